@@ -1,7 +1,7 @@
 // Package bagit implements the enough of the BagIt specification to save and
 // read the BagIt files used by Bendo. It creates zip files which do
-// not use compression. It only supports MD5 and SHA256 checksums for
-// the manifest file.
+// not use compression. It can also write, but not read, bags as tar files.
+// It only supports MD5 and SHA256 checksums for the manifest file.
 //
 // Specific items not implemented from the BagIt specification are fetch files
 // and holely bags. It also doesn't preserve the order of the tags
@@ -1,8 +1,11 @@
 package bagit
 
 import (
+	"archive/tar"
 	"archive/zip"
+	"bytes"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
@@ -14,7 +17,7 @@ import (
 // Writer allows for writing a new bag file. When it is closed, all the
 // relevant tag files and manifests will be written out.
 type Writer struct {
-	z        *zip.Writer      // the underlying zip writer
+	z        archiver         // the underlying zip or tar writer
 	t        Bag              // our bag structure to track the files
 	checksum *Checksum        // pointer to current checksum
 	hw       *util.HashWriter // current hash writer
@@ -29,7 +32,18 @@ func NewWriter(w io.Writer, name string) *Writer {
 	t := New()
 	t.dirname = name + "/"
 	return &Writer{
-		z: zip.NewWriter(w),
+		z: &zipArchiver{z: zip.NewWriter(w)},
+		t: t,
+	}
+}
+
+// NewTarWriter is like NewWriter except the bag is serialized as a tar file
+// instead of a zip file. Bags written this way cannot be read by this package.
+func NewTarWriter(w io.Writer, name string) *Writer {
+	t := New()
+	t.dirname = name + "/"
+	return &Writer{
+		z: &tarArchiver{t: tar.NewWriter(w)},
 		t: t,
 	}
 }
@@ -61,16 +75,55 @@ func (w *Writer) SetTag(tag, content string) {
 // Create a new file inside this bag. The file will be put inside the "data/"
 // directory.
 func (w *Writer) Create(name string) (io.Writer, error) {
+	return w.CreateSize(name, -1)
+}
+
+// CreateSize is like Create, but the size of the file is given in advance.
+// A tar file needs the size of each file before its content, so when writing
+// a tar bag the files made with Create are kept in memory until the next file
+// is created. Use CreateSize to stream large files into a tar bag instead.
+// Exactly size bytes must be written to the file. Names which would be
+// unpacked outside of the "data/" directory return ErrBadName.
+func (w *Writer) CreateSize(name string, size int64) (io.Writer, error) {
+	if !ValidName(name) {
+		return nil, ErrBadName
+	}
 	w.ns++
-	out, err := w.create("data/" + name)
+	out, err := w.create("data/"+name, size)
 	return &countWriter{
 		w:     out,
 		count: &w.sz,
 	}, err
 }
 
+var (
+	// ErrBadName means a file name would be unpacked outside of the
+	// bag's "data/" directory.
+	ErrBadName = errors.New("bagit: bad file name")
+)
+
+// ValidName returns whether the file name stays inside the "data/" directory
+// when the bag is unpacked. That is, it is not empty, does not begin with a
+// slash, and has no ".." elements. Backslashes are treated as slashes, since
+// some programs unpack them that way.
+func ValidName(name string) bool {
+	if name == "" || name[0] == '/' || name[0] == '\\' {
+		return false
+	}
+	elems := strings.FieldsFunc(name, func(r rune) bool {
+		return r == '/' || r == '\\'
+	})
+	for _, elem := range elems {
+		if elem == ".." {
+			return false
+		}
+	}
+	return true
+}
+
 // create is for internal use. It allows non-payload files to be written.
-func (w *Writer) create(name string) (io.Writer, error) {
+// Pass a size of -1 if the size of the file is not known.
+func (w *Writer) create(name string, size int64) (io.Writer, error) {
 	// save checksums in case there is an active writer
 	_ = w.Checksum()
 
@@ -78,12 +131,7 @@ func (w *Writer) create(name string) (io.Writer, error) {
 	w.t.manifest[name] = ck
 	w.checksum = ck
 
-	header := zip.FileHeader{
-		Name:   w.t.dirname + name,
-		Method: zip.Store,
-	}
-	header.SetModTime(time.Now())
-	out, err := w.z.CreateHeader(&header)
+	out, err := w.z.create(w.t.dirname+name, size)
 
 	w.hw = util.NewHashWriter(out)
 
@@ -102,7 +150,7 @@ func (w *Writer) Checksum() *Checksum {
 
 func (w *Writer) writeTags() error {
 	// first write bag-it marker file
-	out, err := w.create("bagit.txt")
+	out, err := w.create("bagit.txt", -1)
 	if err != nil {
 		return err
 	}
@@ -110,7 +158,7 @@ func (w *Writer) writeTags() error {
 	fmt.Fprintf(out, "Tag-File-Character-Encoding: UTF-8\n")
 
 	// now write tags file
-	out, err = w.create("bag-info.txt")
+	out, err = w.create("bag-info.txt", -1)
 	if err != nil {
 		return err
 	}
@@ -162,7 +210,7 @@ func (w *Writer) manifest(istag bool, name string, hash func(Checksum) []byte) {
 			} else {
 				mname = "manifest-" + name + ".txt"
 			}
-			out, _ = w.create(mname)
+			out, _ = w.create(mname, -1)
 		}
 		// The 2 spaces is to be identical to the GNU md5sum output.
 		// Although md5sum outputs " *" to mark binary mode, that
@@ -171,6 +219,81 @@ func (w *Writer) manifest(istag bool, name string, hash func(Checksum) []byte) {
 	}
 }
 
+// An archiver is the container format a bag is serialized into.
+type archiver interface {
+	// create starts a new file in the archive. The size is -1 if it is
+	// not known.
+	create(name string, size int64) (io.Writer, error)
+	Close() error
+}
+
+type zipArchiver struct {
+	z *zip.Writer
+}
+
+func (a *zipArchiver) create(name string, size int64) (io.Writer, error) {
+	header := zip.FileHeader{
+		Name:   name,
+		Method: zip.Store,
+	}
+	header.SetModTime(time.Now())
+	return a.z.CreateHeader(&header)
+}
+
+func (a *zipArchiver) Close() error {
+	return a.z.Close()
+}
+
+// tarArchiver writes files of unknown size into a buffer, and adds them to
+// the tar file once they are complete.
+type tarArchiver struct {
+	t       *tar.Writer
+	pending *bytes.Buffer // content of the file being buffered, if any
+	name    string        // name of the file being buffered
+}
+
+func (a *tarArchiver) create(name string, size int64) (io.Writer, error) {
+	err := a.flush()
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 {
+		a.pending = new(bytes.Buffer)
+		a.name = name
+		return a.pending, nil
+	}
+	err = a.t.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	})
+	return a.t, err
+}
+
+// flush writes any buffered file into the tar file.
+func (a *tarArchiver) flush() error {
+	if a.pending == nil {
+		return nil
+	}
+	buf := a.pending
+	a.pending = nil
+	out, err := a.create(a.name, int64(buf.Len()))
+	if err == nil {
+		_, err = buf.WriteTo(out)
+	}
+	return err
+}
+
+func (a *tarArchiver) Close() error {
+	err := a.flush()
+	if err != nil {
+		return err
+	}
+	return a.t.Close()
+}
+
 // countWriter is an io.Writer that counts the number of bytes written to it.
 type countWriter struct {
 	w     io.Writer
@@ -1,7 +1,10 @@
 package bagit
 
 import (
+	"archive/tar"
 	"bytes"
+	"io/ioutil"
+	"strings"
 	"testing"
 
 	"github.com/ndlib/bendo/store"
@@ -100,3 +103,85 @@ func TestRoundtrip(t *testing.T) {
 
 	f2.Close()
 }
+
+func TestTarWriter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewTarWriter(buf, "zzz-test-bag")
+	out, err := w.CreateSize("hello", 11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Write([]byte("hello there"))
+	out, err = w.Create("a/goodbye")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Write([]byte("goodbye"))
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// read the tar file back and see which files are in it
+	files := make(map[string]string)
+	r := tar.NewReader(buf)
+	for {
+		hdr, err := r.Next()
+		if err != nil {
+			break
+		}
+		content, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = string(content)
+	}
+	var table = []struct {
+		name    string
+		content string
+	}{
+		{"zzz-test-bag/data/hello", "hello there"},
+		{"zzz-test-bag/data/a/goodbye", "goodbye"},
+		{"zzz-test-bag/bagit.txt", "BagIt-Version: " + Version},
+		{"zzz-test-bag/bag-info.txt", "Payload-Oxum: 18.2"},
+		{"zzz-test-bag/manifest-md5.txt", "  data/a/goodbye"},
+		{"zzz-test-bag/manifest-sha256.txt", "  data/hello"},
+		{"zzz-test-bag/tagmanifest-md5.txt", "  bagit.txt"},
+	}
+	for _, tab := range table {
+		content, ok := files[tab.name]
+		if !ok {
+			t.Errorf("File %s is missing", tab.name)
+		} else if !strings.Contains(content, tab.content) {
+			t.Errorf("File %s is %q, expected it to contain %q", tab.name, content, tab.content)
+		}
+	}
+}
+
+func TestValidName(t *testing.T) {
+	var table = []struct {
+		name string
+		ok   bool
+	}{
+		{"a.txt", true},
+		{"dir/a.txt", true},
+		{"a..b", true},
+		{"", false},
+		{"/etc/passwd", false},
+		{"../x", false},
+		{"dir/../../x", false},
+		{"dir/..", false},
+		{`..\x`, false},
+		{`\x`, false},
+	}
+	for _, tab := range table {
+		if ok := ValidName(tab.name); ok != tab.ok {
+			t.Errorf("%q: received %v, expected %v", tab.name, ok, tab.ok)
+		}
+	}
+
+	w := NewWriter(ioutil.Discard, "bad-bag")
+	if _, err := w.Create("../../x"); err != ErrBadName {
+		t.Errorf("Received %v, expected %v", err, ErrBadName)
+	}
+}
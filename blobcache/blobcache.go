@@ -1,12 +1,14 @@
 // Package blobcache implements a simple cache. It is backed by a store, so it
 // can be entirely in memory or disk-backed.
 //
-// While the cached contents are kept in the store, the list recording usage
-// information is kept only in memory. On startup the items in the store are
-// enumerated and taken to populate the cache list in an undetermined order.
+// While the cached contents are kept in the store, the lists recording usage
+// information are kept in memory, and saved into the store every so often so
+// they can be restored on startup. Items in the store which are not in the
+// saved lists are added as the least recently used.
 //
-// The only cache implemented in here uses an LRU item replacement policy. It
-// would be nice for it to use an ARC or 2Q policy instead.
+// There are caches using an LRU item replacement policy (StoreLRU), the 2Q
+// policy (TwoQueue), and a fixed time to live (TimeBased). Any of them can have a
+// small in-memory cache put in front of it (Tiered).
 package blobcache
 
 import (
@@ -14,6 +16,7 @@ import (
 	"errors"
 	"io"
 	"sync"
+	"time"
 
 	"github.com/ndlib/bendo/store"
 )
@@ -34,12 +37,43 @@ type T interface {
 	MaxSize() int64
 }
 
+// An Entry describes an item in a cache.
+type Entry struct {
+	Key        string
+	Size       int64
+	LastAccess time.Time // when the item was added or last read
+	Expires    time.Time // when the item will expire, for a TimeBased cache
+	Pinned     bool      // pinned items are never evicted
+}
+
+// A Manager is a cache whose contents can be listed, and whose items can be
+// pinned so they are not evicted. Pinned items can still be removed with
+// Delete.
+type Manager interface {
+	T
+	// Entries returns every item in the cache, in no particular order.
+	Entries() []Entry
+	// Entry returns the item having the given key, and whether it is in
+	// the cache.
+	Entry(key string) (Entry, bool)
+	// Pin changes whether the given item is pinned. It returns
+	// ErrNotCached if the key is not in the cache.
+	Pin(key string, pinned bool) error
+	// Peek returns the content of an item like Get, but without it
+	// counting as a use of the item.
+	Peek(key string) (store.ReadAtCloser, int64, error)
+}
+
 // A StoreLRU implements a cache using the least recently used (LRU) eviction
 // policy and using a store as the storage backend.
 type StoreLRU struct {
 	// this is the place where cached items are stored
 	s store.Store
 
+	// close this channel to cancel the background goroutine
+	done chan struct{}
+	stop sync.Once // for closing done
+
 	m sync.RWMutex // protects everything below
 
 	// total size in bytes used by the cache. If 0 then
@@ -54,30 +88,81 @@ type StoreLRU struct {
 
 	// set of keys that have a Put() started on them, but not closed yet.
 	pending map[string]struct{}
+
+	dirty bool // has the LRU list changed since it was saved?
+}
+
+// lruFilename is the key we use to persist the LRU list between executions.
+const lruFilename = "LRU-LIST"
+
+// A savedLRU is the form in which the LRU list is persisted.
+type savedLRU struct {
+	Entries []savedEntry // most recently used first
 }
 
 type entry struct {
-	key  string
-	size int64
+	key      string
+	size     int64
+	accessed time.Time
+	pinned   bool
+}
+
+func (e entry) export() Entry {
+	return Entry{Key: e.key, Size: e.size, LastAccess: e.accessed, Pinned: e.pinned}
 }
 
 // NewLRU creates and initializes a new cache structure using the least
 // recently used eviction policy. The given store may already have items in it.
 // You must call Scan() (either inline or in another goroutine) to add the
-// preexisting items in the store to the LRU list.
+// preexisting items in the store to the LRU list. The LRU list is saved in
+// the store when Stop is called, and every so often if the store is not
+// kept in memory.
 func NewLRU(s store.Store, maxSize int64) *StoreLRU {
-	return &StoreLRU{
+	t := &StoreLRU{
 		s:       s,
+		done:    make(chan struct{}),
 		maxSize: maxSize,
 		lru:     list.New(),
 		pending: make(map[string]struct{}),
 	}
+	if persistent(s) {
+		go t.background()
+	}
+	return t
+}
+
+// Stop saves the LRU list and stops the background goroutine started in
+// NewLRU(). Calls after the first do nothing.
+func (t *StoreLRU) Stop() {
+	t.stop.Do(func() {
+		close(t.done)
+		t.writeLRUFile()
+	})
 }
 
 // Scan enumerates the items in the given store and enters them into the LRU
-// cache (if they aren't in it already).
+// cache (if they aren't in it already). The order and sizes saved in the
+// store are used for the items they list. Other items are added as the least
+// recently used, and saved items no longer in the store are dropped. Items
+// which do not fit in the cache are removed from the store.
 func (t *StoreLRU) Scan() {
+	present := make(map[string]bool)
 	for key := range t.s.List() {
+		if !checkpointFile(key) {
+			present[key] = true
+		}
+	}
+	var saved savedLRU
+	readCheckpoint(t.s, lruFilename, &saved)
+	for _, se := range saved.Entries {
+		if !present[se.Key] {
+			continue
+		}
+		delete(present, se.Key)
+		t.scanEntry(se.entry())
+	}
+	// the items we didn't know about
+	for key := range present {
 		if t.Contains(key) {
 			continue
 		}
@@ -86,16 +171,59 @@ func (t *StoreLRU) Scan() {
 			continue
 		}
 		rc.Close()
-		err = t.reserve(size)
-		if err != nil {
-			// this item is too big for the cache.
-			t.s.Delete(key)
-			continue
+		t.scanEntry(entry{key: key, size: size})
+	}
+	t.writeLRUFile()
+}
+
+// scanEntry adds an item found by Scan to the back of the LRU list, if it is
+// not already in the cache. If there is no room for it, it is removed from
+// the store.
+func (t *StoreLRU) scanEntry(ent entry) {
+	if ent.accessed.IsZero() {
+		ent.accessed = time.Now()
+	}
+	t.m.Lock()
+	defer t.m.Unlock()
+	for e := t.lru.Front(); e != nil; e = e.Next() {
+		if e.Value.(entry).key == ent.key {
+			return
+		}
+	}
+	if t.size+ent.size > t.maxSize {
+		t.s.Delete(ent.key)
+		return
+	}
+	t.size += ent.size
+	t.lru.PushBack(ent)
+	t.dirty = true
+}
+
+// background is the goroutine which saves the LRU list every so often.
+func (t *StoreLRU) background() {
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-time.After(checkpointInterval):
+		}
+		t.m.RLock()
+		dirty := t.dirty
+		t.m.RUnlock()
+		if dirty {
+			t.writeLRUFile()
 		}
-		t.linkEntry(entry{key: key, size: size})
 	}
 }
 
+func (t *StoreLRU) writeLRUFile() {
+	t.m.Lock()
+	saved := savedLRU{Entries: saveList(t.lru)}
+	t.dirty = false
+	t.m.Unlock()
+	writeCheckpoint(t.s, lruFilename, saved)
+}
+
 // Contains returns true if the given item is in the cache. It does not
 // update the LRU status, and does not guarantee the item will be in the
 // cache when Get() is called.
@@ -109,13 +237,9 @@ func (t *StoreLRU) Contains(key string) bool {
 // nil is returned for the ReadAtCloser. (NOTE: it is not an error for an item
 // to not be in the cache. Check the ReadAtCloser to see.)
 func (t *StoreLRU) Get(key string) (store.ReadAtCloser, int64, error) {
-	e := t.find(key)
-	if e == nil {
+	if !t.touch(key) {
 		return nil, 0, nil
 	}
-	t.m.Lock()
-	t.lru.MoveToFront(e)
-	t.m.Unlock()
 	rac, size, err := t.s.Open(key)
 	if err != nil {
 		// Something happened, so unlink this item from the lru list
@@ -126,9 +250,32 @@ func (t *StoreLRU) Get(key string) (store.ReadAtCloser, int64, error) {
 	return rac, size, err
 }
 
+// touch makes the given item the most recently used, and returns whether it
+// is in the cache.
+func (t *StoreLRU) touch(key string) bool {
+	e := t.find(key)
+	if e == nil {
+		return false
+	}
+	t.m.Lock()
+	t.lru.MoveToFront(e)
+	ent := e.Value.(entry)
+	ent.accessed = time.Now()
+	e.Value = ent
+	t.dirty = true
+	t.m.Unlock()
+	return true
+}
+
 func (t *StoreLRU) find(key string) *list.Element {
 	t.m.RLock()
 	defer t.m.RUnlock()
+	return t.lookup(key)
+}
+
+// lookup returns the list element for the given key, or nil. The lock must
+// be held.
+func (t *StoreLRU) lookup(key string) *list.Element {
 	for e := t.lru.Front(); e != nil; e = e.Next() {
 		entry := e.Value.(entry)
 		if entry.key == key {
@@ -144,17 +291,28 @@ func (t *StoreLRU) find(key string) *list.Element {
 // closed.
 //
 // Only one writer to a given key can be active at a time. Subsequent Puts
-// will return an error. Also, once an item is in the cache, Puts for it will
-// return an error (until the item is evicted.)
+// will return an error. Putting an item already in the cache replaces it.
 func (t *StoreLRU) Put(key string) (io.WriteCloser, error) {
 	// is there currently a Put pending on that key?
 	t.m.Lock()
 	_, exists := t.pending[key]
 	t.pending[key] = struct{}{} // dosn't hurt since we already know exists
+	var old *list.Element
+	if !exists {
+		old = t.lookup(key)
+	}
+	if old != nil {
+		// forget the old copy so it does not count towards the size
+		t.size -= t.lru.Remove(old).(entry).size
+		t.dirty = true
+	}
 	t.m.Unlock()
 	if exists {
 		return nil, ErrPutPending
 	}
+	if old != nil {
+		t.s.Delete(key)
+	}
 	w, err := t.s.Create(key)
 	// special case situation where the key already exists to try again after
 	// deleting the key.
@@ -202,6 +360,7 @@ func (t *StoreLRU) Delete(key string) error {
 	}
 	t.m.Lock()
 	entry := t.lru.Remove(e).(entry)
+	t.dirty = true
 	t.m.Unlock()
 	err := t.s.Delete(entry.key)
 	err2 := t.reserve(-entry.size) // give the space back
@@ -214,9 +373,20 @@ func (t *StoreLRU) Delete(key string) error {
 // MaxSize returns the maximum size of this cache in bytes.
 // (Not the current size of the cache.)
 func (t *StoreLRU) MaxSize() int64 {
+	t.m.RLock()
+	defer t.m.RUnlock()
 	return t.maxSize
 }
 
+// SetMaxSize changes the maximum size of this cache. If the cache is now
+// larger than the new size, items are evicted until it fits.
+func (t *StoreLRU) SetMaxSize(maxSize int64) error {
+	t.m.Lock()
+	t.maxSize = maxSize
+	t.m.Unlock()
+	return t.reserve(0)
+}
+
 // Size returns the amount currently used by the cache in bytes.
 func (t *StoreLRU) Size() int64 {
 	t.m.RLock()
@@ -229,7 +399,60 @@ func (t *StoreLRU) linkEntry(entry entry) {
 	t.m.Lock()
 	defer t.m.Unlock()
 
+	if entry.accessed.IsZero() {
+		entry.accessed = time.Now()
+	}
 	t.lru.PushFront(entry)
+	t.dirty = true
+}
+
+// Entries returns every item in the cache, the most recently used first.
+func (t *StoreLRU) Entries() []Entry {
+	t.m.RLock()
+	defer t.m.RUnlock()
+	result := make([]Entry, 0, t.lru.Len())
+	for e := t.lru.Front(); e != nil; e = e.Next() {
+		result = append(result, e.Value.(entry).export())
+	}
+	return result
+}
+
+// Entry returns the item having the given key, and whether it is in the
+// cache. The LRU list is not updated.
+func (t *StoreLRU) Entry(key string) (Entry, bool) {
+	e := t.find(key)
+	if e == nil {
+		return Entry{}, false
+	}
+	t.m.RLock()
+	defer t.m.RUnlock()
+	return e.Value.(entry).export(), true
+}
+
+// Peek returns a reader for the given item without changing its place in the
+// LRU list. If the item is not in the cache nil is returned.
+func (t *StoreLRU) Peek(key string) (store.ReadAtCloser, int64, error) {
+	if t.find(key) == nil {
+		return nil, 0, nil
+	}
+	return t.s.Open(key)
+}
+
+// Pin changes whether the given item is pinned. Pinned items are skipped
+// when evicting items to make space, but still count towards the size of
+// the cache. Pins are saved with the LRU list.
+func (t *StoreLRU) Pin(key string, pinned bool) error {
+	e := t.find(key)
+	if e == nil {
+		return ErrNotCached
+	}
+	t.m.Lock()
+	defer t.m.Unlock()
+	ent := e.Value.(entry)
+	ent.pinned = pinned
+	e.Value = ent
+	t.dirty = true
+	return nil
 }
 
 var (
@@ -237,6 +460,7 @@ var (
 	// for the cache.
 	ErrCacheFull  = errors.New("Cache is full and no more items can be removed")
 	ErrPutPending = errors.New("Key is already being added to cache")
+	ErrNotCached  = errors.New("Key is not in the cache")
 )
 
 // reserve space for the passed in size, evicting items if necessary to stay
@@ -248,13 +472,17 @@ func (t *StoreLRU) reserve(size int64) error {
 
 	t.size += size
 	for t.size > t.maxSize {
-		// LRU eviction
+		// LRU eviction, skipping pinned items
 		e := t.lru.Back()
+		for e != nil && e.Value.(entry).pinned {
+			e = e.Prev()
+		}
 		if e == nil {
 			t.size -= size
 			return ErrCacheFull
 		}
 		entry := t.lru.Remove(e).(entry)
+		t.dirty = true
 		err := t.s.Delete(entry.key)
 		if err != nil {
 			t.size -= size
@@ -2,7 +2,9 @@ package blobcache
 
 import (
 	"fmt"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/ndlib/bendo/store"
 )
@@ -43,6 +45,33 @@ func TestEvictionLRU(t *testing.T) {
 	}
 }
 
+func TestSetMaxSizeLRU(t *testing.T) {
+	cache := NewLRU(store.NewMemory(), 100)
+	for i := 0; i < 5; i++ {
+		w, err := cache.Put(fmt.Sprintf("hello-%d", i))
+		if err != nil {
+			t.Fatalf("received %s", err.Error())
+		}
+		w.Write([]byte("hello world"))
+		w.Close()
+	}
+	if cache.Size() != 55 {
+		t.Fatalf("Cache size is %d, expected %d", cache.Size(), 55)
+	}
+	err := cache.SetMaxSize(30)
+	if err != nil {
+		t.Fatalf("received %s", err.Error())
+	}
+	if cache.MaxSize() != 30 || cache.Size() != 22 {
+		t.Errorf("Received max size %d and size %d, expected 30 and 22",
+			cache.MaxSize(), cache.Size())
+	}
+	// the most recent items are kept
+	if !cache.Contains("hello-4") || cache.Contains("hello-0") {
+		t.Errorf("Wrong items evicted")
+	}
+}
+
 func TestTooLargeItemLRU(t *testing.T) {
 	cache := NewLRU(store.NewMemory(), 100)
 	key := "qwerty"
@@ -221,3 +250,166 @@ func TestStoreSyncLRU(t *testing.T) {
 		rac.Close()
 	}
 }
+
+func TestPinLRU(t *testing.T) {
+	cache := NewLRU(store.NewMemory(), 55)
+	for i := 0; i < 5; i++ {
+		w, _ := cache.Put(fmt.Sprintf("hello-%d", i))
+		w.Write([]byte("hello world"))
+		w.Close()
+	}
+	// the oldest item would be evicted first
+	err := cache.Pin("hello-0", true)
+	if err != nil {
+		t.Fatalf("received %s", err.Error())
+	}
+	if err := cache.Pin("missing", true); err != ErrNotCached {
+		t.Errorf("Pin of missing key received %v, expected ErrNotCached", err)
+	}
+	w, _ := cache.Put("hello-5")
+	w.Write([]byte("hello world"))
+	w.Close()
+	if !cache.Contains("hello-0") || cache.Contains("hello-1") {
+		t.Errorf("Wrong items evicted")
+	}
+	e, ok := cache.Entry("hello-0")
+	if !ok || !e.Pinned || e.Size != 11 || e.LastAccess.IsZero() {
+		t.Errorf("Received entry %v, %v", e, ok)
+	}
+	if n := len(cache.Entries()); n != 5 {
+		t.Errorf("Received %d entries, expected 5", n)
+	}
+
+	// a cache full of pinned items cannot take anything new
+	for _, e := range cache.Entries() {
+		cache.Pin(e.Key, true)
+	}
+	w, _ = cache.Put("hello-6")
+	_, err = w.Write([]byte("hello world"))
+	w.Close()
+	if err != ErrCacheFull || cache.Contains("hello-6") {
+		t.Errorf("Received %v, expected ErrCacheFull", err)
+	}
+
+	// pinned items can still be deleted
+	cache.Delete("hello-0")
+	if cache.Contains("hello-0") {
+		t.Errorf("Pinned item was not deleted")
+	}
+}
+
+func TestPersistLRU(t *testing.T) {
+	s := store.NewMemory()
+	cache := NewLRU(s, 100)
+	for i := 0; i < 5; i++ {
+		w, _ := cache.Put(fmt.Sprintf("hello-%d", i))
+		w.Write([]byte("hello world"))
+		w.Close()
+	}
+	// make hello-0 the most recently used
+	r, _, _ := cache.Get("hello-0")
+	r.Close()
+	cache.Pin("hello-4", true)
+	cache.Stop()
+	cache.Stop() // a second stop does nothing
+
+	// change the store behind the cache's back
+	s.Delete("hello-2")
+	w, _ := s.Create("unknown")
+	w.Write([]byte("0123456789"))
+	w.Close()
+
+	cache = NewLRU(s, 100)
+	defer cache.Stop()
+	cache.Scan()
+	var keys []string
+	for _, e := range cache.Entries() {
+		keys = append(keys, e.Key)
+	}
+	expected := "hello-0 hello-4 hello-3 hello-1 unknown"
+	if strings.Join(keys, " ") != expected {
+		t.Errorf("Received order %v, expected %s", keys, expected)
+	}
+	if cache.Size() != 54 {
+		t.Errorf("Received size %d, expected 54", cache.Size())
+	}
+	if e, _ := cache.Entry("hello-4"); !e.Pinned {
+		t.Errorf("Pin was lost")
+	}
+
+	// a smaller cache drops the least recently used items
+	cache2 := NewLRU(s, 30)
+	defer cache2.Stop()
+	cache2.Scan()
+	if !cache2.Contains("hello-0") || !cache2.Contains("hello-4") || cache2.Contains("hello-3") {
+		t.Errorf("Wrong items kept in smaller cache: %v", cache2.Entries())
+	}
+}
+
+func TestPeekLRU(t *testing.T) {
+	cache := NewLRU(store.NewMemory(), 30)
+	defer cache.Stop()
+	putString(t, cache, "first", "0123456789")
+	putString(t, cache, "second", "0123456789")
+	r, size, err := cache.Peek("first")
+	if r == nil || size != 10 || err != nil {
+		t.Fatalf("Received %v, %d, %v", r, size, err)
+	}
+	r.Close()
+	// peeking did not make the first item the most recently used
+	putString(t, cache, "third", "0123456789")
+	putString(t, cache, "fourth", "0123456789")
+	if cache.Contains("first") {
+		t.Errorf("Peek changed the LRU order")
+	}
+	if r, _, _ := cache.Peek("first"); r != nil {
+		t.Errorf("Peek of missing item returned a reader")
+	}
+}
+
+func TestScanCheckpointFiles(t *testing.T) {
+	// a store used by every kind of cache in turn
+	s := store.NewMemory()
+	for _, key := range []string{lruFilename, queueFilename, indexFilename} {
+		w, _ := s.Create(key)
+		w.Write([]byte("{}"))
+		w.Close()
+	}
+	putStore := func(key string) {
+		w, _ := s.Create(key)
+		w.Write([]byte("0123456789"))
+		w.Close()
+	}
+	putStore("item")
+
+	lru := NewLRU(s, 1000)
+	lru.Scan()
+	twoq := NewTwoQueue(s, 1000)
+	twoq.Scan()
+	tb := NewTime(s, time.Hour)
+	tb.Scan()
+	for _, c := range []Manager{lru, twoq, tb} {
+		if len(c.Entries()) != 1 || c.Size() != 10 {
+			t.Errorf("%T: received entries %v", c, c.Entries())
+		}
+	}
+	lru.Stop()
+	twoq.Stop()
+	tb.Stop()
+}
+
+func TestReplaceLRU(t *testing.T) {
+	cache := NewLRU(store.NewMemory(), 100)
+	putString(t, cache, "a", "0123456789")
+	putString(t, cache, "a", "01234")
+	if cache.Size() != 5 {
+		t.Errorf("Received size %d, expected 5", cache.Size())
+	}
+	if n := len(cache.Entries()); n != 1 {
+		t.Errorf("Received %d entries, expected 1", n)
+	}
+	cache.Delete("a")
+	if cache.Size() != 0 || len(cache.Entries()) != 0 {
+		t.Errorf("Received size %d and entries %v", cache.Size(), cache.Entries())
+	}
+}
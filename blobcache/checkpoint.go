@@ -0,0 +1,101 @@
+package blobcache
+
+import (
+	"container/list"
+	"encoding/json"
+	"log"
+	"time"
+
+	raven "github.com/getsentry/raven-go"
+
+	"github.com/ndlib/bendo/store"
+)
+
+// how often the caches save their usage information, if it has changed
+var checkpointInterval = time.Minute
+
+// persistent returns whether the store s keeps its contents once the program
+// exits. There is no point in saving usage information every so often into a
+// store which does not.
+func persistent(s store.Store) bool {
+	_, inMemory := s.(*store.Memory)
+	return !inMemory
+}
+
+// checkpointFile returns whether key is one of the files the caches save their
+// usage information in. Every cache skips all of them when scanning its store,
+// since the store may have been used by a cache of another kind before.
+func checkpointFile(key string) bool {
+	return key == lruFilename || key == queueFilename || key == indexFilename
+}
+
+// A savedEntry is the form in which cache items are persisted.
+type savedEntry struct {
+	Key      string
+	Size     int64
+	Accessed time.Time `json:",omitempty"`
+	Pinned   bool      `json:",omitempty"`
+}
+
+// saveList returns the entries in the list q, from front to back. The list
+// may hold either entry or *qentry values.
+func saveList(q *list.List) []savedEntry {
+	var result []savedEntry
+	for e := q.Front(); e != nil; e = e.Next() {
+		var ent entry
+		switch v := e.Value.(type) {
+		case *qentry:
+			ent = v.entry
+		case entry:
+			ent = v
+		}
+		result = append(result, savedEntry{
+			Key:      ent.key,
+			Size:     ent.size,
+			Accessed: ent.accessed,
+			Pinned:   ent.pinned,
+		})
+	}
+	return result
+}
+
+func (se savedEntry) entry() entry {
+	return entry{key: se.Key, size: se.Size, accessed: se.Accessed, pinned: se.Pinned}
+}
+
+// writeCheckpoint saves v as JSON in the store s under the given key,
+// replacing anything already there.
+func writeCheckpoint(s store.Store, key string, v interface{}) {
+	s.Delete(key)
+	w, err := s.Create(key)
+	if err != nil {
+		log.Println("Error creating", key, ":", err)
+		raven.CaptureError(err, nil)
+		return
+	}
+	err = json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Println("Error writing", key, ":", err)
+		raven.CaptureError(err, nil)
+	}
+	w.Close()
+}
+
+// readCheckpoint loads the JSON saved in the store s under the given key
+// into v. It returns false if there is nothing saved or it cannot be read.
+func readCheckpoint(s store.Store, key string, v interface{}) bool {
+	rac, _, err := s.Open(key)
+	if err != nil {
+		// The file will not exist the first time, so this is not a problem.
+		log.Println("Error opening", key, ":", err)
+		return false
+	}
+	defer rac.Close()
+	err = json.NewDecoder(store.NewReader(rac)).Decode(v)
+	if err != nil {
+		log.Println("Error reading", key, ":", err)
+		raven.CaptureError(err, nil)
+		return false
+	}
+	return true
+}
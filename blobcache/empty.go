@@ -41,6 +41,26 @@ func (EmptyCache) MaxSize() int64 {
 	return 0
 }
 
+// Entries always returns nothing.
+func (EmptyCache) Entries() []Entry {
+	return nil
+}
+
+// Entry always returns false.
+func (EmptyCache) Entry(key string) (Entry, bool) {
+	return Entry{}, false
+}
+
+// Pin always returns ErrNotCached.
+func (EmptyCache) Pin(key string, pinned bool) error {
+	return ErrNotCached
+}
+
+// Peek always returns a cache miss.
+func (EmptyCache) Peek(key string) (store.ReadAtCloser, int64, error) {
+	return nil, 0, nil
+}
+
 type nopCloser struct {
 	io.Writer
 }
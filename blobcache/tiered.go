@@ -0,0 +1,336 @@
+package blobcache
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/ndlib/bendo/store"
+)
+
+// A Tiered cache keeps a small LRU cache of items in memory in front of
+// another cache, which does the real work of storing items. Items read from
+// the other cache are promoted into memory, so the next read does not need to
+// go to the other cache's store (which may be a disk or S3). When the memory
+// tier evicts an item it is demoted, that is, written back to the other cache
+// if the other cache has evicted it in the meantime. Reads answered from
+// memory are also passed on to the other cache's usage lists, when it has
+// them, so hot items are not evicted there in the first place.
+//
+// Only items no larger than 1/8 of the memory size are kept in memory. New
+// items are added only to the other cache. The size, max size, and entries
+// of a Tiered cache are those of the other cache.
+type Tiered struct {
+	next T // the cache behind the memory tier
+
+	m       sync.Mutex // protects everything below
+	size    int64      // bytes of items in memory
+	maxSize int64      // the most bytes to keep in memory
+
+	// list of items in memory. front of list is MRU, tail is LRU.
+	lru   *list.List // of *memEntry
+	items map[string]*list.Element
+
+	// gen is incremented whenever an item is deleted or replaced, so that
+	// a promotion racing with it does not bring back the old content.
+	gen uint64
+
+	// keys of the items evicted from memory which are being demoted. The
+	// value is set if the item is deleted or replaced in the meantime, so
+	// the demotion does not bring back the old content.
+	demoting map[string]bool
+
+	stats TierStats
+}
+
+// TierStats gives the usage of each tier of a Tiered cache.
+type TierStats struct {
+	MemorySize    int64 // bytes of items kept in memory
+	MemoryMaxSize int64
+	MemoryHits    int64 // reads answered from memory
+	MemoryMisses  int64
+	StoreHits     int64 // reads not in memory but in the other cache
+	StoreMisses   int64 // reads in neither tier
+}
+
+type memEntry struct {
+	key  string
+	data []byte
+}
+
+// NewTiered returns a cache keeping up to memSize bytes of items in memory
+// in front of the cache next.
+func NewTiered(next T, memSize int64) *Tiered {
+	return &Tiered{
+		next:     next,
+		maxSize:  memSize,
+		lru:      list.New(),
+		items:    make(map[string]*list.Element),
+		demoting: make(map[string]bool),
+	}
+}
+
+// A toucher is a cache which can record a read of an item without opening
+// it.
+type toucher interface {
+	touch(key string) bool
+}
+
+// Next returns the cache behind the memory tier.
+func (t *Tiered) Next() T {
+	return t.next
+}
+
+// Contains returns whether the key is in either tier.
+func (t *Tiered) Contains(key string) bool {
+	t.m.Lock()
+	_, ok := t.items[key]
+	t.m.Unlock()
+	return ok || t.next.Contains(key)
+}
+
+// Get returns the item having the given key from memory, if it is there, and
+// otherwise from the other cache. Items read from the other cache which are
+// small enough are then kept in memory.
+func (t *Tiered) Get(key string) (store.ReadAtCloser, int64, error) {
+	t.m.Lock()
+	if e, ok := t.items[key]; ok {
+		t.lru.MoveToFront(e)
+		t.stats.MemoryHits++
+		data := e.Value.(*memEntry).data
+		t.m.Unlock()
+		if tc, ok := t.next.(toucher); ok {
+			tc.touch(key)
+		}
+		return byteReader{bytes.NewReader(data)}, int64(len(data)), nil
+	}
+	t.stats.MemoryMisses++
+	gen := t.gen
+	limit := t.maxSize / 8
+	t.m.Unlock()
+
+	r, size, err := t.next.Get(key)
+	if err != nil || r == nil {
+		t.m.Lock()
+		t.stats.StoreMisses++
+		t.m.Unlock()
+		return r, size, err
+	}
+	t.m.Lock()
+	t.stats.StoreHits++
+	t.m.Unlock()
+	if size > limit {
+		return r, size, nil
+	}
+	data := make([]byte, size)
+	n, err := r.ReadAt(data, 0)
+	r.Close()
+	if err == io.EOF && int64(n) == size {
+		err = nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	t.promote(key, data, gen)
+	return byteReader{bytes.NewReader(data)}, size, nil
+}
+
+// promote adds an item to memory, provided nothing has been deleted or
+// replaced since gen was read.
+func (t *Tiered) promote(key string, data []byte, gen uint64) {
+	t.m.Lock()
+	if gen != t.gen || t.items[key] != nil {
+		t.m.Unlock()
+		return
+	}
+	t.items[key] = t.lru.PushFront(&memEntry{key: key, data: data})
+	t.size += int64(len(data))
+	evicted := t.evict()
+	t.m.Unlock()
+	if len(evicted) > 0 {
+		go t.demote(evicted)
+	}
+}
+
+// evict removes items from memory until it is under the maximum size, and
+// returns the items removed, which need to be passed to demote. The lock
+// must be held when calling this.
+func (t *Tiered) evict() []*memEntry {
+	var evicted []*memEntry
+	for t.size > t.maxSize {
+		e := t.lru.Back()
+		if e == nil {
+			break
+		}
+		me := t.lru.Remove(e).(*memEntry)
+		delete(t.items, me.key)
+		t.size -= int64(len(me.data))
+		if _, ok := t.demoting[me.key]; ok {
+			// an earlier copy is still being demoted
+			continue
+		}
+		t.demoting[me.key] = false
+		evicted = append(evicted, me)
+	}
+	return evicted
+}
+
+// demote writes the given items into the other cache if it no longer has
+// them. An item deleted or replaced while this is going on is removed from
+// the other cache again.
+func (t *Tiered) demote(entries []*memEntry) {
+	for _, me := range entries {
+		var w io.WriteCloser
+		var err error
+		if !t.next.Contains(me.key) {
+			w, err = t.next.Put(me.key)
+			// ErrPutPending means someone else is adding it anyway
+			if err != nil && err != ErrPutPending {
+				log.Println("blobcache: demote", me.key, err)
+			}
+		}
+		if w != nil {
+			_, err = w.Write(me.data)
+			if err != nil {
+				log.Println("blobcache: demote", me.key, err)
+			}
+		}
+		// hold the lock so the item cannot be put again until the old
+		// content is removed
+		t.m.Lock()
+		dropped := t.demoting[me.key]
+		delete(t.demoting, me.key)
+		if w != nil {
+			w.Close()
+			if dropped {
+				t.next.Delete(me.key)
+			}
+		}
+		t.m.Unlock()
+	}
+}
+
+// forget removes the key from memory and keeps any promotion or demotion in
+// progress from adding it back.
+func (t *Tiered) forget(key string) {
+	t.m.Lock()
+	t.gen++
+	if _, ok := t.demoting[key]; ok {
+		t.demoting[key] = true
+	}
+	if e, ok := t.items[key]; ok {
+		t.lru.Remove(e)
+		delete(t.items, key)
+		t.size -= int64(len(e.Value.(*memEntry).data))
+	}
+	t.m.Unlock()
+}
+
+// Put adds an item to the other cache. Any copy of the item in memory is
+// dropped.
+func (t *Tiered) Put(key string) (io.WriteCloser, error) {
+	t.forget(key)
+	return t.next.Put(key)
+}
+
+// Delete removes an item from both tiers.
+func (t *Tiered) Delete(key string) error {
+	t.forget(key)
+	return t.next.Delete(key)
+}
+
+// Size returns the size of the other cache.
+func (t *Tiered) Size() int64 {
+	return t.next.Size()
+}
+
+// MaxSize returns the maximum size of the other cache.
+func (t *Tiered) MaxSize() int64 {
+	return t.next.MaxSize()
+}
+
+// MemoryMaxSize returns the most bytes kept in memory.
+func (t *Tiered) MemoryMaxSize() int64 {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.maxSize
+}
+
+// SetMemoryMaxSize changes the most bytes kept in memory. If the new size is
+// smaller, items are evicted from memory until the memory tier fits.
+func (t *Tiered) SetMemoryMaxSize(memSize int64) {
+	t.m.Lock()
+	t.maxSize = memSize
+	evicted := t.evict()
+	t.m.Unlock()
+	if len(evicted) > 0 {
+		go t.demote(evicted)
+	}
+}
+
+// Stats returns the usage of the two tiers.
+func (t *Tiered) Stats() TierStats {
+	t.m.Lock()
+	defer t.m.Unlock()
+	result := t.stats
+	result.MemorySize = t.size
+	result.MemoryMaxSize = t.maxSize
+	return result
+}
+
+// Entries returns the entries of the other cache, if it is a Manager.
+func (t *Tiered) Entries() []Entry {
+	if m, ok := t.next.(Manager); ok {
+		return m.Entries()
+	}
+	return nil
+}
+
+// Entry returns the given entry of the other cache, if it is a Manager.
+func (t *Tiered) Entry(key string) (Entry, bool) {
+	if m, ok := t.next.(Manager); ok {
+		return m.Entry(key)
+	}
+	return Entry{}, false
+}
+
+// Pin pins the item in the other cache, if it is a Manager.
+func (t *Tiered) Pin(key string, pinned bool) error {
+	if m, ok := t.next.(Manager); ok {
+		return m.Pin(key, pinned)
+	}
+	return ErrNotCached
+}
+
+// Peek reads the item from the other cache, if it is a Manager, without
+// promoting it into memory.
+func (t *Tiered) Peek(key string) (store.ReadAtCloser, int64, error) {
+	if m, ok := t.next.(Manager); ok {
+		return m.Peek(key)
+	}
+	return nil, 0, nil
+}
+
+// Scan scans the other cache, if it needs scanning.
+func (t *Tiered) Scan() {
+	if c, ok := t.next.(interface{ Scan() }); ok {
+		c.Scan()
+	}
+}
+
+// Stop stops the other cache, if it needs stopping. The memory tier is not
+// saved.
+func (t *Tiered) Stop() {
+	if c, ok := t.next.(interface{ Stop() }); ok {
+		c.Stop()
+	}
+}
+
+// byteReader is a ReadAtCloser over an item kept in memory.
+type byteReader struct {
+	*bytes.Reader
+}
+
+func (byteReader) Close() error { return nil }
@@ -0,0 +1,134 @@
+package blobcache
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/ndlib/bendo/store"
+)
+
+func TestTiered(t *testing.T) {
+	next := NewLRU(store.NewMemory(), 100)
+	defer next.Stop()
+	cache := NewTiered(next, 80) // keeps items of up to 10 bytes in memory
+	putString(t, cache, "small", "0123456789")
+	putString(t, cache, "large", "0123456789a")
+
+	get := func(key string) string {
+		r, size, err := cache.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r == nil {
+			return ""
+		}
+		defer r.Close()
+		p := make([]byte, size)
+		r.ReadAt(p, 0)
+		return string(p)
+	}
+	for i := 0; i < 2; i++ {
+		if v := get("small"); v != "0123456789" {
+			t.Errorf("Received %q", v)
+		}
+		if v := get("large"); v != "0123456789a" {
+			t.Errorf("Received %q", v)
+		}
+	}
+	get("missing")
+	expected := TierStats{
+		MemorySize:    10,
+		MemoryMaxSize: 80,
+		MemoryHits:    1,
+		MemoryMisses:  4,
+		StoreHits:     3,
+		StoreMisses:   1,
+	}
+	if stats := cache.Stats(); stats != expected {
+		t.Errorf("Received stats %+v, expected %+v", stats, expected)
+	}
+
+	// a deleted item is removed from both tiers
+	cache.Delete("small")
+	if cache.Contains("small") || get("small") != "" {
+		t.Errorf("Deleted item is still in the cache")
+	}
+	if cache.Stats().MemorySize != 0 {
+		t.Errorf("Deleted item is still in memory")
+	}
+}
+
+func TestDemoteTiered(t *testing.T) {
+	next := NewLRU(store.NewMemory(), 30)
+	defer next.Stop()
+	cache := NewTiered(next, 80)
+	putString(t, cache, "hot", "0123456789")
+	r, _, _ := cache.Get("hot")
+	r.Close()
+	// the other cache evicts the hot item, since it never sees it being read
+	for i := 0; i < 3; i++ {
+		putString(t, cache, fmt.Sprintf("other-%d", i), "0123456789")
+	}
+	if next.Contains("hot") || !cache.Contains("hot") {
+		t.Fatalf("Hot item is not only in memory")
+	}
+	// evicting it from memory puts it back
+	cache.SetMemoryMaxSize(0)
+	for i := 0; i < 100 && !next.Contains("hot"); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	r, _, _ = next.Get("hot")
+	if r == nil {
+		t.Fatalf("Hot item was not demoted")
+	}
+	b, _ := ioutil.ReadAll(io.NewSectionReader(r, 0, 10))
+	r.Close()
+	if string(b) != "0123456789" {
+		t.Errorf("Demoted item has content %q", b)
+	}
+}
+
+func TestDemoteDeletedTiered(t *testing.T) {
+	next := NewLRU(store.NewMemory(), 30)
+	defer next.Stop()
+	cache := NewTiered(next, 80)
+	putString(t, cache, "hot", "0123456789")
+	r, _, _ := cache.Get("hot")
+	r.Close()
+	next.Delete("hot")
+	// the item is deleted after it is evicted from memory but before it is
+	// demoted
+	cache.m.Lock()
+	cache.maxSize = 0
+	evicted := cache.evict()
+	cache.m.Unlock()
+	cache.Delete("hot")
+	cache.demote(evicted)
+	if cache.Contains("hot") || next.Contains("hot") {
+		t.Errorf("Deleted item was demoted")
+	}
+}
+
+func TestTouchTiered(t *testing.T) {
+	next := NewLRU(store.NewMemory(), 30)
+	defer next.Stop()
+	cache := NewTiered(next, 80)
+	putString(t, cache, "hot", "0123456789")
+	r, _, _ := cache.Get("hot")
+	r.Close()
+	putString(t, cache, "other-0", "0123456789")
+	putString(t, cache, "other-1", "0123456789")
+	// a read from memory makes it the most recently used in the other cache
+	r, _, _ = cache.Get("hot")
+	r.Close()
+	if cache.Stats().MemoryHits != 1 {
+		t.Fatalf("Item was not read from memory")
+	}
+	putString(t, cache, "other-2", "0123456789")
+	if !next.Contains("hot") || next.Contains("other-0") {
+		t.Errorf("Wrong item evicted from the other cache")
+	}
+}
@@ -19,7 +19,9 @@ import (
 // removed from the cache.
 //
 // The total amount of storage used by this cache will vary over time, and may
-// grow without bound.
+// grow without bound unless a maximum size is set with SetMaxSize. When an
+// item would put the cache over its maximum size, the items closest to
+// expiring are removed early to make room.
 type TimeBased struct {
 	// place to put cached content
 	s store.Store
@@ -36,6 +38,13 @@ type TimeBased struct {
 	// the total size of the cache yet.
 	size int64
 
+	// the maximum size of the cache in bytes. 0 means there is no limit.
+	maxSize int64
+
+	// bytes written by Puts which have not been closed yet. They count
+	// towards the maximum size.
+	reserved int64
+
 	// cache items hashed by key
 	items map[string]timeEntry
 
@@ -60,9 +69,21 @@ type TimeBased struct {
 const indexFilename = "ITEM-LIST"
 
 type timeEntry struct {
-	Key     string
-	Size    int64
-	Expires time.Time
+	Key      string
+	Size     int64
+	Expires  time.Time
+	Accessed time.Time
+	Pinned   bool `json:",omitempty"`
+}
+
+func (e timeEntry) export() Entry {
+	return Entry{
+		Key:        e.Key,
+		Size:       e.Size,
+		LastAccess: e.Accessed,
+		Expires:    e.Expires,
+		Pinned:     e.Pinned,
+	}
 }
 
 // NewTime returns a new time-based cache using s as the backing store and with
@@ -79,11 +100,13 @@ func NewTime(s store.Store, d time.Duration) *TimeBased {
 	return te
 }
 
-// Stop will stop the background goroutine that was spawned in NewTime().
+// Stop will stop the background goroutine that was spawned in NewTime(), and
+// save the index file.
 //
 // (Is there a better name than `Stop`?)
 func (te *TimeBased) Stop() {
 	close(te.done)
+	te.writeIndexFile()
 }
 
 // Contains returns true if the given key is in the cache when the function is
@@ -99,13 +122,9 @@ func (te *TimeBased) Contains(key string) bool {
 func (te *TimeBased) Get(key string) (store.ReadAtCloser, int64, error) {
 	te.m.Lock()
 	defer te.m.Unlock()
-	item, exists := te.items[key]
-	if !exists {
+	if !te.renew(key) {
 		return nil, 0, nil
 	}
-	// update the expires time
-	item.Expires = time.Now().Add(te.ttl)
-	te.items[key] = item
 	rac, size, err := te.s.Open(key)
 	if err != nil {
 		// Something happened getting the item. Assume it is bad and just remove
@@ -115,6 +134,36 @@ func (te *TimeBased) Get(key string) (store.ReadAtCloser, int64, error) {
 	return rac, size, err
 }
 
+// renew pushes back the expiration time of the given item, and returns
+// whether it is in the cache. The lock must be held.
+func (te *TimeBased) renew(key string) bool {
+	item, exists := te.items[key]
+	if !exists {
+		return false
+	}
+	item.Accessed = time.Now()
+	item.Expires = item.Accessed.Add(te.ttl)
+	te.items[key] = item
+	return true
+}
+
+// touch pushes back the expiration time of the given item, as Get does, and
+// returns whether it is in the cache.
+func (te *TimeBased) touch(key string) bool {
+	te.m.Lock()
+	defer te.m.Unlock()
+	return te.renew(key)
+}
+
+// Peek returns a reader for the given item without updating its expiration
+// time. If the item is not in the cache nil is returned.
+func (te *TimeBased) Peek(key string) (store.ReadAtCloser, int64, error) {
+	if !te.Contains(key) {
+		return nil, 0, nil
+	}
+	return te.s.Open(key)
+}
+
 // Put returns a writer for saving the content of the given key. The item is
 // added to the cache when the writer is closed. The error `ErrPutPending` is
 // returned if someone else is currently saving content to the key. If the item
@@ -123,6 +172,10 @@ func (te *TimeBased) Put(key string) (io.WriteCloser, error) {
 	te.m.Lock()
 	_, exists := te.pending[key]
 	te.pending[key] = struct{}{} // doesn't hurt since we already know exists
+	if !exists {
+		// remove any old copy so it does not count towards the size
+		te.delete(key)
+	}
 	te.m.Unlock()
 	if exists {
 		return nil, ErrPutPending
@@ -148,7 +201,12 @@ func (te *TimeBased) addEntry(entry timeEntry) {
 	te.m.Lock()
 	defer te.m.Unlock()
 
-	entry.Expires = time.Now().Add(te.ttl)
+	entry.Accessed = time.Now()
+	entry.Expires = entry.Accessed.Add(te.ttl)
+	if old, ok := te.items[entry.Key]; ok {
+		// the item is being replaced
+		te.size -= old.Size
+	}
 	te.items[entry.Key] = entry
 	te.expireList = append(te.expireList, entry)
 	te.size += entry.Size
@@ -157,6 +215,7 @@ func (te *TimeBased) addEntry(entry timeEntry) {
 func (te *TimeBased) save(w *writer) {
 	te.addEntry(timeEntry{Key: w.key, Size: w.size})
 	te.m.Lock()
+	te.reserved -= w.size // it is now counted in size
 	delete(te.pending, w.key)
 	te.m.Unlock()
 }
@@ -170,12 +229,84 @@ func (te *TimeBased) unpending(key string) {
 // discard is used by a child Writer object to signal this item should be
 // forgotten about.
 func (te *TimeBased) discard(w *writer) {
+	te.m.Lock()
+	te.reserved -= w.size // give space back to cache
+	te.m.Unlock()
 	te.unpending(w.key)
 }
 
-// reserve is needed for `saver` interface.
-// we add the size of the new object all at once in save().
-func (te *TimeBased) reserve(int64) error { return nil }
+// reserve sets aside space for size more bytes of an item being written,
+// removing the items closest to expiring if the cache would go over its
+// maximum size. The size of the new item is added to the cache all at once
+// in save(). It returns ErrCacheFull if not enough items can be removed.
+func (te *TimeBased) reserve(size int64) error {
+	te.m.Lock()
+	te.reserved += size
+	full := te.maxSize > 0 && te.size+te.reserved > te.maxSize
+	te.m.Unlock()
+	if !full {
+		return nil
+	}
+	te.expireM.Lock()
+	defer te.expireM.Unlock()
+	te.m.Lock()
+	defer te.m.Unlock()
+	err := te.makeRoom()
+	if err != nil {
+		te.reserved -= size
+	}
+	return err
+}
+
+// makeRoom removes unpinned items in order of their expiration times until
+// the cache fits in its maximum size. It returns ErrCacheFull if there are
+// no more items which can be removed. It assumes both expireM and m are
+// already held.
+func (te *TimeBased) makeRoom() error {
+	if te.maxSize == 0 || te.size+te.reserved <= te.maxSize {
+		return nil
+	}
+	// The expireList has the expiration times items had when they were
+	// added. Items read since then expire later, so they are moved into
+	// renewed, which is kept sorted, and the next victim is the earlier of
+	// the first items in the two lists.
+	sort.Sort(byExpires(te.expireList))
+	list := te.expireList
+	var keep, renewed []timeEntry
+	var err error
+	for err == nil && te.size+te.reserved > te.maxSize {
+		var next timeEntry
+		if len(list) > 0 && (len(renewed) == 0 || list[0].Expires.Before(renewed[0].Expires)) {
+			next, list = list[0], list[1:]
+		} else if len(renewed) > 0 {
+			next, renewed = renewed[0], renewed[1:]
+		} else {
+			err = ErrCacheFull
+			break
+		}
+		item, ok := te.items[next.Key]
+		switch {
+		case !ok:
+			// it was already removed
+		case item.Pinned:
+			keep = append(keep, item)
+		case item.Expires.After(next.Expires):
+			i := sort.Search(len(renewed), func(i int) bool {
+				return renewed[i].Expires.After(item.Expires)
+			})
+			renewed = append(renewed, timeEntry{})
+			copy(renewed[i+1:], renewed[i:])
+			renewed[i] = item
+		default:
+			err = te.delete(item.Key)
+			if err != nil {
+				keep = append(keep, item)
+			}
+		}
+	}
+	te.expireList = append(append(keep, renewed...), list...)
+	return err
+}
 
 // Delete removes the given item from the cache.
 func (te *TimeBased) Delete(key string) error {
@@ -205,9 +336,86 @@ func (te *TimeBased) Size() int64 {
 	return te.size
 }
 
-// MaxSize always returns 0 since there is no size limit for a TimeBased cache.
+// SetTTL changes the length of time items are kept after their last access.
+// Items already in the cache keep their current expiration times until they
+// are accessed again.
+func (te *TimeBased) SetTTL(d time.Duration) {
+	te.m.Lock()
+	te.ttl = d
+	te.m.Unlock()
+}
+
+// Entries returns every item in the cache, in no particular order.
+func (te *TimeBased) Entries() []Entry {
+	te.m.RLock()
+	defer te.m.RUnlock()
+	result := make([]Entry, 0, len(te.items))
+	for _, item := range te.items {
+		result = append(result, item.export())
+	}
+	return result
+}
+
+// Entry returns the item having the given key, and whether it is in the
+// cache. Its expiration time is not changed.
+func (te *TimeBased) Entry(key string) (Entry, bool) {
+	te.m.RLock()
+	defer te.m.RUnlock()
+	item, ok := te.items[key]
+	return item.export(), ok
+}
+
+// Pin changes whether the given item is pinned. Pinned items do not expire.
+// When an item is unpinned its expiration clock is reset. Pins are saved in
+// the index file.
+func (te *TimeBased) Pin(key string, pinned bool) error {
+	te.m.Lock()
+	item, ok := te.items[key]
+	if ok {
+		item.Pinned = pinned
+		if !pinned {
+			item.Expires = time.Now().Add(te.ttl)
+		}
+		te.items[key] = item
+	}
+	te.m.Unlock()
+	if !ok {
+		return ErrNotCached
+	}
+	te.writeIndexFile()
+	return nil
+}
+
+// MaxSize returns the maximum size of the cache in bytes, or 0 if there is no
+// limit.
 func (te *TimeBased) MaxSize() int64 {
-	return 0
+	te.m.RLock()
+	defer te.m.RUnlock()
+	return te.maxSize
+}
+
+// SetMaxSize changes the maximum size of the cache. A size of 0 removes the
+// limit. If the cache is now larger than the new size, the items closest to
+// expiring are removed until it fits.
+func (te *TimeBased) SetMaxSize(maxSize int64) error {
+	te.expireM.Lock()
+	defer te.expireM.Unlock()
+	te.m.Lock()
+	defer te.m.Unlock()
+	te.maxSize = maxSize
+	return te.makeRoom()
+}
+
+// trim removes items until the cache fits in its maximum size.
+func (te *TimeBased) trim() {
+	te.expireM.Lock()
+	te.m.Lock()
+	err := te.makeRoom()
+	te.m.Unlock()
+	te.expireM.Unlock()
+	if err != nil {
+		log.Println("blobcache: cannot trim cache to its maximum size:", err)
+	}
 }
 
 // background is the goroutine that manages saving the index file and purging
@@ -215,15 +423,18 @@ func (te *TimeBased) MaxSize() int64 {
 func (te *TimeBased) background() {
 	te.readIndexFile()
 	te.scanstore()
+	te.trim() // in case the store holds too much
 
-	// Figure out how often to check for expired keys and save the index file.
-	// Duration is either 1/4 of the TTL or once a day, whichever is shorter.
-	// These amounts are arbitrary, feel free to adjust.
-	d := te.ttl / 4
-	if d > 24*time.Hour {
-		d = 24 * time.Hour
-	}
 	for {
+		// Figure out how often to check for expired keys and save the index
+		// file. Duration is either 1/4 of the TTL or once a day, whichever is
+		// shorter. These amounts are arbitrary, feel free to adjust.
+		te.m.RLock()
+		d := te.ttl / 4
+		te.m.RUnlock()
+		if d > 24*time.Hour {
+			d = 24 * time.Hour
+		}
 		select {
 		case <-te.done:
 			return
@@ -251,25 +462,28 @@ func (te *TimeBased) expireKeys() {
 
 	now := time.Now()
 	sort.Sort(byExpires(te.expireList))
+	var keep []timeEntry
 	for i, item := range te.expireList {
 		if item.Expires.After(now) {
-			te.expireList = te.expireList[i:]
+			keep = append(keep, te.expireList[i:]...)
 			break
 		}
 		// get the actual item to ensure we don't remove something prematurely
 		te.m.Lock()
 		item, ok := te.items[item.Key]
 		if ok {
-			if item.Expires.After(now) {
-				// item's expire time has been updated, add to the end of list
-				// it will be sorted into the correct position next time.
-				te.expireList = append(te.expireList, item)
+			if item.Pinned || item.Expires.After(now) {
+				// item's expire time has been updated, or it is pinned.
+				// Keep it in the list, it will be sorted into the correct
+				// position next time.
+				keep = append(keep, item)
 			} else {
 				te.delete(item.Key)
 			}
 		}
 		te.m.Unlock()
 	}
+	te.expireList = keep
 }
 
 type byExpires []timeEntry
@@ -306,9 +520,21 @@ func (te *TimeBased) readIndexFile() {
 		raven.CaptureError(err, nil)
 		return
 	}
+	defer rac.Close()
 	dec := json.NewDecoder(store.NewReader(rac))
 	var items map[string]timeEntry
-	dec.Decode(items)
+	err = dec.Decode(&items)
+	if err != nil {
+		log.Println("Error reading", indexFilename, ":", err)
+		raven.CaptureError(err, nil)
+		return
+	}
+
+	// the index may list items which have since been removed from the store
+	present := make(map[string]bool)
+	for key := range te.s.List() {
+		present[key] = true
+	}
 
 	// insert the new items into the map
 	te.expireM.Lock()
@@ -316,6 +542,9 @@ func (te *TimeBased) readIndexFile() {
 	te.m.Lock()
 	defer te.m.Unlock()
 	for _, v := range items {
+		if !present[v.Key] {
+			continue
+		}
 		// NOTE: calling addEntry will reset the timestamps. so we inline the
 		// relevant code here.
 		if _, exists := te.items[v.Key]; !exists {
@@ -330,7 +559,7 @@ func (te *TimeBased) readIndexFile() {
 // in our index. The added items are given the default expiry time.
 func (te *TimeBased) scanstore() {
 	for key := range te.s.List() {
-		if key == indexFilename || te.Contains(key) {
+		if checkpointFile(key) || te.Contains(key) {
 			continue
 		}
 		rac, size, err := te.s.Open(key)
@@ -347,5 +576,6 @@ func (te *TimeBased) scanstore() {
 func (te *TimeBased) Scan() {
 	te.readIndexFile()
 	te.scanstore()
+	te.trim()
 	te.writeIndexFile() // make sure things we just scanned end up in the index
 }
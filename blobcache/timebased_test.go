@@ -63,3 +63,139 @@ func TestExpireListTB(t *testing.T) {
 		r.Close()
 	}
 }
+
+func TestPinTB(t *testing.T) {
+	s := store.NewMemory()
+	cache := NewTime(s, time.Second)
+	defer cache.Stop()
+	for _, key := range []string{"pinned", "unpinned"} {
+		w, _ := cache.Put(key)
+		w.Write([]byte("hello world"))
+		w.Close()
+	}
+	err := cache.Pin("pinned", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Pin("missing", true); err != ErrNotCached {
+		t.Errorf("Pin of missing key received %v, expected ErrNotCached", err)
+	}
+
+	time.Sleep(1200 * time.Millisecond)
+	if !cache.Contains("pinned") || cache.Contains("unpinned") {
+		t.Errorf("Wrong items expired")
+	}
+
+	// the pin is kept in the index file
+	cache2 := NewTime(s, time.Second)
+	defer cache2.Stop()
+	cache2.Scan()
+	e, ok := cache2.Entry("pinned")
+	if !ok || !e.Pinned {
+		t.Errorf("Received entry %v, %v after reload", e, ok)
+	}
+}
+
+func TestMaxSizeTB(t *testing.T) {
+	cache := NewTime(store.NewMemory(), time.Hour)
+	defer cache.Stop()
+	cache.SetMaxSize(30)
+	if cache.MaxSize() != 30 {
+		t.Errorf("Received max size %d, expected 30", cache.MaxSize())
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		putString(t, cache, key, "0123456789")
+		time.Sleep(time.Millisecond)
+	}
+	// reading an item pushes back its expiration time
+	r, _, _ := cache.Get("a")
+	r.Close()
+	putString(t, cache, "d", "0123456789")
+	for key, expected := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+		if cache.Contains(key) != expected {
+			t.Errorf("Contains(%q) is %v, expected %v", key, !expected, expected)
+		}
+	}
+	if cache.Size() != 30 {
+		t.Errorf("Received size %d, expected 30", cache.Size())
+	}
+
+	// replacing an item does not count it twice
+	putString(t, cache, "d", "01234")
+	if cache.Size() != 25 || !cache.Contains("a") {
+		t.Errorf("Received size %d, expected 25", cache.Size())
+	}
+
+	// nothing can be removed if everything is pinned
+	for _, key := range []string{"a", "c", "d"} {
+		cache.Pin(key, true)
+	}
+	w, err := cache.Put("e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Write([]byte("0123456789"))
+	if err != ErrCacheFull {
+		t.Errorf("Received %v, expected ErrCacheFull", err)
+	}
+	w.Close()
+	if cache.Contains("e") || cache.Size() != 25 {
+		t.Errorf("Item was added to a full cache")
+	}
+
+	// shrinking the cache removes the unpinned items first
+	cache.Pin("c", false)
+	cache.SetMaxSize(20)
+	if cache.Contains("c") || !cache.Contains("a") || !cache.Contains("d") {
+		t.Errorf("Wrong items removed when shrinking")
+	}
+}
+
+func TestShrinkOrderTB(t *testing.T) {
+	cache := NewTime(store.NewMemory(), time.Hour)
+	defer cache.Stop()
+	for i := 0; i < 10; i++ {
+		putString(t, cache, fmt.Sprintf("item-%d", i), "0123456789")
+		time.Sleep(time.Millisecond)
+	}
+	// reading the first item makes it the last to expire
+	r, _, _ := cache.Get("item-0")
+	r.Close()
+	err := cache.SetMaxSize(30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kept []string
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("item-%d", i)
+		if cache.Contains(key) {
+			kept = append(kept, key)
+		}
+	}
+	if fmt.Sprint(kept) != "[item-0 item-8 item-9]" {
+		t.Errorf("Received %v, expected [item-0 item-8 item-9]", kept)
+	}
+}
+
+func TestScanMissingTB(t *testing.T) {
+	s := store.NewMemory()
+	cache := NewTime(s, time.Hour)
+	for _, key := range []string{"kept", "removed"} {
+		w, _ := cache.Put(key)
+		w.Write([]byte("hello world"))
+		w.Close()
+	}
+	cache.Stop()
+	// the index still lists this item
+	s.Delete("removed")
+
+	cache2 := NewTime(s, time.Hour)
+	defer cache2.Stop()
+	cache2.Scan()
+	if !cache2.Contains("kept") || cache2.Contains("removed") {
+		t.Errorf("Received wrong items after reload")
+	}
+	if size := cache2.Size(); size != 11 {
+		t.Errorf("Received size %d, expected 11", size)
+	}
+}
@@ -0,0 +1,489 @@
+package blobcache
+
+import (
+	"container/list"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ndlib/bendo/store"
+)
+
+// A TwoQueue cache uses the 2Q replacement policy. Items added to the cache
+// go into a first-in first-out probation queue. When an item is evicted from
+// that queue its key is remembered in a ghost queue for a while. Items added
+// again while their key is still remembered go into a main queue managed as
+// an LRU list. Items in the probation queue are evicted first, as long as it
+// holds more than a quarter of the cache. This way a burst of items read only
+// once, such as a bulk harvest, cannot flush the popular items out of the
+// main queue.
+//
+// The queues are saved in the store when Stop is called, and every so often if
+// the store is not kept in memory.
+// Call Scan to restore them and to add the items already in the store.
+type TwoQueue struct {
+	// place to put cached content
+	s store.Store
+
+	// close this channel to cancel the background goroutine
+	done chan struct{}
+	stop sync.Once // for closing done
+
+	m sync.RWMutex // protects everything below
+
+	size    int64 // total size in bytes of the items in the cache
+	maxSize int64 // the maximum amount of space we may use
+	inSize  int64 // total size of the items in the probation queue
+	outSize int64 // total size of the items remembered in the ghost queue
+
+	// front of each list is the most recent
+	in    *list.List // probation queue of *qentry
+	main  *list.List // main queue of *qentry
+	ghost *list.List // ghost queue of entry, only the key and size are used
+
+	items  map[string]*list.Element // elements of in and main, by key
+	ghosts map[string]*list.Element // elements of ghost, by key
+
+	// set of keys that have a Put() started on them, but not closed yet.
+	pending map[string]struct{}
+
+	dirty bool // have the queues changed since they were saved?
+}
+
+type qentry struct {
+	entry
+	hot bool // is this in the main queue?
+}
+
+// queueFilename is the key we use to persist the queues between executions.
+const queueFilename = "QUEUE-LIST"
+
+// NewTwoQueue creates a new cache using the 2Q eviction policy, using s as
+// the backing store and holding at most maxSize bytes. The given store may
+// already have items in it. You must call Scan() (either inline or in another
+// goroutine) to add them to the cache.
+func NewTwoQueue(s store.Store, maxSize int64) *TwoQueue {
+	t := &TwoQueue{
+		s:       s,
+		done:    make(chan struct{}),
+		maxSize: maxSize,
+		in:      list.New(),
+		main:    list.New(),
+		ghost:   list.New(),
+		items:   make(map[string]*list.Element),
+		ghosts:  make(map[string]*list.Element),
+		pending: make(map[string]struct{}),
+	}
+	if persistent(s) {
+		go t.background()
+	}
+	return t
+}
+
+// Stop saves the queues and stops the background goroutine started in
+// NewTwoQueue(). Calls after the first do nothing.
+func (t *TwoQueue) Stop() {
+	t.stop.Do(func() {
+		close(t.done)
+		t.writeQueueFile()
+	})
+}
+
+// Contains returns true if the given item is in the cache. It does not
+// change the queues.
+func (t *TwoQueue) Contains(key string) bool {
+	t.m.RLock()
+	_, ok := t.items[key]
+	t.m.RUnlock()
+	return ok
+}
+
+// Get returns a reader for the given item. If the item is not in the cache
+// nil is returned for the ReadAtCloser. An item in the main queue becomes the
+// most recently used. An item in the probation queue keeps its place.
+func (t *TwoQueue) Get(key string) (store.ReadAtCloser, int64, error) {
+	if !t.touch(key) {
+		return nil, 0, nil
+	}
+	rac, size, err := t.s.Open(key)
+	if err != nil {
+		// Something happened, so forget this item.
+		// We assume Open will always return at least one of rac and err as nil.
+		err = t.Delete(key)
+	}
+	return rac, size, err
+}
+
+// touch records a read of the given item, as Get does, and returns whether it
+// is in the cache.
+func (t *TwoQueue) touch(key string) bool {
+	t.m.Lock()
+	defer t.m.Unlock()
+	e, ok := t.items[key]
+	if !ok {
+		return false
+	}
+	qe := e.Value.(*qentry)
+	qe.accessed = time.Now()
+	if qe.hot {
+		t.main.MoveToFront(e)
+	}
+	t.dirty = true
+	return true
+}
+
+// Peek returns a reader for the given item without changing the queues. If
+// the item is not in the cache nil is returned.
+func (t *TwoQueue) Peek(key string) (store.ReadAtCloser, int64, error) {
+	if !t.Contains(key) {
+		return nil, 0, nil
+	}
+	return t.s.Open(key)
+}
+
+// Put returns a WriteCloser which saves writes to it in the cache under the
+// provided key. Items are evicted from the cache as content is written. The
+// item is not added to the cache until the Writer is closed. Only one writer
+// to a given key can be active at a time. Any item already having the key is
+// removed.
+func (t *TwoQueue) Put(key string) (io.WriteCloser, error) {
+	t.m.Lock()
+	_, exists := t.pending[key]
+	t.pending[key] = struct{}{}
+	var old *qentry
+	if e, ok := t.items[key]; ok && !exists {
+		// forget the old copy so it does not count towards the size
+		old = t.unlink(e)
+		t.size -= old.size
+	}
+	t.m.Unlock()
+	if exists {
+		return nil, ErrPutPending
+	}
+	if old != nil {
+		t.s.Delete(key)
+	}
+	w, err := t.s.Create(key)
+	// since we passed the pending check, there are no open Puts on that key
+	if err == store.ErrKeyExists {
+		t.s.Delete(key)
+		w, err = t.s.Create(key)
+	}
+	if err != nil {
+		t.unpending(key)
+		return nil, err
+	}
+	return &writer{parent: t, key: key, w: w}, nil
+}
+
+func (t *TwoQueue) unpending(key string) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	delete(t.pending, key)
+}
+
+// save adds a newly written item. It goes into the main queue if its key is
+// in the ghost queue, and into the probation queue otherwise.
+func (t *TwoQueue) save(w *writer) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	qe := &qentry{entry: entry{key: w.key, size: w.size, accessed: time.Now()}}
+	if g, ok := t.ghosts[w.key]; ok {
+		t.removeGhost(g)
+		qe.hot = true
+	}
+	t.link(qe, true)
+	delete(t.pending, w.key)
+}
+
+// discard handles unsuccessful writes on a new entry
+func (t *TwoQueue) discard(w *writer) {
+	t.s.Delete(w.key)
+	t.unpending(w.key)
+	t.reserve(-w.size) // give space back to cache
+}
+
+// link adds qe to the front (or back) of its queue. The lock must be held.
+// The space for it should already be reserved.
+func (t *TwoQueue) link(qe *qentry, front bool) {
+	q := t.in
+	if qe.hot {
+		q = t.main
+	} else {
+		t.inSize += qe.size
+	}
+	if front {
+		t.items[qe.key] = q.PushFront(qe)
+	} else {
+		t.items[qe.key] = q.PushBack(qe)
+	}
+	t.dirty = true
+}
+
+// unlink removes the element e from its queue. The lock must be held. The
+// space used by it is not given back.
+func (t *TwoQueue) unlink(e *list.Element) *qentry {
+	qe := e.Value.(*qentry)
+	if qe.hot {
+		t.main.Remove(e)
+	} else {
+		t.in.Remove(e)
+		t.inSize -= qe.size
+	}
+	delete(t.items, qe.key)
+	t.dirty = true
+	return qe
+}
+
+// addGhost remembers an item evicted from the probation queue, and forgets
+// the oldest ghosts if there are too many. The lock must be held.
+func (t *TwoQueue) addGhost(ent entry, front bool) {
+	if g, ok := t.ghosts[ent.key]; ok {
+		t.removeGhost(g)
+	}
+	if front {
+		t.ghosts[ent.key] = t.ghost.PushFront(ent)
+	} else {
+		t.ghosts[ent.key] = t.ghost.PushBack(ent)
+	}
+	t.outSize += ent.size
+	for t.outSize > t.maxSize/2 && t.ghost.Len() > 0 {
+		t.removeGhost(t.ghost.Back())
+	}
+}
+
+// removeGhost removes an element from the ghost queue. The lock must be held.
+func (t *TwoQueue) removeGhost(g *list.Element) {
+	ent := t.ghost.Remove(g).(entry)
+	delete(t.ghosts, ent.key)
+	t.outSize -= ent.size
+}
+
+// Delete removes an item from the cache, even if it is pinned. It is not an
+// error to remove a key which is not present.
+func (t *TwoQueue) Delete(key string) error {
+	t.m.Lock()
+	if g, ok := t.ghosts[key]; ok {
+		t.removeGhost(g)
+	}
+	e, ok := t.items[key]
+	if !ok {
+		t.m.Unlock()
+		return nil
+	}
+	qe := t.unlink(e)
+	t.size -= qe.size
+	t.m.Unlock()
+	return t.s.Delete(key)
+}
+
+// reserve space for the passed in size, evicting items if necessary to stay
+// under maxSize. Size can be negative to cancel a previous reservation.
+// Nothing is reserved if there is an error.
+func (t *TwoQueue) reserve(size int64) error {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	t.size += size
+	for t.size > t.maxSize {
+		e := t.victim()
+		if e == nil {
+			t.size -= size
+			return ErrCacheFull
+		}
+		qe := t.unlink(e)
+		err := t.s.Delete(qe.key)
+		if err != nil {
+			// put it back where it was
+			t.link(qe, false)
+			t.size -= size
+			return err
+		}
+		t.size -= qe.size
+		if !qe.hot {
+			t.addGhost(qe.entry, true)
+		}
+	}
+	return nil
+}
+
+// victim returns the element to evict next, or nil if there is nothing which
+// can be evicted. The lock must be held.
+func (t *TwoQueue) victim() *list.Element {
+	first, second := t.main, t.in
+	if t.inSize > t.maxSize/4 || t.main.Len() == 0 {
+		first, second = t.in, t.main
+	}
+	if e := lastUnpinned(first); e != nil {
+		return e
+	}
+	return lastUnpinned(second)
+}
+
+// lastUnpinned returns the element closest to the back of q which is not
+// pinned, or nil if there is none.
+func lastUnpinned(q *list.List) *list.Element {
+	e := q.Back()
+	for e != nil && e.Value.(*qentry).pinned {
+		e = e.Prev()
+	}
+	return e
+}
+
+// MaxSize returns the maximum size of this cache in bytes.
+func (t *TwoQueue) MaxSize() int64 {
+	t.m.RLock()
+	defer t.m.RUnlock()
+	return t.maxSize
+}
+
+// SetMaxSize changes the maximum size of this cache. If the cache is now
+// larger than the new size, items are evicted until it fits.
+func (t *TwoQueue) SetMaxSize(maxSize int64) error {
+	t.m.Lock()
+	t.maxSize = maxSize
+	t.m.Unlock()
+	return t.reserve(0)
+}
+
+// Size returns the amount currently used by the cache in bytes.
+func (t *TwoQueue) Size() int64 {
+	t.m.RLock()
+	defer t.m.RUnlock()
+	return t.size
+}
+
+// Entries returns every item in the cache, the main queue first.
+func (t *TwoQueue) Entries() []Entry {
+	t.m.RLock()
+	defer t.m.RUnlock()
+	result := make([]Entry, 0, len(t.items))
+	for _, q := range []*list.List{t.main, t.in} {
+		for e := q.Front(); e != nil; e = e.Next() {
+			result = append(result, e.Value.(*qentry).export())
+		}
+	}
+	return result
+}
+
+// Entry returns the item having the given key, and whether it is in the
+// cache. The queues are not changed.
+func (t *TwoQueue) Entry(key string) (Entry, bool) {
+	t.m.RLock()
+	defer t.m.RUnlock()
+	e, ok := t.items[key]
+	if !ok {
+		return Entry{}, false
+	}
+	return e.Value.(*qentry).export(), true
+}
+
+// Pin changes whether the given item is pinned. Pinned items are skipped
+// when evicting items to make space, but still count towards the size of
+// the cache. Pins are saved with the queues.
+func (t *TwoQueue) Pin(key string, pinned bool) error {
+	t.m.Lock()
+	defer t.m.Unlock()
+	e, ok := t.items[key]
+	if !ok {
+		return ErrNotCached
+	}
+	e.Value.(*qentry).pinned = pinned
+	t.dirty = true
+	return nil
+}
+
+// background is the goroutine which saves the queues every so often.
+func (t *TwoQueue) background() {
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-time.After(checkpointInterval):
+		}
+		t.m.RLock()
+		dirty := t.dirty
+		t.m.RUnlock()
+		if dirty {
+			t.writeQueueFile()
+		}
+	}
+}
+
+// A savedQueues is the form in which the queues are persisted, each with
+// the most recent item first.
+type savedQueues struct {
+	In    []savedEntry
+	Main  []savedEntry
+	Ghost []savedEntry
+}
+
+func (t *TwoQueue) writeQueueFile() {
+	t.m.Lock()
+	queues := savedQueues{
+		In:    saveList(t.in),
+		Main:  saveList(t.main),
+		Ghost: saveList(t.ghost),
+	}
+	t.dirty = false
+	t.m.Unlock()
+	writeCheckpoint(t.s, queueFilename, queues)
+}
+
+// Scan restores the queues saved in the store and then adds any other items
+// in the store to the back of the probation queue. Saved items no longer in
+// the store are dropped. Items are evicted if the cache is now too large.
+func (t *TwoQueue) Scan() {
+	present := make(map[string]bool)
+	for key := range t.s.List() {
+		if !checkpointFile(key) {
+			present[key] = true
+		}
+	}
+	var queues savedQueues
+	readCheckpoint(t.s, queueFilename, &queues)
+	t.m.Lock()
+	restore := func(saved []savedEntry, hot bool) {
+		for _, se := range saved {
+			if !present[se.Key] {
+				continue
+			}
+			delete(present, se.Key)
+			if _, ok := t.items[se.Key]; ok {
+				continue
+			}
+			t.size += se.Size
+			t.link(&qentry{entry: se.entry(), hot: hot}, false)
+		}
+	}
+	restore(queues.Main, true)
+	restore(queues.In, false)
+	for _, se := range queues.Ghost {
+		if _, ok := t.items[se.Key]; !ok {
+			t.addGhost(entry{key: se.Key, size: se.Size}, false)
+		}
+	}
+	t.m.Unlock()
+
+	// the items we didn't know about
+	for key := range present {
+		if t.Contains(key) {
+			continue
+		}
+		rac, size, err := t.s.Open(key)
+		if err != nil {
+			continue
+		}
+		rac.Close()
+		t.m.Lock()
+		t.size += size
+		t.link(&qentry{entry: entry{key: key, size: size, accessed: time.Now()}}, false)
+		t.m.Unlock()
+	}
+	err := t.reserve(0)
+	if err != nil {
+		log.Println("Scan:", err)
+	}
+	t.writeQueueFile()
+}
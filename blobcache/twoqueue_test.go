@@ -0,0 +1,135 @@
+package blobcache
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/ndlib/bendo/store"
+)
+
+// putString adds an item having the given content to the cache.
+func putString(t *testing.T, cache T, key, content string) {
+	w, err := cache.Put(key)
+	if err != nil {
+		t.Fatalf("Put %s: received %s", key, err.Error())
+	}
+	w.Write([]byte(content))
+	w.Close()
+}
+
+func TestScanResistance2Q(t *testing.T) {
+	cache := NewTwoQueue(store.NewMemory(), 100)
+	defer cache.Stop()
+	// popular items are added, evicted, and added again
+	putString(t, cache, "popular-1", "0123456789")
+	putString(t, cache, "popular-2", "0123456789")
+	for i := 0; i < 10; i++ {
+		putString(t, cache, fmt.Sprintf("first-%d", i), "0123456789")
+	}
+	if cache.Contains("popular-1") || cache.Contains("popular-2") {
+		t.Fatalf("Popular items were not evicted")
+	}
+	putString(t, cache, "popular-1", "0123456789")
+	putString(t, cache, "popular-2", "0123456789")
+
+	// a harvest of items read once does not evict them
+	for i := 0; i < 100; i++ {
+		putString(t, cache, fmt.Sprintf("harvest-%d", i), "0123456789")
+	}
+	if !cache.Contains("popular-1") || !cache.Contains("popular-2") {
+		t.Errorf("Popular items were evicted by the harvest")
+	}
+	if !cache.Contains("harvest-99") || cache.Contains("harvest-0") {
+		t.Errorf("Wrong harvest items kept")
+	}
+	if cache.Size() > 100 {
+		t.Errorf("Cache size is %d, expected at most 100", cache.Size())
+	}
+}
+
+func TestReplace2Q(t *testing.T) {
+	cache := NewTwoQueue(store.NewMemory(), 100)
+	defer cache.Stop()
+	putString(t, cache, "a", "0123456789")
+	putString(t, cache, "a", "01234")
+	if cache.Size() != 5 {
+		t.Errorf("Received size %d, expected 5", cache.Size())
+	}
+	if n := len(cache.Entries()); n != 1 {
+		t.Errorf("Received %d entries, expected 1", n)
+	}
+	r, size, _ := cache.Get("a")
+	if r == nil || size != 5 {
+		t.Fatalf("Received size %d, expected 5", size)
+	}
+	r.Close()
+	// deleting it leaves nothing behind
+	cache.Delete("a")
+	if cache.Size() != 0 || len(cache.Entries()) != 0 {
+		t.Errorf("Received size %d and entries %v", cache.Size(), cache.Entries())
+	}
+}
+
+func TestPin2Q(t *testing.T) {
+	cache := NewTwoQueue(store.NewMemory(), 30)
+	defer cache.Stop()
+	putString(t, cache, "pinned", "0123456789")
+	if err := cache.Pin("pinned", true); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		putString(t, cache, fmt.Sprintf("other-%d", i), "0123456789")
+	}
+	if !cache.Contains("pinned") {
+		t.Errorf("Pinned item was evicted")
+	}
+	if err := cache.Pin("missing", true); err != ErrNotCached {
+		t.Errorf("Pin of missing key received %v, expected ErrNotCached", err)
+	}
+}
+
+func TestPersist2Q(t *testing.T) {
+	s := store.NewMemory()
+	cache := NewTwoQueue(s, 100)
+	putString(t, cache, "hot", "0123456789")
+	for i := 0; i < 10; i++ {
+		putString(t, cache, fmt.Sprintf("cold-%d", i), "0123456789")
+	}
+	putString(t, cache, "hot", "0123456789")
+	putString(t, cache, "pinned", "0123456789")
+	cache.Pin("pinned", true)
+	cache.Stop()
+	cache.Stop() // a second stop does nothing
+
+	// change the store behind the cache's back
+	s.Delete("cold-9")
+	w, _ := s.Create("unknown")
+	w.Write([]byte("01234"))
+	w.Close()
+
+	cache = NewTwoQueue(s, 100)
+	defer cache.Stop()
+	cache.Scan()
+	if cache.Contains("cold-9") || !cache.Contains("unknown") {
+		t.Errorf("Store changes not picked up")
+	}
+	// the unknown item is the first to go, and the hot item is still hot
+	entries := cache.Entries()
+	if entries[0].Key != "hot" || entries[len(entries)-1].Key != "unknown" {
+		t.Errorf("Received entries %v", entries)
+	}
+	if e, _ := cache.Entry("pinned"); !e.Pinned {
+		t.Errorf("Pin was lost")
+	}
+	if cache.Size() != 95 {
+		t.Errorf("Received size %d, expected 95", cache.Size())
+	}
+	// the ghost queue is kept too
+	putString(t, cache, "cold-0", "0123456789")
+	cache.m.RLock()
+	hot := cache.items["cold-0"].Value.(*qentry).hot
+	cache.m.RUnlock()
+	if !hot {
+		t.Errorf("Evicted item was not remembered")
+	}
+}
@@ -111,3 +111,21 @@ func parselocation(location string, addition string) store.Store {
 	log.Println("Problem parsing location", location)
 	return nil
 }
+
+// fillDir returns the directory inside cacheDir to keep the files of blobs
+// being copied into the cache in, emptying it of any left from before. It
+// returns "" if cacheDir is not on the file system.
+func fillDir(cacheDir string) string {
+	u, err := url.Parse(cacheDir)
+	if err != nil || (u.Scheme != "" && u.Scheme != "file") {
+		return ""
+	}
+	dir := filepath.Join(u.Path, "fill")
+	os.RemoveAll(dir)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		log.Println("fillDir:", err)
+		return ""
+	}
+	return dir
+}
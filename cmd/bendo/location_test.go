@@ -1,7 +1,9 @@
 package main
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/ndlib/bendo/store"
@@ -113,3 +115,25 @@ func init() {
 		os.Setenv("DS3_SECRET_KEY", "192.168.1.70:8008")
 	}
 }
+
+func TestFillDir(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "bendo-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+	leftover := filepath.Join(cacheDir, "fill", "bendo-fill-123")
+	os.MkdirAll(filepath.Dir(leftover), 0755)
+	ioutil.WriteFile(leftover, []byte("hello"), 0644)
+
+	dir := fillDir(cacheDir)
+	if dir != filepath.Join(cacheDir, "fill") {
+		t.Errorf("Received %q", dir)
+	}
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Errorf("Leftover fill file was not removed: %v", err)
+	}
+	if dir := fillDir("s3:/bucket/prefix"); dir != "" {
+		t.Errorf("Received %q for an S3 cache, expected none", dir)
+	}
+}
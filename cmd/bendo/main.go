@@ -1,11 +1,16 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
@@ -24,21 +29,56 @@ import (
 //Config info needed for Bendo
 
 type bendoConfig struct {
-	StoreDir     string
-	Tokenfile    string
-	CacheDir     string
-	CacheSize    int64
-	CacheTimeout string
-	PortNumber   string
-	PProfPort    string
-	Mysql        string
-	CowHost      string
-	CowToken     string
+	StoreDir        string
+	Tokenfile       string
+	JWTKeyFile      string
+	JWTAudience     string
+	JWTUserClaim    string
+	JWTRoleClaim    string
+	JWTScopeClaim   string
+	UseTokenDB      bool
+	CacheDir        string
+	CacheSize       int64
+	CacheTimeout    string
+	CacheMaxSize    int64
+	CacheStrategy   string
+	CacheChunkSize  int64
+	CacheMemorySize int64
+	CacheScrubRate  int64
+	PortNumber      string
+	PProfPort       string
+	TLS             tlsConfig
+	Mysql           string
+	CowHost         string
+	CowToken        string
+	SigningKey      string
+	DisableFixity   bool
+	Limits          limitConfig
 }
 
-func main() {
-	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+// tlsConfig gives the settings for serving HTTPS. If CertFile is empty the
+// server uses HTTP.
+type tlsConfig struct {
+	CertFile       string
+	KeyFile        string
+	MinVersion     string   // "1.0", "1.1", "1.2", or "1.3"
+	Ciphers        []string // names as used by the crypto/tls package
+	ClientCAFile   string   // if given, client certificates are verified
+	RequireClient  bool     // require every client to give a certificate
+	ClientUserFile string   // maps client certificate subjects to users
+}
 
+// limitConfig gives the request limits for each role and for specific users.
+// The keys of Roles are role names, e.g. "read".
+type limitConfig struct {
+	Roles map[string]server.Limit
+	Users map[string]server.Limit
+}
+
+// readConfig returns the configuration in the given file, using the default
+// values for anything not given. If fname is empty, all the default values
+// are used.
+func readConfig(fname string) (*bendoConfig, error) {
 	// Start with the Default values
 	config := &bendoConfig{
 		StoreDir:     ".",
@@ -52,16 +92,27 @@ func main() {
 		CowHost:      "",
 		CowToken:     "",
 	}
+	// If config file name is provided, try to open & decode it
+	if fname != "" {
+		if _, err := toml.DecodeFile(fname, config); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+func main() {
+	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
 
 	var configFile = flag.String("config-file", "", "Configuration File")
 	flag.Parse()
-	// If config file name is provided, try to open & decode it
 	if *configFile != "" {
 		log.Printf("Using config file %s\n", *configFile)
-		if _, err := toml.DecodeFile(*configFile, config); err != nil {
-			log.Println(err)
-			return
-		}
+	}
+	config, err := readConfig(*configFile)
+	if err != nil {
+		log.Println(err)
+		return
 	}
 
 	log.Println("==========")
@@ -70,6 +121,11 @@ func main() {
 	log.Println("CacheDir =", config.CacheDir)
 	log.Println("CacheSize =", config.CacheSize)
 	log.Println("CacheTimeout =", config.CacheTimeout)
+	log.Println("CacheMaxSize =", config.CacheMaxSize)
+	log.Println("CacheStrategy =", config.CacheStrategy)
+	log.Println("CacheChunkSize =", config.CacheChunkSize)
+	log.Println("CacheMemorySize =", config.CacheMemorySize)
+	log.Println("CacheScrubRate =", config.CacheScrubRate)
 
 	// use the config values to set up the server
 	var s = &server.RESTServer{
@@ -77,24 +133,34 @@ func main() {
 		Validator:  nil,
 		PortNumber: config.PortNumber,
 		PProfPort:  config.PProfPort,
+		SigningKey: []byte(config.SigningKey),
 	}
 
 	// Use the config settings to update s.
 	// All the setup* functions panic on error.
-	setupTokens(config, s)
 	// set up preservation store. Do this before setting up the database.
 	setupItemStore(config, s)
 	setupCache(config, s)
 	setupTransactionStore(config, s)
 	setupUploadStore(config, s)
 	setupDatabase(config, s)
+	// the tokens may be in the database, so do these after it.
+	setupTokens(config, s)
+	setupLimits(config, s)
+	certs := setupTLS(config, s)
+	if config.DisableFixity {
+		s.DisableFixity = true
+	}
+
+	rl := &reloader{fname: *configFile, s: s, certs: certs, current: config}
+	s.Reload = rl.reload
 
 	// install signal handlers
 	sig := make(chan os.Signal, 5)
-	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	go signalHandler(sig, s)
 
-	err := s.Run()
+	err = s.Run()
 	if err != nil {
 		log.Println(err)
 	}
@@ -107,6 +173,11 @@ func signalHandler(sig <-chan os.Signal, svr *server.RESTServer) {
 		switch s {
 		case syscall.SIGINT, syscall.SIGTERM:
 			svr.Stop() // this will cause Run to exit
+		case syscall.SIGHUP:
+			err := svr.Reload()
+			if err != nil {
+				log.Println("Reload:", err)
+			}
 		}
 	}
 }
@@ -132,17 +203,168 @@ func setupItemStore(config *bendoConfig, s *server.RESTServer) {
 
 // setupTokens configures the token verification. It will panic on error.
 func setupTokens(config *bendoConfig, s *server.RESTServer) {
+	v, err := newValidator(config, s.TokenDatabase)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	s.Validator = v
+}
+
+// newValidator returns the token validator described by config. The token
+// database db is only used if config enables it.
+func newValidator(config *bendoConfig, db server.TokenDB) (server.TokenValidator, error) {
+	var validators server.MultiValidator
 	if config.Tokenfile != "" {
-		var err error
 		log.Printf("Using user token file %s\n", config.Tokenfile)
-		s.Validator, err = server.NewListValidatorFile(config.Tokenfile)
+		v, err := server.NewListValidatorFile(config.Tokenfile)
 		if err != nil {
-			log.Fatalln(err)
+			return nil, err
 		}
-	} else {
+		validators = append(validators, v)
+	}
+	if config.JWTKeyFile != "" {
+		log.Printf("Using JWT key file %s\n", config.JWTKeyFile)
+		v, err := server.NewJWTValidatorFile(config.JWTKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		v.Audience = config.JWTAudience
+		v.UserClaim = config.JWTUserClaim
+		v.RoleClaim = config.JWTRoleClaim
+		v.ScopeClaim = config.JWTScopeClaim
+		validators = append(validators, v)
+	}
+	if config.UseTokenDB {
+		if db == nil {
+			return nil, fmt.Errorf("UseTokenDB is set but there is no database")
+		}
+		log.Println("Using token database")
+		validators = append(validators, server.DBValidator{DB: db})
+	}
+	switch len(validators) {
+	case 0:
 		log.Printf("No user token file specified")
-		s.Validator = server.NobodyValidator{}
+		return server.NobodyValidator{}, nil
+	case 1:
+		return validators[0], nil
+	default:
+		return validators, nil
+	}
+}
+
+// setupTLS configures serving HTTPS and the use of client certificates. It
+// returns the loader for the server certificate, or nil if HTTPS is not
+// used. It will panic on error.
+func setupTLS(config *bendoConfig, s *server.RESTServer) *server.CertReloader {
+	if config.TLS.CertFile == "" {
+		return nil
+	}
+	tc, certs, err := newTLSConfig(config.TLS)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Println("Using TLS certificate", config.TLS.CertFile)
+	s.TLSConfig = tc
+	if config.TLS.ClientUserFile != "" {
+		if config.TLS.ClientCAFile == "" {
+			log.Fatalln("TLS.ClientUserFile needs TLS.ClientCAFile to verify client certificates")
+		}
+		log.Println("Using client certificate user file", config.TLS.ClientUserFile)
+		v, err := server.NewSubjectValidatorFile(config.TLS.ClientUserFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		s.CertValidator = v
+	}
+	return certs
+}
+
+// newTLSConfig returns the tls.Config described by config, along with the
+// loader for its certificate.
+func newTLSConfig(config tlsConfig) (*tls.Config, *server.CertReloader, error) {
+	certs, err := server.NewCertReloader(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	tc := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if config.MinVersion != "" {
+		versions := map[string]uint16{
+			"1.0": tls.VersionTLS10,
+			"1.1": tls.VersionTLS11,
+			"1.2": tls.VersionTLS12,
+			"1.3": tls.VersionTLS13,
+		}
+		v, ok := versions[config.MinVersion]
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown TLS version %q", config.MinVersion)
+		}
+		tc.MinVersion = v
+	}
+	for _, name := range config.Ciphers {
+		id, ok := cipherSuite(name)
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown TLS cipher %q", name)
+		}
+		tc.CipherSuites = append(tc.CipherSuites, id)
+	}
+	if config.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(config.ClientCAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		tc.ClientCAs = x509.NewCertPool()
+		if !tc.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("no certificates in %s", config.ClientCAFile)
+		}
+		tc.ClientAuth = tls.VerifyClientCertIfGiven
+		if config.RequireClient {
+			tc.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return tc, certs, nil
+}
+
+// cipherSuite returns the id of the cipher suite with the given name.
+// Insecure suites are not allowed.
+func cipherSuite(name string) (uint16, bool) {
+	for _, c := range tls.CipherSuites() {
+		if c.Name == name {
+			return c.ID, true
+		}
 	}
+	return 0, false
+}
+
+// setupLimits configures the per-user request limits. It will panic on error.
+// There is always a Limiter, since there may be limits in the token file.
+func setupLimits(config *bendoConfig, s *server.RESTServer) {
+	roles, err := roleLimits(config)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if len(roles) > 0 || len(config.Limits.Users) > 0 {
+		log.Println("Using request limits")
+	}
+	s.Limits = &server.Limiter{
+		Roles: roles,
+		Users: config.Limits.Users,
+	}
+}
+
+// roleLimits returns the role limits in config, indexed by Role.
+func roleLimits(config *bendoConfig) (map[server.Role]server.Limit, error) {
+	result := make(map[server.Role]server.Limit)
+	for name, limit := range config.Limits.Roles {
+		role := server.AtoRole(name)
+		if role == server.RoleUnknown && strings.ToLower(name) != "unknown" {
+			return nil, fmt.Errorf("unknown role in Limits: %s", name)
+		}
+		result[role] = limit
+	}
+	return result, nil
 }
 
 func setupCache(config *bendoConfig, s *server.RESTServer) {
@@ -151,19 +373,55 @@ func setupCache(config *bendoConfig, s *server.RESTServer) {
 	if config.CacheDir == "" || size == 0 {
 		log.Println("Not using blob cache")
 		s.Cache = blobcache.EmptyCache{}
-	} else {
-		v := parselocation(config.CacheDir, "blobcache")
-		if v == nil {
-			log.Fatalln("no location for cache")
-		}
-		if timeout != 0 {
-			log.Println("Using time-based cache strategy")
-			s.Cache = blobcache.NewTime(v, timeout)
-		} else {
-			log.Println("Using size-based cache strategy")
-			s.Cache = blobcache.NewLRU(v, size)
+		return
+	}
+	v := parselocation(config.CacheDir, "blobcache")
+	if v == nil {
+		log.Fatalln("no location for cache")
+	}
+	switch cacheStrategy(config) {
+	case "time":
+		log.Println("Using time-based cache strategy")
+		tc := blobcache.NewTime(v, timeout)
+		tc.SetMaxSize(config.CacheMaxSize * 1000000) // config is in MB
+		s.Cache = tc
+	case "lru":
+		log.Println("Using size-based cache strategy")
+		s.Cache = blobcache.NewLRU(v, size)
+	case "2q":
+		log.Println("Using 2Q cache strategy")
+		s.Cache = blobcache.NewTwoQueue(v, size)
+	default:
+		log.Fatalln("Unknown CacheStrategy", config.CacheStrategy)
+	}
+	if config.CacheMemorySize > 0 {
+		log.Println("Keeping part of the cache in memory")
+		s.Cache = blobcache.NewTiered(s.Cache, config.CacheMemorySize*1000000)
+	}
+	s.ChunkSize = config.CacheChunkSize * 1000000 // config is in MB
+	s.CacheScrubRate = config.CacheScrubRate * 1000000
+	s.FillDir = fillDir(config.CacheDir)
+}
+
+// cacheStrategy returns the eviction strategy to use for the blob cache,
+// either "time", "lru", or "2q". A CacheTimeout always means the time-based
+// strategy, and any CacheStrategy given with it is ignored. Unknown strategies
+// are returned as given.
+func cacheStrategy(config *bendoConfig) string {
+	timeout, _ := time.ParseDuration(config.CacheTimeout)
+	if timeout != 0 {
+		if config.CacheStrategy != "" {
+			log.Println("Warning: CacheTimeout is set, so CacheStrategy", config.CacheStrategy, "is ignored")
 		}
+		return "time"
+	}
+	switch strings.ToLower(config.CacheStrategy) {
+	case "", "lru", "size":
+		return "lru"
+	case "2q":
+		return "2q"
 	}
+	return config.CacheStrategy
 }
 
 func setupTransactionStore(config *bendoConfig, s *server.RESTServer) {
@@ -179,6 +437,9 @@ func setupUploadStore(config *bendoConfig, s *server.RESTServer) {
 func setupDatabase(config *bendoConfig, s *server.RESTServer) {
 	var db interface {
 		server.FixityDB
+		server.BlobDB
+		server.TokenDB
+		server.AuditDB
 		items.ItemCache
 	}
 	var err error
@@ -202,5 +463,8 @@ func setupDatabase(config *bendoConfig, s *server.RESTServer) {
 		log.Fatalln("problem setting up database")
 	}
 	s.FixityDatabase = db
+	s.BlobDatabase = db
+	s.TokenDatabase = db
+	s.AuditDatabase = db
 	s.Items.SetCache(db)
 }
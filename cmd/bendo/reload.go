@@ -0,0 +1,162 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ndlib/bendo/blobcache"
+	"github.com/ndlib/bendo/server"
+)
+
+// A reloader rereads the config file and the token file, and applies the
+// settings which can be changed while the server is running. Other changes
+// are logged and need a restart to take effect.
+type reloader struct {
+	fname string
+	s     *server.RESTServer
+	certs *server.CertReloader // nil if not using TLS
+
+	m       sync.Mutex   // protects current and serializes reloads
+	current *bendoConfig // the config in use
+}
+
+// reload does the reloading. If there is an error in either the config file
+// or the token file, nothing is changed.
+func (rl *reloader) reload() error {
+	rl.m.Lock()
+	defer rl.m.Unlock()
+
+	log.Println("Reloading configuration")
+	config, err := readConfig(rl.fname)
+	if err != nil {
+		return err
+	}
+	// load everything before changing anything
+	v, err := newValidator(config, rl.s.TokenDatabase)
+	if err != nil {
+		return err
+	}
+	roles, err := roleLimits(config)
+	if err != nil {
+		return err
+	}
+	var certValidator server.TokenValidator
+	if config.TLS.ClientUserFile != "" {
+		certValidator, err = server.NewSubjectValidatorFile(config.TLS.ClientUserFile)
+		if err != nil {
+			return err
+		}
+	}
+	timeout, err := time.ParseDuration(config.CacheTimeout)
+	if config.CacheTimeout != "" && err != nil {
+		return err
+	}
+
+	rl.s.SetValidator(v)
+	if rl.certs != nil {
+		// pick up a renewed certificate now, rather than waiting for the
+		// periodic check
+		err = rl.certs.Reload()
+		if err != nil {
+			log.Println("Reload: TLS certificate:", err)
+		}
+		rl.s.SetCertValidator(certValidator)
+	}
+	rl.s.Limits.SetLimits(roles, config.Limits.Users)
+
+	cache := rl.s.Cache
+	if tc, ok := cache.(*blobcache.Tiered); ok {
+		size := config.CacheMemorySize * 1000000 // config is in MB
+		if size != tc.MemoryMaxSize() {
+			log.Println("Reload: CacheMemorySize =", config.CacheMemorySize)
+			tc.SetMemoryMaxSize(size)
+		}
+		cache = tc.Next()
+	} else if config.CacheMemorySize != rl.current.CacheMemorySize {
+		log.Println("Reload: adding a memory cache needs a restart")
+		config.CacheMemorySize = rl.current.CacheMemorySize
+	}
+	if cacheStrategy(config) != cacheStrategy(rl.current) {
+		log.Println("Reload: changing the cache strategy needs a restart")
+		config.CacheTimeout = rl.current.CacheTimeout
+		config.CacheStrategy = rl.current.CacheStrategy
+	} else {
+		switch cache := cache.(type) {
+		case *blobcache.StoreLRU, *blobcache.TwoQueue:
+			sized := cache.(interface {
+				SetMaxSize(int64) error
+			})
+			size := config.CacheSize * 1000000 // config is in MB
+			if size != cache.MaxSize() {
+				log.Println("Reload: CacheSize =", config.CacheSize)
+				err = sized.SetMaxSize(size)
+				if err != nil {
+					log.Println("Reload:", err)
+				}
+			}
+		case *blobcache.TimeBased:
+			if config.CacheTimeout != rl.current.CacheTimeout {
+				log.Println("Reload: CacheTimeout =", config.CacheTimeout)
+				cache.SetTTL(timeout)
+			}
+			size := config.CacheMaxSize * 1000000 // config is in MB
+			if size != cache.MaxSize() {
+				log.Println("Reload: CacheMaxSize =", config.CacheMaxSize)
+				err = cache.SetMaxSize(size)
+				if err != nil {
+					log.Println("Reload:", err)
+				}
+			}
+		}
+	}
+
+	if config.CacheScrubRate != rl.current.CacheScrubRate {
+		log.Println("Reload: CacheScrubRate =", config.CacheScrubRate)
+		rl.s.SetCacheScrubRate(config.CacheScrubRate * 1000000) // config is in MB
+	}
+
+	// the COW host always disables fixity, but needs a restart to change
+	rl.s.SetFixity(!config.DisableFixity && rl.current.CowHost == "")
+
+	old := rl.current
+	if config.StoreDir != old.StoreDir ||
+		config.CacheDir != old.CacheDir ||
+		config.CacheChunkSize != old.CacheChunkSize ||
+		config.PortNumber != old.PortNumber ||
+		config.PProfPort != old.PProfPort ||
+		config.Mysql != old.Mysql ||
+		config.CowHost != old.CowHost ||
+		config.CowToken != old.CowToken ||
+		config.SigningKey != old.SigningKey ||
+		!sameTLS(config.TLS, old.TLS) {
+		log.Println("Reload: some changed settings need a restart to take effect")
+	}
+	// keep the settings which were not changed
+	config.StoreDir = old.StoreDir
+	config.CacheDir = old.CacheDir
+	config.CacheChunkSize = old.CacheChunkSize
+	config.PortNumber = old.PortNumber
+	config.PProfPort = old.PProfPort
+	config.Mysql = old.Mysql
+	config.CowHost = old.CowHost
+	config.CowToken = old.CowToken
+	config.SigningKey = old.SigningKey
+	clientUserFile := config.TLS.ClientUserFile
+	config.TLS = old.TLS
+	config.TLS.ClientUserFile = clientUserFile
+	rl.current = config
+	return nil
+}
+
+// sameTLS returns whether the TLS settings needing a restart are the same.
+// The client user file may be changed by a reload.
+func sameTLS(a, b tlsConfig) bool {
+	return a.CertFile == b.CertFile &&
+		a.KeyFile == b.KeyFile &&
+		a.MinVersion == b.MinVersion &&
+		strings.Join(a.Ciphers, " ") == strings.Join(b.Ciphers, " ") &&
+		a.ClientCAFile == b.ClientCAFile &&
+		a.RequireClient == b.RequireClient
+}
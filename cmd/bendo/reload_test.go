@@ -0,0 +1,180 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ndlib/bendo/blobcache"
+	"github.com/ndlib/bendo/server"
+	"github.com/ndlib/bendo/store"
+)
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bendo-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configfile := filepath.Join(dir, "config")
+	tokenfile := filepath.Join(dir, "tokens")
+	write := func(fname, contents string) {
+		err := ioutil.WriteFile(fname, []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(tokenfile, "a read 1234\n")
+	write(configfile, `Tokenfile = "`+tokenfile+`"
+CacheSize = 10
+`)
+	config, err := readConfig(configfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server.RESTServer{
+		Cache:         blobcache.NewLRU(store.NewMemory(), config.CacheSize*1000000),
+		DisableFixity: true,
+	}
+	setupTokens(config, s)
+	setupLimits(config, s)
+	rl := &reloader{fname: configfile, s: s, current: config}
+
+	// change the token and the cache size
+	write(tokenfile, "b write 5678\n")
+	write(configfile, `Tokenfile = "`+tokenfile+`"
+CacheSize = 5
+DisableFixity = true
+PortNumber = "15000"
+`)
+	err = rl.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user, _, _ := s.Validator.TokenValid("1234"); user != "" {
+		t.Errorf("Old token is still valid for user %q", user)
+	}
+	if user, role, _ := s.Validator.TokenValid("5678"); user != "b" || role != server.RoleWrite {
+		t.Errorf("Received %q, %v for new token", user, role)
+	}
+	if s.Cache.MaxSize() != 5000000 {
+		t.Errorf("Received cache size %d, expected %d", s.Cache.MaxSize(), 5000000)
+	}
+	if rl.current.PortNumber != "14000" {
+		t.Errorf("Port number changed to %s", rl.current.PortNumber)
+	}
+
+	// a bad config file changes nothing
+	write(tokenfile, "c admin 9999\n")
+	write(configfile, `Tokenfile = "`+tokenfile+`"
+CacheSize = "big"
+`)
+	err = rl.reload()
+	if err == nil {
+		t.Error("Expected an error")
+	}
+	if user, _, _ := s.Validator.TokenValid("5678"); user != "b" {
+		t.Errorf("Token file reloaded after an error")
+	}
+}
+
+func TestCacheStrategy(t *testing.T) {
+	var table = []struct {
+		timeout, strategy string
+		expected          string
+	}{
+		{"", "", "lru"},
+		{"", "LRU", "lru"},
+		{"", "2q", "2q"},
+		{"24h", "2q", "time"},
+		{"", "arc", "arc"},
+	}
+	for _, tab := range table {
+		config := &bendoConfig{CacheTimeout: tab.timeout, CacheStrategy: tab.strategy}
+		if s := cacheStrategy(config); s != tab.expected {
+			t.Errorf("%q, %q: received %q, expected %q", tab.timeout, tab.strategy, s, tab.expected)
+		}
+	}
+}
+
+func TestReloadMemoryCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bendo-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configfile := filepath.Join(dir, "config")
+	err = ioutil.WriteFile(configfile, []byte("CacheSize = 10\nCacheMemorySize = 2\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := readConfig(configfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := blobcache.NewLRU(store.NewMemory(), 10000000)
+	defer next.Stop()
+	cache := blobcache.NewTiered(next, 2000000)
+	s := &server.RESTServer{Cache: cache, DisableFixity: true}
+	setupLimits(config, s)
+	rl := &reloader{fname: configfile, s: s, current: config}
+
+	// both tiers can be resized. This also turns on fixity checking, which
+	// must not start without a fixity database.
+	err = ioutil.WriteFile(configfile, []byte("CacheSize = 5\nCacheMemorySize = 1\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rl.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cache.MemoryMaxSize() != 1000000 || next.MaxSize() != 5000000 {
+		t.Errorf("Received sizes %d and %d", cache.MemoryMaxSize(), next.MaxSize())
+	}
+}
+
+func TestReloadTimeCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bendo-reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configfile := filepath.Join(dir, "config")
+	// CacheSize does not limit the time-based cache
+	err = ioutil.WriteFile(configfile, []byte("CacheSize = 10\nCacheTimeout = \"1h\"\nDisableFixity = true\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := readConfig(configfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := blobcache.NewTime(store.NewMemory(), time.Hour)
+	defer cache.Stop()
+	s := &server.RESTServer{Cache: cache, DisableFixity: true}
+	setupLimits(config, s)
+	rl := &reloader{fname: configfile, s: s, current: config}
+	err = rl.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cache.MaxSize() != 0 {
+		t.Errorf("Received size %d, expected 0", cache.MaxSize())
+	}
+
+	err = ioutil.WriteFile(configfile, []byte("CacheSize = 10\nCacheTimeout = \"1h\"\nCacheMaxSize = 5\nDisableFixity = true\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rl.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cache.MaxSize() != 5000000 {
+		t.Errorf("Received size %d, expected 5000000", cache.MaxSize())
+	}
+}
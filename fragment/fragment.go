@@ -58,6 +58,9 @@ type FileEntry interface {
 	// Set the creator name for this file.
 	SetCreator(name string)
 
+	// Set the scope of the token which created this file.
+	SetScope(scope string)
+
 	// Set the expected MD5 sum for the entire file (i.e. over all of
 	// its blocks).
 	SetMD5(hash []byte)
@@ -85,6 +88,7 @@ type Stat struct {
 	Created    time.Time
 	Modified   time.Time
 	Creator    string
+	Scope      string // the scope of the token which created this file
 	MD5        []byte // expected hash for entire file
 	SHA256     []byte // expected hash for entire file
 	MimeType   string
@@ -102,6 +106,7 @@ type file struct {
 	Created  time.Time    // time this record was created
 	Modified time.Time    // last time this record was modified
 	Creator  string       // the "user" (aka API key) who created this file
+	Scope    string       // the scope of the token which created this file
 	MD5      []byte       // expected hash for entire file
 	SHA256   []byte       // expected hash for entire file
 	MimeType string       // the mime type of the file
@@ -226,6 +231,7 @@ func (f *file) Stat() Stat {
 		Created:    f.Created,
 		Modified:   f.Modified,
 		Creator:    f.Creator,
+		Scope:      f.Scope,
 		MD5:        f.MD5[:],
 		SHA256:     f.SHA256[:],
 		MimeType:   f.MimeType,
@@ -386,6 +392,13 @@ func (f *file) SetCreator(name string) {
 	f.saveAndLog()
 }
 
+func (f *file) SetScope(scope string) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.Scope = scope
+	f.saveAndLog()
+}
+
 func (f *file) SetMD5(hash []byte) {
 	f.m.Lock()
 	defer f.m.Unlock()
@@ -26,5 +26,4 @@ require (
 	github.com/julienschmidt/httprouter v1.3.0
 	github.com/remyoudompheng/bigfft v0.0.0-20190728182440-6a916e37a237 // indirect
 	golang.org/x/net v0.0.0-20201021035429-f5854403a974 // indirect
-	golang.org/x/sync v0.0.0-20201207232520-09787c993a3a
 )
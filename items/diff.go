@@ -0,0 +1,133 @@
+package items
+
+import (
+	"encoding/hex"
+	"sort"
+)
+
+// A VersionDiff lists the differences between the slots of two versions of
+// an item. Slots which are the same in both versions are not listed.
+type VersionDiff struct {
+	From     VersionID
+	To       VersionID
+	Added    []DiffEntry // slots only in To
+	Removed  []DiffEntry // slots only in From
+	Renamed  []DiffEntry // a blob in From moved to a new slot in To
+	Modified []DiffEntry // slots in both versions pointing to different blobs
+}
+
+// A DiffEntry describes one change between two versions. Old describes the
+// blob in the From version and New describes the blob in the To version.
+// Either may be nil if it does not apply to the kind of change. OldSlot is
+// only set for renamed entries.
+type DiffEntry struct {
+	Slot    string
+	OldSlot string    `json:",omitempty"`
+	Old     *DiffBlob `json:",omitempty"`
+	New     *DiffBlob `json:",omitempty"`
+}
+
+// A DiffBlob is the information about a blob included in a VersionDiff. The
+// checksums are encoded as hex strings.
+type DiffBlob struct {
+	ID     BlobID
+	Size   int64
+	MD5    string
+	SHA256 string
+}
+
+// DiffVersions compares the slots of versions v1 and v2 of this item. A slot
+// whose blob appears in v1 under a different name that is not in v2 is
+// considered to be renamed. It returns nil if either version does not exist.
+func (item Item) DiffVersions(v1, v2 VersionID) *VersionDiff {
+	from := item.version(v1)
+	to := item.version(v2)
+	if from == nil || to == nil {
+		return nil
+	}
+	result := &VersionDiff{From: v1, To: v2}
+
+	// the blobs of the slots which were deleted or added, by blob id
+	removed := make(map[BlobID][]string)
+	var added []string
+	for slot, bid := range from.Slots {
+		if _, ok := to.Slots[slot]; !ok {
+			removed[bid] = append(removed[bid], slot)
+		}
+	}
+	for slot, bid := range to.Slots {
+		oldbid, ok := from.Slots[slot]
+		switch {
+		case !ok:
+			added = append(added, slot)
+		case oldbid != bid:
+			result.Modified = append(result.Modified, DiffEntry{
+				Slot: slot,
+				Old:  item.diffBlob(oldbid),
+				New:  item.diffBlob(bid),
+			})
+		}
+	}
+
+	// pair up the added slots with removed slots having the same blob.
+	// go through them in order so the pairing is deterministic.
+	sort.Strings(added)
+	for _, list := range removed {
+		sort.Strings(list)
+	}
+	for _, slot := range added {
+		bid := to.Slots[slot]
+		if list := removed[bid]; len(list) > 0 {
+			removed[bid] = list[1:]
+			result.Renamed = append(result.Renamed, DiffEntry{
+				Slot:    slot,
+				OldSlot: list[0],
+				Old:     item.diffBlob(bid),
+				New:     item.diffBlob(bid),
+			})
+			continue
+		}
+		result.Added = append(result.Added, DiffEntry{
+			Slot: slot,
+			New:  item.diffBlob(bid),
+		})
+	}
+	for bid, list := range removed {
+		for _, slot := range list {
+			result.Removed = append(result.Removed, DiffEntry{
+				Slot: slot,
+				Old:  item.diffBlob(bid),
+			})
+		}
+	}
+
+	sortEntries(result.Removed)
+	sortEntries(result.Modified)
+	return result
+}
+
+func (item Item) version(vid VersionID) *Version {
+	for _, v := range item.Versions {
+		if v.ID == vid {
+			return v
+		}
+	}
+	return nil
+}
+
+func (item Item) diffBlob(bid BlobID) *DiffBlob {
+	b := item.blobByID(bid)
+	if b == nil {
+		return &DiffBlob{ID: bid}
+	}
+	return &DiffBlob{
+		ID:     bid,
+		Size:   b.Size,
+		MD5:    hex.EncodeToString(b.MD5),
+		SHA256: hex.EncodeToString(b.SHA256),
+	}
+}
+
+func sortEntries(list []DiffEntry) {
+	sort.Slice(list, func(i, j int) bool { return list[i].Slot < list[j].Slot })
+}
@@ -0,0 +1,82 @@
+package items
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDiffVersions(t *testing.T) {
+	m := Item{
+		Blobs: []*Blob{
+			&Blob{ID: 1, Size: 10, MD5: checksum(16, 1), SHA256: checksum(32, 1)},
+			&Blob{ID: 2, Size: 20},
+			&Blob{ID: 3, Size: 30},
+			&Blob{ID: 4, Size: 40},
+			&Blob{ID: 5, Size: 50},
+		},
+		Versions: []*Version{
+			&Version{
+				ID:    1,
+				Slots: map[string]BlobID{"a": 1, "b": 2, "c": 3, "d": 4, "e": 4},
+			},
+			&Version{
+				ID:    2,
+				Slots: map[string]BlobID{"a": 1, "b": 5, "d": 4, "f": 3, "g": 2, "h": 4},
+			},
+		},
+	}
+
+	diff := m.DiffVersions(1, 2)
+	if diff == nil {
+		t.Fatal("Received nil diff")
+	}
+	var table = []struct {
+		name    string
+		entries []DiffEntry
+		expect  string
+	}{
+		{"added", diff.Added, "g:0-2"},
+		{"removed", diff.Removed, ""},
+		{"renamed", diff.Renamed, "f:3-3 h:4-4"},
+		{"modified", diff.Modified, "b:2-5"},
+	}
+	for _, tab := range table {
+		var got string
+		for i, e := range tab.entries {
+			if i > 0 {
+				got += " "
+			}
+			var oldid, newid BlobID
+			if e.Old != nil {
+				oldid = e.Old.ID
+			}
+			if e.New != nil {
+				newid = e.New.ID
+			}
+			got += fmt.Sprintf("%s:%d-%d", e.Slot, oldid, newid)
+		}
+		if got != tab.expect {
+			t.Errorf("%s: received %q, expected %q", tab.name, got, tab.expect)
+		}
+	}
+	if len(diff.Renamed) > 0 && diff.Renamed[0].OldSlot != "c" {
+		t.Errorf("Renamed from %q, expected %q", diff.Renamed[0].OldSlot, "c")
+	}
+
+	// reversing the order of the versions swaps additions and removals
+	diff = m.DiffVersions(2, 1)
+	if len(diff.Added) != 0 || len(diff.Removed) != 1 || diff.Removed[0].Slot != "g" {
+		t.Errorf("Received %v, expected g to be removed", diff)
+	}
+	if len(diff.Renamed) != 2 || diff.Renamed[0].Slot != "c" || diff.Renamed[1].Slot != "e" {
+		t.Errorf("Received %v, expected c and e to be renamed", diff.Renamed)
+	}
+
+	diff = m.DiffVersions(1, 1)
+	if len(diff.Added)+len(diff.Removed)+len(diff.Renamed)+len(diff.Modified) != 0 {
+		t.Errorf("Received %v, expected no differences", diff)
+	}
+	if m.DiffVersions(1, 3) != nil {
+		t.Errorf("Expected nil diff for a missing version")
+	}
+}
@@ -1,6 +1,8 @@
 package items
 
 import (
+	"bytes"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -172,6 +174,34 @@ func (s *Store) Blob(id string, bid BlobID) (io.ReadCloser, int64, error) {
 	return stream, b.Size, err
 }
 
+// StageBlobs tells the underlying store that the bundles holding the given
+// blobs of item id are about to be read, so they may all be fetched together.
+// It does nothing if the store does not support staging. Unknown or deleted
+// blobs are ignored.
+func (s *Store) StageBlobs(id string, bids []BlobID) {
+	stager, ok := s.S.(store.Stager)
+	if !ok {
+		return
+	}
+	item, err := s.Item(id)
+	if err != nil {
+		return
+	}
+	var keys []string
+	seen := make(map[int]bool)
+	for _, bid := range bids {
+		b := item.blobByID(bid)
+		if b == nil || b.Bundle == 0 || seen[b.Bundle] {
+			continue
+		}
+		seen[b.Bundle] = true
+		keys = append(keys, sugar(id, b.Bundle))
+	}
+	if len(keys) > 0 {
+		stager.Stage(keys)
+	}
+}
+
 type NoBlobError struct {
 	ID  string
 	BID BlobID
@@ -223,10 +253,45 @@ func (item Item) BlobByVersionSlot(vid VersionID, slot string) BlobID {
 	return ver.Slots[slot]
 }
 
+// BlobBySHA256 returns the blob having the given SHA-256 checksum. If more
+// than one blob has the checksum, the most recent one that has not been
+// deleted is preferred. It returns 0 if no blob has the checksum.
+func (item Item) BlobBySHA256(sum []byte) BlobID {
+	return item.blobByChecksum(sum, func(b *Blob) []byte { return b.SHA256 })
+}
+
+// BlobByMD5 returns the blob having the given MD5 checksum. It chooses among
+// blobs in the same way as BlobBySHA256.
+func (item Item) BlobByMD5(sum []byte) BlobID {
+	return item.blobByChecksum(sum, func(b *Blob) []byte { return b.MD5 })
+}
+
+func (item Item) blobByChecksum(sum []byte, checksum func(*Blob) []byte) BlobID {
+	if len(sum) == 0 {
+		return 0
+	}
+	var result BlobID
+	for i := len(item.Blobs) - 1; i >= 0; i-- {
+		b := item.Blobs[i]
+		if !bytes.Equal(checksum(b), sum) {
+			continue
+		}
+		if b.DeleteDate.IsZero() {
+			return b.ID
+		}
+		if result == 0 {
+			result = b.ID
+		}
+	}
+	return result
+}
+
 // BlobByExtendedSlot return the blob idenfifer for the given extended slot
 // name. An extended slot name is a slot name with an optional "@nnn/" prefix,
 // where nnn is the version number of the item to use (in decimal). If a
 // version prefix is not present, the most recent version of the item is used.
+// The special forms "@blob/nnn", "@sha256/hex", and "@md5/hex" refer to a blob
+// directly by its identifier or by the hex encoding of one of its checksums.
 // Like BlobByVersionSlot, 0 is returned if the slot path does not
 // resolve to anything.
 func (item Item) BlobByExtendedSlot(slot string) BlobID {
@@ -243,6 +308,21 @@ func (item Item) BlobByExtendedSlot(slot string) BlobID {
 			}
 			return BlobID(b)
 		}
+		// handle "@sha256/hex" and "@md5/hex" paths
+		if strings.HasPrefix(slot, "@sha256/") {
+			sum, err := hex.DecodeString(slot[8:])
+			if err != nil || len(sum) != 32 {
+				return 0
+			}
+			return item.BlobBySHA256(sum)
+		}
+		if strings.HasPrefix(slot, "@md5/") {
+			sum, err := hex.DecodeString(slot[5:])
+			if err != nil || len(sum) != 16 {
+				return 0
+			}
+			return item.BlobByMD5(sum)
+		}
 		// handle "@nnn/path/to/file" paths
 		var err error
 		j := strings.Index(slot, "/")
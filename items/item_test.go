@@ -1,12 +1,21 @@
 package items
 
 import (
+	"encoding/hex"
 	"testing"
+	"time"
 )
 
 func TestBlobByExtendedSlot(t *testing.T) {
+	now := time.Now()
 	m := Item{
-		Blobs: []*Blob{&Blob{}, &Blob{}, &Blob{}, &Blob{}, &Blob{}},
+		Blobs: []*Blob{
+			&Blob{ID: 1, MD5: checksum(16, 1), SHA256: checksum(32, 1)},
+			&Blob{ID: 2},
+			&Blob{ID: 3, MD5: checksum(16, 3), SHA256: checksum(32, 3), DeleteDate: now},
+			&Blob{ID: 4, MD5: checksum(16, 1), SHA256: checksum(32, 1), DeleteDate: now},
+			&Blob{ID: 5},
+		},
 		Versions: []*Version{
 			&Version{
 				ID:    1,
@@ -32,6 +41,14 @@ func TestBlobByExtendedSlot(t *testing.T) {
 		{"@blob/04", 4}, // octal?
 		{"@blob/0x4", 0},
 		{"@blob/", 0},
+		{"@md5/" + hex.EncodeToString(checksum(16, 1)), 1}, // prefer undeleted blob
+		{"@sha256/" + hex.EncodeToString(checksum(32, 1)), 1},
+		{"@sha256/" + hex.EncodeToString(checksum(32, 3)), 3}, // deleted blob
+		{"@md5/" + hex.EncodeToString(checksum(16, 2)), 0},
+		{"@md5/" + hex.EncodeToString(checksum(32, 1)), 0}, // wrong length
+		{"@sha256/" + hex.EncodeToString(checksum(16, 1)), 0},
+		{"@sha256/xyz", 0},
+		{"@sha256/", 0},
 	}
 
 	for _, tab := range table {
@@ -45,3 +62,10 @@ func TestBlobByExtendedSlot(t *testing.T) {
 	}
 
 }
+
+// checksum returns a fake checksum n bytes long which begins with the byte b.
+func checksum(n int, b byte) []byte {
+	result := make([]byte, n)
+	result[0] = b
+	return result
+}
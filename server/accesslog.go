@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ndlib/bendo/items"
+)
+
+// A requestInfo collects what we know about a request as it is handled, so
+// it can be included in the access log. A pointer to one is kept in the
+// request context.
+type requestInfo struct {
+	ID    string // the request id, also returned in the X-Request-Id header
+	User  string
+	Role  Role
+	Token string // the API key given, if it was valid
+	Scope Scope  // the items the token may be used for
+	Item  string
+	Blob  items.BlobID
+}
+
+type contextKey int
+
+const requestInfoKey contextKey = 0
+
+// getRequestInfo returns the requestInfo for r, or nil if there is none.
+func getRequestInfo(r *http.Request) *requestInfo {
+	info, _ := r.Context().Value(requestInfoKey).(*requestInfo)
+	return info
+}
+
+// requestID returns the id of the request r, or "" if it does not have one.
+func requestID(r *http.Request) string {
+	if info := getRequestInfo(r); info != nil {
+		return info.ID
+	}
+	return ""
+}
+
+// setRequestBlob records the blob a request is for in the access log.
+func setRequestBlob(r *http.Request, bid items.BlobID) {
+	if info := getRequestInfo(r); info != nil {
+		info.Blob = bid
+	}
+}
+
+// newRequestID returns the id to use for a request. A client may pass its
+// own id in the X-Request-Id header so it can be traced across systems.
+// Otherwise a random one is made.
+func newRequestID(r *http.Request) string {
+	id := r.Header.Get("X-Request-Id")
+	if len(id) > 0 && len(id) <= 64 && strings.Trim(id, requestIDChars) == "" {
+		return id
+	}
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+const requestIDChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_."
+
+// An accessEntry is a single line in the access log.
+type accessEntry struct {
+	Time      time.Time    `json:"time"`
+	RequestID string       `json:"request_id"`
+	Method    string       `json:"method"`
+	Path      string       `json:"path"`
+	Route     string       `json:"route"`
+	Remote    string       `json:"remote"`
+	User      string       `json:"user,omitempty"`
+	Role      string       `json:"role"`
+	Status    int          `json:"status"`
+	Bytes     int64        `json:"bytes"`
+	Duration  float64      `json:"duration"` // in seconds
+	Cached    string       `json:"cached,omitempty"`
+	Item      string       `json:"item,omitempty"`
+	Blob      items.BlobID `json:"blob,omitempty"`
+}
+
+// accessLogOutput is where the access log is written. If nil, the log goes
+// to the same place as the standard logger, but without its date prefix
+// since each entry has its own timestamp.
+var accessLogOutput io.Writer
+
+func writeAccessLog(entry accessEntry) {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		log.Println("access log:", err)
+		return
+	}
+	out := accessLogOutput
+	if out == nil {
+		out = log.Writer()
+	}
+	fmt.Fprintln(out, string(b))
+}
+
+// withRequestInfo returns a copy of r whose context holds info.
+func withRequestInfo(r *http.Request, info *requestInfo) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey, info))
+}
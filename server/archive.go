@@ -0,0 +1,181 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	raven "github.com/getsentry/raven-go"
+
+	"github.com/ndlib/bendo/bagit"
+	"github.com/ndlib/bendo/items"
+	"github.com/ndlib/bendo/store"
+)
+
+// parseArchiveSlot decides whether the extended slot name is a request for an
+// archive of an entire version, that is, if it has the form "@nnn.zip" or
+// "@nnn.tar". It returns the version number and the archive format ("zip" or
+// "tar"). The version is 0 if the slot is not an archive request.
+func parseArchiveSlot(slot string) (items.VersionID, string) {
+	if !strings.HasPrefix(slot, "@") {
+		return 0, ""
+	}
+	var format string
+	switch {
+	case strings.HasSuffix(slot, ".zip"):
+		format = "zip"
+	case strings.HasSuffix(slot, ".tar"):
+		format = "tar"
+	default:
+		return 0, ""
+	}
+	v, err := strconv.ParseUint(slot[1:len(slot)-4], 10, 0)
+	if err != nil || v == 0 {
+		return 0, ""
+	}
+	return items.VersionID(v), format
+}
+
+// VersionArchiveHandler handles requests to GET /item/:id/@nnn.zip and
+// GET /item/:id/@nnn.tar. (It is called from the SlotHandler.)
+//
+// Every slot in version nnn of the item is streamed as a single BagIt file,
+// using the slot names as the file names. Since the response is streamed, an
+// error that happens after the first byte has been sent can only be signaled
+// by aborting the connection.
+func (s *RESTServer) VersionArchiveHandler(w http.ResponseWriter, r *http.Request, id string, item *items.Item, vid items.VersionID, format string) {
+	var version *items.Version
+	for _, v := range item.Versions {
+		if v.ID == vid {
+			version = v
+			break
+		}
+	}
+	if version == nil {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Invalid Version")
+		return
+	}
+	var names []string
+	for name := range version.Slots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// make sure all the content is available before starting the response
+	var uncached []items.BlobID
+	for _, name := range names {
+		// a name like "../x" would be unpacked outside of the bag
+		if !bagit.ValidName(name) {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "Slot %q cannot be put into an archive\n", name)
+			return
+		}
+		bid := version.Slots[name]
+		blob, err := s.Items.BlobInfo(id, bid)
+		if err != nil {
+			w.WriteHeader(404)
+			fmt.Fprintln(w, err)
+			return
+		}
+		if blob.Bundle == 0 {
+			w.WriteHeader(410)
+			fmt.Fprintln(w, name, ":", items.ErrDeleted)
+			return
+		}
+		if !s.Cache.Contains(blobKey(id, bid)) {
+			uncached = append(uncached, bid)
+		}
+	}
+	if len(uncached) > 0 && !s.useTape {
+		w.WriteHeader(503)
+		fmt.Fprintln(w, items.ErrNoStore)
+		return
+	}
+	if len(uncached) > 0 && r.Method == "GET" {
+		release := s.startTapeRead(w, r)
+		if release == nil {
+			return
+		}
+		defer release()
+	}
+
+	bagname := fmt.Sprintf("%s-v%d", id, vid)
+	if format == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+	} else {
+		w.Header().Set("Content-Type", "application/x-tar")
+	}
+	w.Header().Set("Content-Disposition",
+		mime.FormatMediaType("attachment", map[string]string{"filename": bagname + "." + format}))
+	if r.Method != "GET" {
+		return
+	}
+
+	// ask for everything on tape at once
+	s.Items.StageBlobs(id, uncached)
+
+	var bag *bagit.Writer
+	if format == "zip" {
+		bag = bagit.NewWriter(w, bagname)
+	} else {
+		bag = bagit.NewTarWriter(w, bagname)
+	}
+	bag.SetTag("External-Identifier", id)
+	if version.Note != "" {
+		bag.SetTag("External-Description", version.Note)
+	}
+	for _, name := range names {
+		err := s.copyBlobToBag(bag, name, id, version.Slots[name])
+		if err != nil {
+			log.Println("archive", bagname, name, err)
+			raven.CaptureError(err, map[string]string{"id": id})
+			panic(http.ErrAbortHandler)
+		}
+	}
+	err := bag.Close()
+	if err != nil {
+		log.Println("archive", bagname, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// copyBlobToBag copies the given blob into the bag under the given name. The
+// content is taken from the cache if it is there, otherwise it is read from
+// tape. Content read from tape is not added to the cache.
+func (s *RESTServer) copyBlobToBag(bag *bagit.Writer, name string, id string, bid items.BlobID) error {
+	var src io.Reader
+	cached, length, err := s.Cache.Get(blobKey(id, bid))
+	if err != nil {
+		return err
+	}
+	if cached != nil {
+		defer cached.Close()
+		src = store.NewReader(cached)
+	} else {
+		var rc io.ReadCloser
+		rc, length, err = s.openBlob(id, bid)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		src = rc
+	}
+	out, err := bag.CreateSize(name, length)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(out, src)
+	if cached != nil {
+		xCacheServedBytes.Add(n)
+	}
+	if err == nil && n != length {
+		err = fmt.Errorf("length mismatch: read %d, expected %d", n, length)
+	}
+	return err
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ndlib/bendo/blobcache"
+	"github.com/ndlib/bendo/items"
+	"github.com/ndlib/bendo/store"
+)
+
+// brokenCache is a cache whose items fail to read past their first few bytes.
+type brokenCache struct {
+	blobcache.T
+}
+
+func (c brokenCache) Get(key string) (store.ReadAtCloser, int64, error) {
+	r, size, err := c.T.Get(key)
+	if r == nil {
+		return r, size, err
+	}
+	return brokenReader{r}, size, err
+}
+
+type brokenReader struct {
+	store.ReadAtCloser
+}
+
+func (br brokenReader) ReadAt(p []byte, off int64) (int, error) {
+	if off+int64(len(p)) > 3 {
+		return 0, errors.New("read error")
+	}
+	return br.ReadAtCloser.ReadAt(p, off)
+}
+
+func TestVersionArchiveAbort(t *testing.T) {
+	cache := blobcache.NewLRU(store.NewMemory(), 1000)
+	s := &RESTServer{
+		Items:   items.New(store.NewMemory()),
+		Cache:   brokenCache{cache},
+		useTape: true,
+	}
+	w, err := s.Items.Open("abort", "nobody")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := "this blob cannot be read"
+	m := md5.Sum([]byte(content))
+	h := sha256.Sum256([]byte(content))
+	bid, err := w.WriteBlob(strings.NewReader(content), int64(len(content)), m[:], h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SetSlot("a.txt", bid)
+	w.Close()
+	putString := func(key, content string) {
+		w, _ := cache.Put(key)
+		w.Write([]byte(content))
+		w.Close()
+	}
+	putString(blobKey("abort", bid), content)
+
+	ts := httptest.NewServer(recoverer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		item, err := s.Items.Item("abort")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		s.VersionArchiveHandler(w, r, "abort", item, 1, "tar")
+	})))
+	defer ts.Close()
+
+	// the client must not receive a complete looking response
+	resp, err := http.Get(ts.URL)
+	if err == nil {
+		_, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+	}
+	if err == nil {
+		t.Errorf("Received a complete response for a failed archive")
+	}
+}
+
+func TestVersionArchiveBadName(t *testing.T) {
+	cache := blobcache.NewLRU(store.NewMemory(), 1000)
+	s := &RESTServer{
+		Items:   items.New(store.NewMemory()),
+		Cache:   cache,
+		useTape: true,
+	}
+	w, err := s.Items.Open("badname", "nobody")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := "outside the bag"
+	m := md5.Sum([]byte(content))
+	h := sha256.Sum256([]byte(content))
+	bid, err := w.WriteBlob(strings.NewReader(content), int64(len(content)), m[:], h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.SetSlot("../../x", bid)
+	w.Close()
+	item, err := s.Items.Item("badname")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []string{"zip", "tar"} {
+		rec := httptest.NewRecorder()
+		s.VersionArchiveHandler(rec, httptest.NewRequest("GET", "/", nil), "badname", item, 1, format)
+		if rec.Code != 500 || rec.Body.Len() == 0 {
+			t.Errorf("%s: received status %d, %q", format, rec.Code, rec.Body.String())
+		}
+	}
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	raven "github.com/getsentry/raven-go"
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/ndlib/bendo/transaction"
+)
+
+// An AuditRecord is an entry in the audit log. There is one for each request
+// changing something on the server, and for each transaction commit.
+type AuditRecord struct {
+	ID          int64
+	Time        time.Time
+	RequestID   string
+	User        string
+	Remote      string // the IP address of the client
+	Action      string // e.g. "upload.delete"
+	Item        string // the item acted on, if any
+	Transaction string // the transaction acted on, if any
+	Detail      string // e.g. the path of the request
+	Outcome     string // e.g. "201 Created"
+}
+
+// An AuditQuery selects audit records. The zero value for a field matches
+// every record.
+type AuditQuery struct {
+	Start       time.Time
+	End         time.Time
+	User        string
+	Action      string
+	Item        string
+	Transaction string
+	Limit       int // the most records to return
+}
+
+// AuditDB keeps the audit log. It is append only, there is no way to change
+// or remove a record.
+type AuditDB interface {
+	// AddAudit appends a record to the audit log. The ID field of the record
+	// is ignored.
+	AddAudit(record AuditRecord) error
+
+	// SearchAudit returns the records matching the query, newest first.
+	SearchAudit(query AuditQuery) ([]AuditRecord, error)
+}
+
+// auditActions gives the audit action name for each route which is audited,
+// by method and route.
+var auditActions = map[string]string{
+	"POST /sign/item/:id/*slot":             "url.sign",
+	"POST /item/:id/transaction":            "transaction.create",
+	"POST /item/:id/recall":                 "item.recall",
+	"POST /transaction/:tid/cancel":         "transaction.cancel",
+	"POST /upload":                          "upload.append",
+	"POST /upload/:fileid":                  "upload.append",
+	"DELETE /upload/:fileid":                "upload.delete",
+	"PUT /upload/:fileid/metadata":          "upload.metadata",
+	"POST /fixity/:item":                    "fixity.create",
+	"PUT /fixity/:id":                       "fixity.update",
+	"DELETE /fixity/:id":                    "fixity.delete",
+	"PUT /admin/use_tape/:status":           "tape.use",
+	"POST /admin/reload":                    "admin.reload",
+	"POST /admin/tokens":                    "token.create",
+	"PUT /admin/tokens/:id/:action":         "token.update",
+	"DELETE /admin/tokens/:id":              "token.revoke",
+	"DELETE /admin/cache/entries/:key":      "cache.evict",
+	"PUT /admin/cache/entries/:key/:action": "cache.pin",
+	"DELETE /admin/cache/item/:id":          "cache.evict",
+}
+
+// auditWrapper takes a handler and returns a handler which does the same
+// thing and then adds a record to the audit log, if the route is one which
+// is audited. It expects to be inside a logWrapper and outside of an
+// authzWrapper, so requests which are not allowed are also recorded.
+func (s *RESTServer) auditWrapper(method, route string, handler httprouter.Handle) httprouter.Handle {
+	action, ok := auditActions[method+" "+route]
+	if !ok {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		record := AuditRecord{
+			Time:        time.Now(),
+			Action:      action,
+			Item:        scopeItem(r, ps),
+			Transaction: ps.ByName("tid"),
+			Detail:      r.URL.Path,
+		}
+		if record.Transaction != "" && s.TxStore != nil {
+			// look it up now, since the handler may remove it
+			if tx := s.TxStore.Lookup(record.Transaction); tx != nil {
+				record.Item = tx.ItemID
+			}
+		}
+		record.Remote, _, _ = net.SplitHostPort(r.RemoteAddr)
+
+		sw := &statusWriter{ResponseWriter: w}
+		handler(sw, r, ps)
+
+		if info := getRequestInfo(r); info != nil {
+			record.RequestID = info.ID
+			record.User = info.User
+		}
+		if loc := sw.Header().Get("Location"); strings.HasPrefix(loc, "/transaction/") {
+			record.Transaction = strings.TrimPrefix(loc, "/transaction/")
+		}
+		status := sw.Status()
+		record.Outcome = fmt.Sprintf("%d %s", status, http.StatusText(status))
+		s.addAudit(record)
+	}
+}
+
+// auditCommit adds records to the audit log for a transaction that has been
+// committed. Besides the commit itself, each blob deletion is recorded.
+func (s *RESTServer) auditCommit(tx *transaction.Transaction) {
+	tx.M.RLock()
+	record := AuditRecord{
+		Time:        time.Now(),
+		RequestID:   tx.RequestID,
+		User:        tx.Creator,
+		Action:      "transaction.commit",
+		Item:        tx.ItemID,
+		Transaction: tx.ID,
+		Outcome:     "finished",
+	}
+	if tx.Status != transaction.StatusFinished {
+		record.Outcome = "error: " + strings.Join(tx.Err, "; ")
+	}
+	var deletes []string
+	for _, cmd := range tx.Commands {
+		if len(cmd) == 2 && cmd[0] == "delete" {
+			deletes = append(deletes, cmd[1])
+		}
+	}
+	tx.M.RUnlock()
+
+	s.addAudit(record)
+	record.Action = "blob.delete"
+	for _, blob := range deletes {
+		record.Detail = "blob " + blob
+		s.addAudit(record)
+	}
+}
+
+// addAudit adds a record to the audit log, if there is one.
+func (s *RESTServer) addAudit(record AuditRecord) {
+	if s.AuditDatabase == nil {
+		return
+	}
+	err := s.AuditDatabase.AddAudit(record)
+	if err != nil {
+		log.Println("AddAudit:", err)
+		raven.CaptureError(err, nil)
+	}
+}
+
+// AuditHandler handles requests to GET /admin/audit
+//
+// The records may be filtered using the parameters "start" and "end", which
+// are times in either RFC3339 or "2006-01-02" format, and "user", "action",
+// "item", and "transaction". The parameter "limit" gives the most records to
+// return, and defaults to 1000. The newest records are returned first. If the
+// parameter "format" is "csv", the records are returned as CSV.
+func (s *RESTServer) AuditHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.AuditDatabase == nil {
+		w.WriteHeader(503)
+		fmt.Fprintln(w, "No audit database")
+		return
+	}
+	query := AuditQuery{
+		User:        r.FormValue("user"),
+		Action:      r.FormValue("action"),
+		Item:        r.FormValue("item"),
+		Transaction: r.FormValue("transaction"),
+		Limit:       1000,
+	}
+	var err error
+	query.Start, err = timeValidate(r.FormValue("start"), time.Time{})
+	if err == nil {
+		query.End, err = timeValidate(r.FormValue("end"), time.Time{})
+	}
+	if v := r.FormValue("limit"); err == nil && v != "" {
+		query.Limit, err = strconv.Atoi(v)
+		if err == nil && query.Limit <= 0 {
+			err = fmt.Errorf("bad limit %q", v)
+		}
+	}
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintln(w, err)
+		return
+	}
+	result, err := s.AuditDatabase.SearchAudit(query)
+	if err != nil {
+		log.Println("SearchAudit:", err)
+		raven.CaptureError(err, nil)
+		w.WriteHeader(500)
+		fmt.Fprintln(w, err)
+		return
+	}
+	if r.FormValue("format") == "csv" {
+		writeAuditCSV(w, result)
+		return
+	}
+	if result == nil {
+		result = []AuditRecord{}
+	}
+	writeHTMLorJSON(w, r, auditTemplate, result)
+}
+
+// writeAuditCSV writes the records to w as CSV, with a header row.
+func writeAuditCSV(w http.ResponseWriter, records []AuditRecord) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit.csv"`)
+	out := csv.NewWriter(w)
+	out.Write([]string{"id", "time", "request_id", "user", "remote", "action",
+		"item", "transaction", "detail", "outcome"})
+	for _, rec := range records {
+		out.Write([]string{
+			strconv.FormatInt(rec.ID, 10),
+			rec.Time.UTC().Format(time.RFC3339),
+			rec.RequestID,
+			rec.User,
+			rec.Remote,
+			rec.Action,
+			rec.Item,
+			rec.Transaction,
+			rec.Detail,
+			rec.Outcome,
+		})
+	}
+	out.Flush()
+}
+
+var (
+	auditTemplate = template.Must(template.New("audit").Parse(`<html>
+	<h1>Audit Log</h1>
+	<table><thead><tr>
+		<th>Time</th>
+		<th>User</th>
+		<th>Remote</th>
+		<th>Action</th>
+		<th>Item</th>
+		<th>Transaction</th>
+		<th>Detail</th>
+		<th>Outcome</th>
+	</tr></thead><tbody>
+	{{ range . }}
+	<tr>
+		<td>{{ .Time.Format "2006-01-02 15:04:05" }}</td>
+		<td>{{ .User }}</td>
+		<td>{{ .Remote }}</td>
+		<td>{{ .Action }}</td>
+		<td>{{ if .Item }}<a href="/item/{{ .Item }}">{{ .Item }}</a>{{ end }}</td>
+		<td>{{ if .Transaction }}<a href="/transaction/{{ .Transaction }}">{{ .Transaction }}</a>{{ end }}</td>
+		<td>{{ .Detail }}</td>
+		<td>{{ .Outcome }}</td>
+	</tr>
+	{{ else }}
+	<tr><td colspan="8">No records</td></tr>
+	{{ end }}
+	</tbody></table>
+	</html>`))
+)
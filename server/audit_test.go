@@ -0,0 +1,109 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func runAuditSequence(t *testing.T, db AuditDB) {
+	start := time.Now().Truncate(time.Second)
+	for i, rec := range []AuditRecord{
+		{Time: start, User: "a", Action: "upload.append", Detail: "/upload/x"},
+		{Time: start.Add(time.Minute), User: "b", Action: "transaction.create", Item: "abc", Transaction: "t1"},
+		{Time: start.Add(2 * time.Minute), User: "b", Action: "transaction.commit", Item: "abc", Transaction: "t1"},
+	} {
+		rec.Remote = "127.0.0.1"
+		rec.Outcome = "200 OK"
+		err := db.AddAudit(rec)
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+	}
+	var table = []struct {
+		query   AuditQuery
+		actions []string
+	}{
+		{AuditQuery{}, []string{"transaction.commit", "transaction.create", "upload.append"}},
+		{AuditQuery{User: "b"}, []string{"transaction.commit", "transaction.create"}},
+		{AuditQuery{Item: "abc", Action: "transaction.commit"}, []string{"transaction.commit"}},
+		// the limit keeps the newest records
+		{AuditQuery{Limit: 2}, []string{"transaction.commit", "transaction.create"}},
+		{AuditQuery{Transaction: "t1", Limit: 1}, []string{"transaction.commit"}},
+		{AuditQuery{Start: start.Add(30 * time.Second), End: start.Add(90 * time.Second)}, []string{"transaction.create"}},
+		{AuditQuery{User: "c"}, nil},
+	}
+	for i, tab := range table {
+		result, err := db.SearchAudit(tab.query)
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		var actions []string
+		for _, rec := range result {
+			actions = append(actions, rec.Action)
+		}
+		if strings.Join(actions, " ") != strings.Join(tab.actions, " ") {
+			t.Errorf("%d: received %v, expected %v", i, actions, tab.actions)
+		}
+	}
+}
+
+func TestAuditRoutes(t *testing.T) {
+	// uploads and deletions are recorded
+	file := uploadstring(t, "POST", "/upload", "hello audit")
+	checkStatus(t, "DELETE", file, 200)
+	body := getbody(t, "GET", "/admin/audit?action=upload.delete&user=nobody&format=csv", 200)
+	records, err := csv.NewReader(strings.NewReader(body)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) < 2 || records[0][0] != "id" {
+		t.Fatalf("Received %v", records)
+	}
+	found := false
+	for _, rec := range records[1:] {
+		if rec[8] == file && rec[9] == "200 OK" && rec[4] == "127.0.0.1" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Deletion of %s not in audit log: %v", file, records)
+	}
+
+	// transactions are recorded when they are made and when they are
+	// committed
+	file = uploadstring(t, "POST", "/upload", "hello audit")
+	itemid := "audit" + randomid()
+	txpath := sendtransaction(t, "/item/"+itemid+"/transaction",
+		[][]string{{"add", path.Base(file)}}, 202)
+	waitTransaction(t, txpath)
+	var actions []string
+	for i := 0; i < 10; i++ {
+		var result []AuditRecord
+		body = getbody(t, "GET", "/admin/audit?item="+itemid, 200)
+		err = json.Unmarshal([]byte(body), &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actions = nil
+		for _, rec := range result {
+			if rec.Transaction != path.Base(txpath) {
+				t.Errorf("Received transaction %q, expected %q", rec.Transaction, path.Base(txpath))
+			}
+			actions = append(actions, rec.Action)
+		}
+		if len(actions) == 2 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond) // the commit record is made after the transaction finishes
+	}
+	if strings.Join(actions, " ") != "transaction.commit transaction.create" {
+		t.Errorf("Received actions %v", actions)
+	}
+
+	checkStatus(t, "GET", "/admin/audit?start=yesterday", 400)
+	checkStatus(t, "GET", "/admin/audit?limit=-1", 400)
+}
@@ -12,9 +12,25 @@ import (
 	"github.com/ndlib/bendo/store"
 )
 
+// checkUnscoped returns whether the request r may read bundles. Bundles are
+// not sorted out by item, so tokens limited to some items may not read them.
+// If not, an error is written to w.
+func checkUnscoped(w http.ResponseWriter, r *http.Request) bool {
+	if requestScope(r) == nil {
+		return true
+	}
+	w.WriteHeader(403)
+	fmt.Fprintln(w, "A token limited to some items cannot read bundles")
+	return false
+}
+
 // BundleListHandler handles GET requests to "/bundle/list".
 func (s *RESTServer) BundleListHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 
+	if !checkUnscoped(w, r) {
+		return
+	}
+
 	if !s.useTape {
 		w.WriteHeader(503)
 		fmt.Fprintln(w, items.ErrNoStore)
@@ -37,6 +53,9 @@ func (s *RESTServer) BundleListHandler(w http.ResponseWriter, r *http.Request, p
 // BundleListPrefixHandler handles GET requests to "/bundle/list/:prefix".
 func (s *RESTServer) BundleListPrefixHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	prefix := ps.ByName("prefix")
+	if !checkUnscoped(w, r) {
+		return
+	}
 
 	if !s.useTape {
 		w.WriteHeader(503)
@@ -58,6 +77,9 @@ func (s *RESTServer) BundleListPrefixHandler(w http.ResponseWriter, r *http.Requ
 // BundleOpenHandler handles GET requests to "/bundle/open/:key"
 func (s *RESTServer) BundleOpenHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	key := ps.ByName("key")
+	if !checkUnscoped(w, r) {
+		return
+	}
 
 	if !s.useTape {
 		w.WriteHeader(503)
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/ndlib/bendo/blobcache"
+)
+
+// A CacheUsage summarizes the contents of the blob cache.
+type CacheUsage struct {
+	Size        int64   // bytes used
+	MaxSize     int64   // capacity in bytes, 0 means unlimited
+	Percent     float64 // percent of MaxSize used, 0 if unlimited
+	Entries     int
+	Pinned      int
+	PinnedSize  int64
+	LargestKey  string
+	LargestSize int64
+}
+
+// cacheManager returns the blob cache as a blobcache.Manager. If the cache
+// does not support that, an error is written to w and nil is returned.
+func (s *RESTServer) cacheManager(w http.ResponseWriter) blobcache.Manager {
+	if m, ok := s.Cache.(blobcache.Manager); ok {
+		return m
+	}
+	w.WriteHeader(501)
+	fmt.Fprintln(w, "The blob cache cannot be managed")
+	return nil
+}
+
+// CacheUsageHandler handles requests to GET /admin/cache
+func (s *RESTServer) CacheUsageHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	cache := s.cacheManager(w)
+	if cache == nil {
+		return
+	}
+	usage := CacheUsage{
+		Size:    cache.Size(),
+		MaxSize: cache.MaxSize(),
+	}
+	if usage.MaxSize > 0 {
+		usage.Percent = 100 * float64(usage.Size) / float64(usage.MaxSize)
+	}
+	for _, e := range cache.Entries() {
+		usage.Entries++
+		if e.Pinned {
+			usage.Pinned++
+			usage.PinnedSize += e.Size
+		}
+		if e.Size > usage.LargestSize {
+			usage.LargestKey = e.Key
+			usage.LargestSize = e.Size
+		}
+	}
+	writeHTMLorJSON(w, r, cacheUsageTemplate, usage)
+}
+
+// ListCacheHandler handles requests to GET /admin/cache/entries
+//
+// The entries are sorted by key. The parameter "prefix" only lists the keys
+// beginning with it, and "item" only lists the keys for the given item. The
+// parameter "limit" gives the most entries to return, and defaults to 1000.
+func (s *RESTServer) ListCacheHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	cache := s.cacheManager(w)
+	if cache == nil {
+		return
+	}
+	prefix := r.FormValue("prefix")
+	if item := r.FormValue("item"); item != "" {
+		prefix = item + "+"
+	}
+	limit := 1000
+	if v := r.FormValue("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit <= 0 {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "bad limit %q\n", v)
+			return
+		}
+	}
+	result := []blobcache.Entry{}
+	for _, e := range cache.Entries() {
+		if strings.HasPrefix(e.Key, prefix) {
+			result = append(result, e)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Key < result[j].Key
+	})
+	if len(result) > limit {
+		result = result[:limit]
+	}
+	writeHTMLorJSON(w, r, cacheListTemplate, result)
+}
+
+// GetCacheHandler handles requests to GET /admin/cache/entries/:key
+func (s *RESTServer) GetCacheHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	cache := s.cacheManager(w)
+	if cache == nil {
+		return
+	}
+	e, ok := cache.Entry(ps.ByName("key"))
+	if !ok {
+		w.WriteHeader(404)
+		fmt.Fprintln(w, blobcache.ErrNotCached)
+		return
+	}
+	writeHTMLorJSON(w, r, cacheListTemplate, []blobcache.Entry{e})
+}
+
+// EvictCacheHandler handles requests to DELETE /admin/cache/entries/:key
+//
+// The entry is removed even if it is pinned.
+func (s *RESTServer) EvictCacheHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	key := ps.ByName("key")
+	if !s.Cache.Contains(key) {
+		w.WriteHeader(404)
+		fmt.Fprintln(w, blobcache.ErrNotCached)
+		return
+	}
+	err := s.Cache.Delete(key)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintln(w, err)
+		return
+	}
+	log.Println("Cache entry", key, "evicted by", ps.ByName("username"))
+}
+
+// EvictCacheItemHandler handles requests to DELETE /admin/cache/item/:id
+//
+// Every entry for the item is removed, even those which are pinned. The
+// number of entries removed is returned.
+func (s *RESTServer) EvictCacheItemHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	cache := s.cacheManager(w)
+	if cache == nil {
+		return
+	}
+	id := ps.ByName("id")
+	var n int
+	for _, e := range cache.Entries() {
+		if !strings.HasPrefix(e.Key, id+"+") {
+			continue
+		}
+		err := cache.Delete(e.Key)
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintln(w, err)
+			return
+		}
+		n++
+	}
+	log.Println("Cache entries for", id, "evicted by", ps.ByName("username"))
+	fmt.Fprintln(w, n)
+}
+
+// PinCacheHandler handles requests to PUT /admin/cache/entries/:key/:action
+//
+// The action is either "pin" or "unpin". Pinned entries are never evicted to
+// make space, or expire.
+func (s *RESTServer) PinCacheHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var pin bool
+	switch ps.ByName("action") {
+	case "pin":
+		pin = true
+	case "unpin":
+		pin = false
+	default:
+		w.WriteHeader(404)
+		return
+	}
+	cache := s.cacheManager(w)
+	if cache == nil {
+		return
+	}
+	key := ps.ByName("key")
+	err := cache.Pin(key, pin)
+	if err == blobcache.ErrNotCached {
+		w.WriteHeader(404)
+		fmt.Fprintln(w, err)
+		return
+	} else if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintln(w, err)
+		return
+	}
+	log.Printf("Cache entry %s %sned by %s", key, ps.ByName("action"), ps.ByName("username"))
+}
+
+var (
+	cacheUsageTemplate = template.Must(template.New("cacheusage").Parse(`<html>
+	<h1>Blob Cache</h1>
+	<dl>
+	<dt>Size</dt><dd>{{ .Size }}</dd>
+	<dt>MaxSize</dt><dd>{{ if .MaxSize }}{{ .MaxSize }} ({{ printf "%.1f" .Percent }}% used){{ else }}unlimited{{ end }}</dd>
+	<dt>Entries</dt><dd>{{ .Entries }}</dd>
+	<dt>Pinned</dt><dd>{{ .Pinned }} ({{ .PinnedSize }} bytes)</dd>
+	<dt>Largest</dt><dd>{{ if .LargestKey }}<a href="/admin/cache/entries/{{ .LargestKey }}">{{ .LargestKey }}</a> ({{ .LargestSize }} bytes){{ end }}</dd>
+	</dl>
+	<a href="/admin/cache/entries">Entries</a>
+	</html>`))
+
+	cacheListTemplate = template.Must(template.New("cachelist").Parse(`<html>
+	<h1>Blob Cache Entries</h1>
+	<table><thead><tr>
+		<th>Key</th>
+		<th>Size</th>
+		<th>Last Access</th>
+		<th>Expires</th>
+		<th>Pinned</th>
+	</tr></thead><tbody>
+	{{ range . }}
+	<tr>
+		<td><a href="/admin/cache/entries/{{ .Key }}">{{ .Key }}</a></td>
+		<td>{{ .Size }}</td>
+		<td>{{ .LastAccess.Format "2006-01-02 15:04:05" }}</td>
+		<td>{{ if not .Expires.IsZero }}{{ .Expires.Format "2006-01-02 15:04:05" }}{{ end }}</td>
+		<td>{{ if .Pinned }}yes{{ end }}</td>
+	</tr>
+	{{ else }}
+	<tr><td colspan="5">No entries</td></tr>
+	{{ end }}
+	</tbody></table>
+	<a href="/admin/cache">Back</a>
+	</html>`))
+)
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ndlib/bendo/blobcache"
+	"github.com/ndlib/bendo/store"
+)
+
+func TestCacheRoutes(t *testing.T) {
+	cache := blobcache.NewLRU(store.NewMemory(), 100)
+	for _, key := range []string{"abc+0001", "abc+0002", "xyz+0001"} {
+		w, _ := cache.Put(key)
+		w.Write([]byte("hello world"))
+		w.Close()
+	}
+	s := &RESTServer{
+		Validator: NobodyValidator{},
+		Cache:     cache,
+	}
+	ts := httptest.NewServer(s.addRoutes())
+	defer ts.Close()
+
+	send := func(method, route string, expstatus int) string {
+		req, _ := http.NewRequest(method, ts.URL+route, nil)
+		req.Header.Set("Accept-Encoding", "application/json")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != expstatus {
+			t.Errorf("%s %s: received status %d, expected %d: %s",
+				method, route, resp.StatusCode, expstatus, body)
+		}
+		return string(body)
+	}
+
+	var usage CacheUsage
+	json.NewDecoder(strings.NewReader(send("GET", "/admin/cache", 200))).Decode(&usage)
+	if usage.Size != 33 || usage.MaxSize != 100 || usage.Entries != 3 || usage.Percent != 33 {
+		t.Errorf("Received usage %+v", usage)
+	}
+
+	var entries []blobcache.Entry
+	json.NewDecoder(strings.NewReader(send("GET", "/admin/cache/entries?item=abc", 200))).Decode(&entries)
+	if len(entries) != 2 || entries[0].Key != "abc+0001" || entries[1].Key != "abc+0002" {
+		t.Errorf("Received entries %v", entries)
+	}
+	send("GET", "/admin/cache/entries?limit=x", 400)
+	send("GET", "/admin/cache/entries/abc+0001", 200)
+	send("GET", "/admin/cache/entries/nothere", 404)
+
+	send("PUT", "/admin/cache/entries/abc+0001/pin", 200)
+	send("PUT", "/admin/cache/entries/nothere/pin", 404)
+	send("PUT", "/admin/cache/entries/abc+0001/other", 404)
+	if e, _ := cache.Entry("abc+0001"); !e.Pinned {
+		t.Errorf("Entry was not pinned")
+	}
+
+	send("DELETE", "/admin/cache/entries/xyz+0001", 200)
+	send("DELETE", "/admin/cache/entries/xyz+0001", 404)
+	if body := send("DELETE", "/admin/cache/item/abc", 200); body != "2\n" {
+		t.Errorf("Received %q, expected 2 entries evicted", body)
+	}
+	if cache.Size() != 0 {
+		t.Errorf("Cache has size %d after evicting everything", cache.Size())
+	}
+
+	// caches which cannot be managed
+	s.Cache = struct{ blobcache.T }{blobcache.EmptyCache{}}
+	send("GET", "/admin/cache", 501)
+	send("PUT", "/admin/cache/entries/abc+0001/pin", 501)
+}
@@ -0,0 +1,334 @@
+package server
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/ndlib/bendo/items"
+	"github.com/ndlib/bendo/store"
+)
+
+var (
+	nChunkHit  = expvar.NewInt("cache.chunk.hit")
+	nChunkMiss = expvar.NewInt("cache.chunk.miss")
+)
+
+// chunkKey returns the key used to store bytes start through end, inclusive,
+// of the given blob in the blob cache. Putting the range into the key means
+// chunks cached with a different chunk size are never confused for one
+// another.
+func chunkKey(id string, bid items.BlobID, start, end int64) string {
+	return fmt.Sprintf("%s@%d-%d", blobKey(id, bid), start, end)
+}
+
+// A chunkReader reads a blob which is too large to be cached in one piece.
+// Instead the blob is cached as a sequence of chunks, each chunkSize bytes
+// long except perhaps the last one. A chunk is only read from tape when some
+// part of it is asked for. Since each chunk is a separate cache entry, the
+// parts of a blob which are read end up cached while the rest do not, and
+// chunks are evicted independently of each other.
+//
+// A chunk read from tape is copied into the cache the same way a whole blob
+// is (see joinFill), so any number of requests for the same chunk share one
+// read from tape, and the chunk is kept in a temporary file rather than in
+// memory. A chunkReader is not safe to use from more than one goroutine.
+type chunkReader struct {
+	s         *RESTServer
+	id        string
+	bid       items.BlobID
+	size      int64 // the size of the blob
+	chunkSize int64
+	reqid     string // the request reading the blob, used for logging
+
+	cur int64              // index of the loaded chunk, or -1 for none
+	r   store.ReadAtCloser // the loaded chunk, from the cache or a fill
+
+	// the blob on tape. nil until needed. While one of our chunks is being
+	// copied the stream belongs to the copy, and tapeBack will return it.
+	tape     *streamSeeker
+	tapeBack chan *streamSeeker
+}
+
+// newChunkReader returns a store.ReadAtCloser for the given blob, which is
+// size bytes long, that caches it in pieces of s.ChunkSize bytes.
+func (s *RESTServer) newChunkReader(id string, bid items.BlobID, size int64, reqid string) *chunkReader {
+	return &chunkReader{
+		s:         s,
+		id:        id,
+		bid:       bid,
+		size:      size,
+		chunkSize: s.ChunkSize,
+		reqid:     reqid,
+		cur:       -1,
+	}
+}
+
+// chunkLen returns the length of chunk i.
+func (cr *chunkReader) chunkLen(i int64) int64 {
+	n := cr.size - i*cr.chunkSize
+	if n > cr.chunkSize {
+		n = cr.chunkSize
+	}
+	return n
+}
+
+func (cr *chunkReader) ReadAt(p []byte, off int64) (int, error) {
+	var total int
+	for len(p) > 0 {
+		if off >= cr.size {
+			return total, io.EOF
+		}
+		i := off / cr.chunkSize
+		err := cr.load(i)
+		if err != nil {
+			return total, err
+		}
+		// the position of off inside the chunk
+		pos := off - i*cr.chunkSize
+		want := p
+		if rest := cr.chunkLen(i) - pos; int64(len(want)) > rest {
+			want = want[:rest]
+		}
+		n, err := cr.r.ReadAt(want, pos)
+		if err == io.EOF && n == len(want) {
+			err = nil
+		}
+		total += n
+		off += int64(n)
+		p = p[n:]
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// load makes chunk i the loaded chunk, either from the cache or, if it is
+// not cached, from a copy of it being made from tape into the cache.
+func (cr *chunkReader) load(i int64) error {
+	if i == cr.cur {
+		return nil
+	}
+	cr.unload()
+	start := i * cr.chunkSize
+	clen := cr.chunkLen(i)
+	key := chunkKey(cr.id, cr.bid, start, start+clen-1)
+	r, length, err := cr.s.Cache.Get(key)
+	if err != nil {
+		return err
+	}
+	if r != nil {
+		if length == clen {
+			nChunkHit.Add(1)
+			cr.r = r
+			cr.cur = i
+			return nil
+		}
+		// this shouldn't happen since the range is part of the key
+		log.Println("chunk", key, "has length", length, "expected", clen)
+		r.Close()
+		cr.s.Cache.Delete(key)
+	}
+	nChunkMiss.Add(1)
+	if !cr.s.useTape {
+		return items.ErrNoStore
+	}
+	// were there previous errors when caching this chunk?
+	err = cr.s.errorledger.find(key)
+	if err != nil {
+		return err
+	}
+	fr, err := cr.joinFill(key, start, clen)
+	if err != nil {
+		return err
+	}
+	cr.r = fr
+	cr.cur = i
+	return nil
+}
+
+// joinFill returns a reader for the copy of the given chunk into the cache,
+// starting the copy if there is not one already going on. A copy started
+// here is given our tape stream, so reading the chunks of a blob in order
+// only opens the blob once.
+func (cr *chunkReader) joinFill(key string, start, length int64) (*fillReader, error) {
+	// get the stream back from the copy of our previous chunk before locking
+	// fillM, since that copy needs fillM to finish.
+	if cr.tapeBack != nil {
+		cr.tape = <-cr.tapeBack
+		cr.tapeBack = nil
+	}
+	s := cr.s
+	s.fillM.Lock()
+	defer s.fillM.Unlock()
+	fill := s.fills[key]
+	if fill == nil {
+		var err error
+		fill, err = s.addFill(key)
+		if err != nil {
+			return nil, err
+		}
+		if cr.tape == nil {
+			cr.tape = newStreamSeeker(nil, cr.size, func() (io.ReadCloser, error) {
+				rc, _, err := s.openBlob(cr.id, cr.bid)
+				return rc, err
+			})
+		}
+		back := make(chan *streamSeeker, 1)
+		go s.copyChunkIntoCache(fill, cr.tape, start, length, back, cr.reqid)
+		cr.tape = nil
+		cr.tapeBack = back
+	}
+	return fill.newReader(), nil
+}
+
+// copyChunkIntoCache copies length bytes of tape, starting at byte start,
+// into both fill and s's blobcache. The stream is sent to back once the copy
+// is finished.
+func (s *RESTServer) copyChunkIntoCache(fill *cacheFill, tape *streamSeeker, start, length int64, back chan<- *streamSeeker, reqid string) {
+	s.copyIntoCache(fill, reqid, func(w io.Writer) error {
+		defer func() { back <- tape }()
+		_, err := tape.Seek(start, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(w, tape, length)
+		return err
+	})
+}
+
+// unload forgets the loaded chunk.
+func (cr *chunkReader) unload() {
+	if cr.r != nil {
+		cr.r.Close()
+		cr.r = nil
+	}
+	cr.cur = -1
+}
+
+func (cr *chunkReader) Close() error {
+	cr.unload()
+	if cr.tapeBack != nil {
+		// the copy still going on keeps using the stream, so close it
+		// once the copy is done.
+		back := cr.tapeBack
+		cr.tapeBack = nil
+		go func() { (<-back).Close() }()
+	}
+	if cr.tape != nil {
+		return cr.tape.Close()
+	}
+	return nil
+}
+
+// warm copies each chunk of the blob which is not cached into the cache, one
+// after another, waiting for each copy to finish. It returns the first error.
+func (cr *chunkReader) warm() error {
+	for i := int64(0); i*cr.chunkSize < cr.size; i++ {
+		err := cr.load(i)
+		if err != nil {
+			return err
+		}
+		fr, ok := cr.r.(*fillReader)
+		if !ok {
+			continue
+		}
+		<-fr.c.done
+		if !cr.s.Cache.Contains(fr.c.key) {
+			err = cr.s.errorledger.find(fr.c.key)
+			if err == nil {
+				err = fmt.Errorf("chunk was not cached")
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// needsTape returns whether reading the given blob will read from tape, that
+// is, whether the blob is not cached, or, for a blob cached in chunks,
+// whether any of the chunks covering the bytes asked for by the Range header
+// rng are not cached. An empty rng asks for the whole blob.
+func (s *RESTServer) needsTape(key string, id string, bid items.BlobID, rng string) bool {
+	if s.Cache.Contains(key) {
+		return false
+	}
+	if s.ChunkSize <= 0 || !s.cacheable(s.ChunkSize) {
+		return true
+	}
+	blob, err := s.Items.BlobInfo(id, bid)
+	if err != nil || s.cacheable(blob.Size) {
+		return true
+	}
+	first, last := rangeSpan(rng, blob.Size)
+	for start := first - first%s.ChunkSize; start <= last; start += s.ChunkSize {
+		end := start + s.ChunkSize - 1
+		if end >= blob.Size {
+			end = blob.Size - 1
+		}
+		if !s.Cache.Contains(chunkKey(id, bid, start, end)) {
+			return true
+		}
+	}
+	return false
+}
+
+// rangeSpan returns the first and last bytes, inclusive, of the smallest span
+// of a blob of the given size covering every range in the Range header rng.
+// The whole blob is returned if rng is empty or cannot be understood.
+func rangeSpan(rng string, size int64) (int64, int64) {
+	first, last := size, int64(-1)
+	if !strings.HasPrefix(rng, "bytes=") {
+		return 0, size - 1
+	}
+	for _, ra := range strings.Split(rng[len("bytes="):], ",") {
+		i := strings.Index(ra, "-")
+		if i < 0 {
+			return 0, size - 1
+		}
+		startText := strings.TrimSpace(ra[:i])
+		endText := strings.TrimSpace(ra[i+1:])
+		var start, end int64
+		if startText == "" {
+			// the last n bytes
+			n, err := strconv.ParseInt(endText, 10, 64)
+			if err != nil {
+				return 0, size - 1
+			}
+			start, end = size-n, size-1
+		} else {
+			var err error
+			start, err = strconv.ParseInt(startText, 10, 64)
+			if err != nil {
+				return 0, size - 1
+			}
+			end = size - 1
+			if endText != "" {
+				end, err = strconv.ParseInt(endText, 10, 64)
+				if err != nil {
+					return 0, size - 1
+				}
+			}
+		}
+		if start < 0 {
+			start = 0
+		}
+		if end >= size {
+			end = size - 1
+		}
+		if start < first {
+			first = start
+		}
+		if end > last {
+			last = end
+		}
+	}
+	if first > last {
+		return 0, size - 1
+	}
+	return first, last
+}
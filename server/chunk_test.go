@@ -0,0 +1,138 @@
+package server
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ndlib/bendo/blobcache"
+	"github.com/ndlib/bendo/items"
+	"github.com/ndlib/bendo/store"
+)
+
+func TestChunkReader(t *testing.T) {
+	const content = "0123456789abcdefghijklmnopqrstuvwxyz" // 36 bytes
+	s := &RESTServer{
+		Items:     items.New(store.NewMemory()),
+		Cache:     blobcache.NewLRU(store.NewMemory(), 160),
+		ChunkSize: 10,
+		useTape:   true,
+	}
+	w, err := s.Items.Open("chunk", "nobody")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := md5.Sum([]byte(content))
+	h := sha256.Sum256([]byte(content))
+	bid, err := w.WriteBlob(strings.NewReader(content), int64(len(content)), m[:], h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	// the blob is more than 1/8 of the cache, so it is cached in chunks
+	content1, err := s.findContent(blobKey("chunk", bid), "chunk", bid, true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content1.status != ContentChunked {
+		t.Fatalf("Received status %d, expected %d", content1.status, ContentChunked)
+	}
+	// read a range spanning two chunks
+	p := make([]byte, 8)
+	content1.r.Seek(16, 0)
+	n, err := content1.r.Read(p)
+	if n != 8 || err != nil || string(p) != "ghijklmn" {
+		t.Errorf("Received %d, %v, %q", n, err, p[:n])
+	}
+	content1.r.Close()
+	waitFills(t, s)
+	for _, key := range []string{"chunk+0001@10-19", "chunk+0001@20-29"} {
+		if !s.Cache.Contains(key) {
+			t.Errorf("Chunk %s was not cached", key)
+		}
+	}
+	if s.Cache.Contains("chunk+0001@0-9") {
+		t.Errorf("Chunk which was not read was cached")
+	}
+
+	// read everything with tape turned off. Only the cached chunks are
+	// available.
+	s.useTape = false
+	cr := s.newChunkReader("chunk", bid, int64(len(content)), "")
+	n, err = cr.ReadAt(p, 12)
+	if n != 8 || err != nil || string(p) != "cdefghij" {
+		t.Errorf("Received %d, %v, %q", n, err, p[:n])
+	}
+	_, err = ioutil.ReadAll(NewReadCloser(cr))
+	if err != items.ErrNoStore {
+		t.Errorf("Received %v, expected %v", err, items.ErrNoStore)
+	}
+	cr.Close()
+
+	// with tape, the whole blob can be read, and the last chunk is short
+	s.useTape = true
+	cr = s.newChunkReader("chunk", bid, int64(len(content)), "")
+	b, err := ioutil.ReadAll(NewReadCloser(cr))
+	if string(b) != content || err != nil {
+		t.Errorf("Received %q, %v, expected %q", b, err, content)
+	}
+	cr.Close()
+	waitFills(t, s)
+	if !s.Cache.Contains("chunk+0001@30-35") {
+		t.Errorf("Last chunk was not cached")
+	}
+	if s.needsTape(blobKey("chunk", bid), "chunk", bid, "") {
+		t.Errorf("Reading a blob whose chunks are all cached needs tape")
+	}
+	s.Cache.Delete("chunk+0001@0-9")
+	if !s.needsTape(blobKey("chunk", bid), "chunk", bid, "") {
+		t.Errorf("Reading a blob missing a chunk does not need tape")
+	}
+	// only the chunks covering the range asked for are checked
+	var ranges = []struct {
+		rng  string
+		tape bool
+	}{
+		{"bytes=10-35", false},
+		{"bytes=-6", false},
+		{"bytes=9-12", true},
+		{"bytes=12-14, 5-6", true},
+		{"bytes=20-", false},
+		{"pages=20-", true},
+	}
+	for _, tab := range ranges {
+		if tape := s.needsTape(blobKey("chunk", bid), "chunk", bid, tab.rng); tape != tab.tape {
+			t.Errorf("Range %q: received %v, expected %v", tab.rng, tape, tab.tape)
+		}
+	}
+
+	// readers of a chunk being copied share the copy
+	cr = s.newChunkReader("chunk", bid, int64(len(content)), "")
+	cr2 := s.newChunkReader("chunk", bid, int64(len(content)), "")
+	cr.ReadAt(p[:1], 0)
+	cr2.ReadAt(p[:1], 0)
+	if cr.tapeBack == nil || cr2.tapeBack != nil || cr2.tape != nil {
+		t.Errorf("Second reader started its own copy")
+	}
+	cr.Close()
+	cr2.Close()
+	waitFills(t, s)
+}
+
+// waitFills waits for the copies into the cache going on in s to finish.
+func waitFills(t *testing.T, s *RESTServer) {
+	for i := 0; i < 100; i++ {
+		s.fillM.Lock()
+		n := len(s.fills)
+		s.fillM.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Copies into the cache did not finish")
+}
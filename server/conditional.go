@@ -0,0 +1,124 @@
+package server
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/ndlib/bendo/items"
+)
+
+// These are the Cache-Control values we send. Content referenced by a version
+// number or a blob number never changes, so it may be cached indefinitely.
+// Everything else may change when a new version of an item is saved, so it
+// needs to be revalidated using the ETag or Last-Modified headers.
+const (
+	cacheImmutable  = "max-age=31536000, immutable"
+	cacheRevalidate = "no-cache"
+)
+
+// setBlobHeaders adds the headers describing the given blob, accessed through
+// the given (extended) slot path, to the response.
+func setBlobHeaders(w http.ResponseWriter, slot string, blob *items.Blob) {
+	h := w.Header()
+	h.Set("ETag", fmt.Sprintf(`"%d"`, blob.ID))
+	if !blob.SaveDate.IsZero() {
+		h.Set("Last-Modified", blob.SaveDate.UTC().Format(http.TimeFormat))
+	}
+	if strings.HasPrefix(slot, "@") {
+		h.Set("Cache-Control", cacheImmutable)
+	} else {
+		h.Set("Cache-Control", cacheRevalidate)
+	}
+	name := slotFilename(slot)
+	ctype := blob.MimeType
+	if ctype == "" && name != "" {
+		ctype = mime.TypeByExtension(path.Ext(name))
+	}
+	// If there is no content type, http.ServeContent will sniff one for us.
+	if ctype != "" {
+		h.Set("Content-Type", ctype)
+	}
+	if name != "" {
+		h.Set("Content-Disposition",
+			mime.FormatMediaType("inline", map[string]string{"filename": name}))
+	}
+}
+
+// slotFilename returns the file name part of an extended slot path, or "" if
+// the path does not contain a slot name (e.g. "@blob/nnn" or "@sha256/hex").
+func slotFilename(slot string) string {
+	if strings.HasPrefix(slot, "@") {
+		// only a "@nnn/" version prefix is followed by a slot name
+		j := strings.Index(slot, "/")
+		if j <= 1 || strings.Trim(slot[1:j], "0123456789") != "" {
+			return ""
+		}
+		slot = slot[j+1:]
+	}
+	return path.Base(slot)
+}
+
+// writeBlobError removes the headers describing blob content, since they
+// should not be sent with an error, and then writes the given status code and
+// message as the response.
+func writeBlobError(w http.ResponseWriter, status int, msg interface{}) {
+	h := w.Header()
+	h.Del("Cache-Control")
+	h.Del("Content-Disposition")
+	h.Del("Content-Type")
+	h.Del("Last-Modified")
+	w.WriteHeader(status)
+	fmt.Fprintln(w, msg)
+}
+
+// checkNotModified evaluates the If-None-Match and If-Modified-Since headers
+// of a GET or HEAD request against the ETag already set in the response and
+// the given modification time. If the client's copy is current, a 304 status
+// is written and true is returned. Otherwise nothing is written and false is
+// returned.
+//
+// This is done before looking for content so a conditional request never
+// causes a blob to be recalled from tape.
+func checkNotModified(w http.ResponseWriter, r *http.Request, modtime time.Time) bool {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+	var notmodified bool
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		notmodified = etagMatch(inm, w.Header().Get("ETag"))
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" && !modtime.IsZero() {
+		t, err := http.ParseTime(ims)
+		// HTTP dates only have a resolution of a second
+		notmodified = err == nil && !modtime.Truncate(time.Second).After(t)
+	}
+	if !notmodified {
+		return false
+	}
+	h := w.Header()
+	h.Del("Content-Type")
+	h.Del("Content-Length")
+	h.Del("Content-Disposition")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// etagMatch returns true if etag is in the comma separated list of entity
+// tags given in an If-None-Match header. The comparison is the weak one,
+// so the prefix "W/" is ignored.
+func etagMatch(list string, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
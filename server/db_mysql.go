@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	// no _ in import mysql since we need mysql.NullTime
@@ -26,7 +28,9 @@ type MsqlCache struct {
 
 var _ items.ItemCache = &MsqlCache{}
 var _ FixityDB = &MsqlCache{}
-var _ blobDB = &MsqlCache{}
+var _ BlobDB = &MsqlCache{}
+var _ TokenDB = &MsqlCache{}
+var _ AuditDB = &MsqlCache{}
 
 // List of migrations to perform. Add new ones to the end.
 // DO NOT change the order of items already in this list.
@@ -35,6 +39,11 @@ var mysqlMigrations = []migration.Migrator{
 	mysqlschema2,
 	mysqlschema3,
 	mysqlschema4,
+	mysqlschema5,
+	mysqlschema6,
+	mysqlschema7,
+	mysqlschema8,
+	mysqlschema9,
 }
 
 // Adapt the schema versioning for MySQL
@@ -199,6 +208,126 @@ func (ms *MsqlCache) FindBlobBySlot(item string, version int, slot string) (*ite
 	return ms.FindBlob(item, bid)
 }
 
+// FindBlobsBySHA256 returns every blob in the index having the given SHA-256
+// checksum, ordered by item and blob id.
+func (ms *MsqlCache) FindBlobsBySHA256(sum []byte) ([]BlobRef, error) {
+	const query = `
+			SELECT item, blobid, size, bundle, created, creator, MD5, SHA256,
+				mimetype, deleted, deleter, deletenote
+			FROM blobs
+			WHERE SHA256 = ?
+			ORDER BY item, blobid`
+
+	rows, err := ms.db.Query(query, sum)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []BlobRef
+	for rows.Next() {
+		var ref BlobRef
+		var b items.Blob
+		var bid int64
+		var dDeleted mysql.NullTime
+		var dSave mysql.NullTime
+		err = rows.Scan(&ref.Item, &bid, &b.Size, &b.Bundle, &dSave, &b.Creator, &b.MD5, &b.SHA256, &b.MimeType, &dDeleted, &b.Deleter, &b.DeleteNote)
+		if err != nil {
+			return nil, err
+		}
+		b.ID = items.BlobID(bid)
+		if dSave.Valid {
+			b.SaveDate = dSave.Time
+		}
+		if dDeleted.Valid {
+			b.DeleteDate = dDeleted.Time
+		}
+		ref.Blob = &b
+		result = append(result, ref)
+	}
+	return result, rows.Err()
+}
+
+// ListItems returns the items in the index matching the given query.
+func (ms *MsqlCache) ListItems(q ItemQuery) ([]ItemSummary, error) {
+	query, args := buildItemQuery(q)
+	rows, err := ms.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []ItemSummary
+	for rows.Next() {
+		var summary ItemSummary
+		var created, modified mysql.NullTime
+		err = rows.Scan(&summary.ID, &created, &modified, &summary.Size)
+		if err != nil {
+			return nil, err
+		}
+		if created.Valid {
+			summary.Created = created.Time
+		}
+		if modified.Valid {
+			summary.Modified = modified.Time
+		}
+		result = append(result, summary)
+	}
+	return result, rows.Err()
+}
+
+// construct an sql query and parameter list to list items
+func buildItemQuery(q ItemQuery) (string, []interface{}) {
+	var query bytes.Buffer
+	// as in buildQuery, the parameter list is built in parallel to the query.
+	query.WriteString("SELECT item, created, modified, size FROM items WHERE item > ?")
+	args := []interface{}{q.After}
+
+	if q.Prefix != "" {
+		query.WriteString(" AND item LIKE ?")
+		args = append(args, likeEscaper.Replace(q.Prefix)+"%")
+	}
+	if !q.ModifiedAfter.IsZero() {
+		query.WriteString(" AND modified >= ?")
+		args = append(args, q.ModifiedAfter)
+	}
+	if !q.ModifiedBefore.IsZero() {
+		query.WriteString(" AND modified <= ?")
+		args = append(args, q.ModifiedBefore)
+	}
+	if q.Creator != "" {
+		query.WriteString(" AND item IN (SELECT item FROM versions WHERE creator = ?)")
+		args = append(args, q.Creator)
+	}
+	if q.MinSize > 0 {
+		query.WriteString(" AND size >= ?")
+		args = append(args, q.MinSize)
+	}
+	if q.MaxSize > 0 {
+		query.WriteString(" AND size <= ?")
+		args = append(args, q.MaxSize)
+	}
+	query.WriteString(" ORDER BY item LIMIT ?")
+	args = append(args, q.Limit)
+	return query.String(), args
+}
+
+// likeEscaper quotes the characters that are special in a LIKE pattern.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// IndexStats returns the number and total size of the items in the index,
+// and the number of deleted blobs.
+func (ms *MsqlCache) IndexStats() (IndexStats, error) {
+	var result IndexStats
+	var size sql.NullInt64
+	err := ms.db.QueryRow(`SELECT count(*), sum(size) FROM items`).Scan(&result.Items, &size)
+	if err != nil {
+		return result, err
+	}
+	result.ItemBytes = size.Int64
+	// deleted blobs do not belong to any bundle
+	err = ms.db.QueryRow(`SELECT count(*) FROM blobs WHERE bundle = 0`).Scan(&result.DeletedBlobs)
+	return result, err
+}
+
 // IndexItem adds row entries for every version, slot, and blob
 // for the given item. It is ok if some pieces are already in the tables.
 func (ms *MsqlCache) IndexItem(item string, thisItem *items.Item) error {
@@ -459,6 +588,175 @@ func (mc *MsqlCache) LookupCheck(item string) (time.Time, error) {
 	return time.Time{}, err
 }
 
+// CreateToken saves a new token record and returns its id.
+func (ms *MsqlCache) CreateToken(record TokenRecord) (int64, error) {
+	const command = `INSERT INTO tokens
+		(username, role, scope, hash, created, creator, expires, lastused, disabled)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	result, err := ms.db.Exec(command, record.User, int(record.Role),
+		record.Scope.String(), record.Hash, record.Created, record.Creator,
+		nullTime(record.Expires), nullTime(record.LastUsed), record.Disabled)
+	var id int64
+	if err == nil {
+		id, _ = result.LastInsertId()
+	}
+	return id, err
+}
+
+const mysqlTokenColumns = `id, username, role, scope, hash, created, creator, expires, lastused, disabled`
+
+// GetToken returns the token with the given id, or nil if there is none.
+func (ms *MsqlCache) GetToken(id int64) (*TokenRecord, error) {
+	rows, err := ms.db.Query(`SELECT `+mysqlTokenColumns+` FROM tokens WHERE id = ?`, id)
+	return firstToken(rows, err)
+}
+
+// FindToken returns the token having the given hash, or nil if there is none.
+func (ms *MsqlCache) FindToken(hash string) (*TokenRecord, error) {
+	rows, err := ms.db.Query(`SELECT `+mysqlTokenColumns+` FROM tokens WHERE hash = ?`, hash)
+	return firstToken(rows, err)
+}
+
+// ListTokens returns every token, in order of id.
+func (ms *MsqlCache) ListTokens() ([]TokenRecord, error) {
+	rows, err := ms.db.Query(`SELECT ` + mysqlTokenColumns + ` FROM tokens ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []TokenRecord
+	for rows.Next() {
+		record, err := scanToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, record)
+	}
+	return result, rows.Err()
+}
+
+// firstToken returns the first token record from rows, or nil if there are
+// no rows.
+func firstToken(rows *sql.Rows, err error) (*TokenRecord, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	record, err := scanToken(rows)
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func scanToken(rows *sql.Rows) (TokenRecord, error) {
+	var record TokenRecord
+	var role int
+	var scope sql.NullString
+	var created, expires, lastused mysql.NullTime
+	err := rows.Scan(&record.ID, &record.User, &role, &scope, &record.Hash,
+		&created, &record.Creator, &expires, &lastused, &record.Disabled)
+	record.Role = Role(role)
+	record.Scope = ParseScope(scope.String)
+	record.Created = created.Time
+	record.Expires = expires.Time
+	record.LastUsed = lastused.Time
+	return record, err
+}
+
+// SetTokenDisabled disables or re-enables the given token.
+func (ms *MsqlCache) SetTokenDisabled(id int64, disabled bool) error {
+	_, err := ms.db.Exec(`UPDATE tokens SET disabled = ? WHERE id = ?`, disabled, id)
+	return err
+}
+
+// TouchToken sets the last used time of the given token.
+func (ms *MsqlCache) TouchToken(id int64, when time.Time) error {
+	_, err := ms.db.Exec(`UPDATE tokens SET lastused = ? WHERE id = ?`, when, id)
+	return err
+}
+
+// DeleteToken removes the given token.
+func (ms *MsqlCache) DeleteToken(id int64) error {
+	_, err := ms.db.Exec(`DELETE FROM tokens WHERE id = ?`, id)
+	return err
+}
+
+// AddAudit appends a record to the audit log.
+func (ms *MsqlCache) AddAudit(record AuditRecord) error {
+	const command = `INSERT INTO audit
+		(logged, requestid, username, remote, action, item, txid, detail, outcome)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	_, err := ms.db.Exec(command, record.Time, record.RequestID,
+		record.User, record.Remote, record.Action, record.Item,
+		record.Transaction, record.Detail, record.Outcome)
+	return err
+}
+
+// SearchAudit returns the audit records matching the query, newest first.
+func (ms *MsqlCache) SearchAudit(q AuditQuery) ([]AuditRecord, error) {
+	// as with buildQuery, the parameter list is built in parallel to the
+	// query.
+	var query bytes.Buffer
+	var args []interface{}
+	query.WriteString(`SELECT id, logged, requestid, username, remote,
+		action, item, txid, detail, outcome FROM audit`)
+	conjunction := " WHERE "
+	for _, c := range []struct {
+		use   bool
+		where string
+		arg   interface{}
+	}{
+		{!q.Start.IsZero(), "logged >= ?", q.Start},
+		{!q.End.IsZero(), "logged <= ?", q.End},
+		{q.User != "", "username = ?", q.User},
+		{q.Action != "", "action = ?", q.Action},
+		{q.Item != "", "item = ?", q.Item},
+		{q.Transaction != "", "txid = ?", q.Transaction},
+	} {
+		if c.use {
+			query.WriteString(conjunction + c.where)
+			conjunction = " AND "
+			args = append(args, c.arg)
+		}
+	}
+	query.WriteString(" ORDER BY id DESC")
+	if q.Limit > 0 {
+		fmt.Fprintf(&query, " LIMIT %d", q.Limit)
+	}
+
+	rows, err := ms.db.Query(query.String(), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []AuditRecord
+	for rows.Next() {
+		var rec AuditRecord
+		var logged mysql.NullTime
+		err = rows.Scan(&rec.ID, &logged, &rec.RequestID, &rec.User,
+			&rec.Remote, &rec.Action, &rec.Item, &rec.Transaction,
+			&rec.Detail, &rec.Outcome)
+		if err != nil {
+			return nil, err
+		}
+		rec.Time = logged.Time
+		result = append(result, rec)
+	}
+	return result, rows.Err()
+}
+
+// nullTime returns t as a mysql.NullTime, which is NULL if t is the zero
+// time.
+func nullTime(t time.Time) mysql.NullTime {
+	return mysql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
 // database migrations. each one is a go function. Add them to the
 // list mysqlMigrations at top of this file for them to be run.
 
@@ -545,6 +843,69 @@ func mysqlschema4(tx migration.LimitedTx) error {
 	return execlist(tx, s)
 }
 
+func mysqlschema5(tx migration.LimitedTx) error {
+	// support looking up blobs by their checksum
+	var s = []string{
+		`ALTER TABLE blobs ADD INDEX i_sha256 (SHA256)`,
+	}
+	return execlist(tx, s)
+}
+
+func mysqlschema6(tx migration.LimitedTx) error {
+	// support the filters used when listing items
+	var s = []string{
+		`ALTER TABLE items ADD INDEX i_modified (modified)`,
+		`ALTER TABLE versions ADD INDEX i_creator (creator)`,
+	}
+	return execlist(tx, s)
+}
+
+func mysqlschema7(tx migration.LimitedTx) error {
+	// API tokens managed through /admin/tokens
+	var s = []string{
+		`CREATE TABLE IF NOT EXISTS tokens (
+			id int PRIMARY KEY AUTO_INCREMENT,
+			username varchar(255),
+			role int,
+			hash char(64),
+			created datetime,
+			creator varchar(255),
+			expires datetime NULL,
+			lastused datetime NULL,
+			disabled bool,
+			UNIQUE INDEX i_hash (hash))`,
+	}
+	return execlist(tx, s)
+}
+
+func mysqlschema8(tx migration.LimitedTx) error {
+	// the items each API token may be used for
+	var s = []string{
+		`ALTER TABLE tokens ADD COLUMN scope varchar(1024) NULL AFTER role`,
+	}
+	return execlist(tx, s)
+}
+
+func mysqlschema9(tx migration.LimitedTx) error {
+	// the audit log
+	var s = []string{
+		`CREATE TABLE IF NOT EXISTS audit (
+			id bigint PRIMARY KEY AUTO_INCREMENT,
+			logged datetime,
+			requestid varchar(64),
+			username varchar(255),
+			remote varchar(64),
+			action varchar(64),
+			item varchar(255),
+			txid varchar(64),
+			detail varchar(1024),
+			outcome text,
+			INDEX i_logged (logged),
+			INDEX i_item (item))`,
+	}
+	return execlist(tx, s)
+}
+
 // execlist exec's each item in the list, return if there is an error.
 // Used to work around mysql driver not handling compound exec statements.
 func execlist(tx migration.LimitedTx, stms []string) error {
@@ -27,6 +27,8 @@ func resetMysql(mc *MsqlCache) {
 	mc.db.Exec("DROP TABLE blobs")
 	mc.db.Exec("DROP TABLE slots")
 	mc.db.Exec("DROP TABLE versions")
+	mc.db.Exec("DROP TABLE tokens")
+	mc.db.Exec("DROP TABLE audit")
 }
 
 func TestMySQLItemCache(t *testing.T) {
@@ -67,6 +69,33 @@ func TestMySQLSearchFixity(t *testing.T) {
 	resetMysql(mc)
 }
 
+func TestMySQLTokens(t *testing.T) {
+	mc, err := NewMysqlCache(dialmysql)
+	if err != nil {
+		t.Fatalf("Received %s", err.Error())
+	}
+	runTokenSequence(t, mc)
+	resetMysql(mc)
+}
+
+func TestMySQLAudit(t *testing.T) {
+	mc, err := NewMysqlCache(dialmysql)
+	if err != nil {
+		t.Fatalf("Received %s", err.Error())
+	}
+	runAuditSequence(t, mc)
+	resetMysql(mc)
+}
+
+func TestMySQLBlobChecksum(t *testing.T) {
+	mc, err := NewMysqlCache(dialmysql)
+	if err != nil {
+		t.Fatalf("Received %s", err.Error())
+	}
+	runBlobChecksumSequence(t, mc)
+	resetMysql(mc)
+}
+
 func TestMySQLDelete(t *testing.T) {
 	mc, err := NewMysqlCache(dialmysql)
 	if err != nil {
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"log"
 	"strings"
 	"time"
@@ -27,7 +28,9 @@ type QlCache struct {
 
 var _ items.ItemCache = &QlCache{}
 var _ FixityDB = &QlCache{}
-var _ blobDB = &QlCache{}
+var _ BlobDB = &QlCache{}
+var _ TokenDB = &QlCache{}
+var _ AuditDB = &QlCache{}
 
 // List of migrations to perform. Add new ones to the end.
 // DO NOT change the order of items already in this list.
@@ -35,6 +38,10 @@ var qlMigrations = []migration.Migrator{
 	qlschema1,
 	qlschema2,
 	qlschema3,
+	qlschema4,
+	qlschema5,
+	qlschema6,
+	qlschema7,
 }
 
 // adapt schema versioning for QL
@@ -207,6 +214,102 @@ func (qc *QlCache) FindBlobBySlot(item string, version int, slot string) (*items
 	return qc.FindBlob(item, bid)
 }
 
+// FindBlobsBySHA256 returns every blob in the index having the given SHA-256
+// checksum, ordered by item and blob id.
+func (qc *QlCache) FindBlobsBySHA256(sum []byte) ([]BlobRef, error) {
+	const query = `
+			SELECT item, blobid, size, bundle, created, creator, MD5, SHA256,
+				mimetype, deleted, deleter, deletenote
+			FROM blobs
+			WHERE SHA256 == ?1
+			ORDER BY item, blobid`
+
+	rows, err := qc.db.Query(query, sum)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []BlobRef
+	for rows.Next() {
+		var ref BlobRef
+		var b items.Blob
+		var bid int64
+		err = rows.Scan(&ref.Item, &bid, &b.Size, &b.Bundle, &b.SaveDate, &b.Creator, &b.MD5, &b.SHA256, &b.MimeType, &b.DeleteDate, &b.Deleter, &b.DeleteNote)
+		if err != nil {
+			return nil, err
+		}
+		b.ID = items.BlobID(bid)
+		ref.Blob = &b
+		result = append(result, ref)
+	}
+	return result, rows.Err()
+}
+
+// ListItems returns the items in the index matching the given query.
+func (qc *QlCache) ListItems(q ItemQuery) ([]ItemSummary, error) {
+	query := buildQLItemQuery(q)
+	rows, err := qc.db.Query(query, q.Prefix, q.After, q.ModifiedAfter,
+		q.ModifiedBefore, q.Creator, q.MinSize, q.MaxSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []ItemSummary
+	for rows.Next() {
+		var summary ItemSummary
+		err = rows.Scan(&summary.ID, &summary.Created, &summary.Modified, &summary.Size)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, summary)
+	}
+	return result, rows.Err()
+}
+
+// construct an sql query to list items, using the parameters passed
+func buildQLItemQuery(q ItemQuery) string {
+	var query bytes.Buffer
+	// as in buildQLQuery, every parameter is passed to the query, and the
+	// driver chooses the ones it needs.
+	query.WriteString("SELECT item, created, modified, size FROM items WHERE item > ?2")
+
+	if q.Prefix != "" {
+		query.WriteString(" AND hasPrefix(item, ?1)")
+	}
+	if !q.ModifiedAfter.IsZero() {
+		query.WriteString(" AND modified >= ?3")
+	}
+	if !q.ModifiedBefore.IsZero() {
+		query.WriteString(" AND modified <= ?4")
+	}
+	if q.Creator != "" {
+		query.WriteString(" AND item IN (SELECT item FROM versions WHERE creator == ?5)")
+	}
+	if q.MinSize > 0 {
+		query.WriteString(" AND size >= ?6")
+	}
+	if q.MaxSize > 0 {
+		query.WriteString(" AND size <= ?7")
+	}
+	fmt.Fprintf(&query, " ORDER BY item LIMIT %d", q.Limit)
+	return query.String()
+}
+
+// IndexStats returns the number and total size of the items in the index,
+// and the number of deleted blobs.
+func (qc *QlCache) IndexStats() (IndexStats, error) {
+	var result IndexStats
+	var size sql.NullInt64
+	err := qc.db.QueryRow(`SELECT count(*), sum(size) FROM items`).Scan(&result.Items, &size)
+	if err != nil {
+		return result, err
+	}
+	result.ItemBytes = size.Int64
+	// deleted blobs do not belong to any bundle
+	err = qc.db.QueryRow(`SELECT count(*) FROM blobs WHERE bundle == 0`).Scan(&result.DeletedBlobs)
+	return result, err
+}
+
 // IndexItem adds row entries for every version, slot, and blob
 // for the given item. It is ok if some pieces are already in the tables.
 func (qc *QlCache) IndexItem(item string, thisItem *items.Item) error {
@@ -442,6 +545,159 @@ func (qc *QlCache) LookupCheck(item string) (time.Time, error) {
 	return when, err
 }
 
+// CreateToken saves a new token record and returns its id.
+func (qc *QlCache) CreateToken(record TokenRecord) (int64, error) {
+	const command = `INSERT INTO tokens
+		(username, role, scope, hash, created, creator, expires, lastused, disabled)
+		VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9)`
+
+	result, err := performExec(qc.db, command, record.User, int64(record.Role),
+		record.Scope.String(), record.Hash, record.Created, record.Creator,
+		record.Expires, record.LastUsed, record.Disabled)
+	var id int64
+	if err == nil {
+		id, _ = result.LastInsertId()
+	}
+	return id, err
+}
+
+const qlTokenColumns = `id(), username, role, scope, hash, created, creator, expires, lastused, disabled`
+
+// GetToken returns the token with the given id, or nil if there is none.
+func (qc *QlCache) GetToken(id int64) (*TokenRecord, error) {
+	return qc.queryToken(`SELECT `+qlTokenColumns+` FROM tokens WHERE id() == ?1`, id)
+}
+
+// FindToken returns the token having the given hash, or nil if there is none.
+func (qc *QlCache) FindToken(hash string) (*TokenRecord, error) {
+	return qc.queryToken(`SELECT `+qlTokenColumns+` FROM tokens WHERE hash == ?1`, hash)
+}
+
+func (qc *QlCache) queryToken(query string, arg interface{}) (*TokenRecord, error) {
+	record, err := scanQlToken(qc.db.QueryRow(query, arg))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// scanQlToken reads a token record selected using qlTokenColumns from row,
+// which is either a *sql.Row or a *sql.Rows.
+func scanQlToken(row interface {
+	Scan(dest ...interface{}) error
+}) (TokenRecord, error) {
+	var record TokenRecord
+	var role int64
+	var scope sql.NullString // tokens made before there were scopes have none
+	err := row.Scan(&record.ID, &record.User, &role, &scope,
+		&record.Hash, &record.Created, &record.Creator, &record.Expires,
+		&record.LastUsed, &record.Disabled)
+	record.Role = Role(role)
+	record.Scope = ParseScope(scope.String)
+	return record, err
+}
+
+// ListTokens returns every token, in order of id.
+func (qc *QlCache) ListTokens() ([]TokenRecord, error) {
+	rows, err := qc.db.Query(`SELECT ` + qlTokenColumns + ` FROM tokens ORDER BY id()`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []TokenRecord
+	for rows.Next() {
+		record, err := scanQlToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, record)
+	}
+	return result, rows.Err()
+}
+
+// SetTokenDisabled disables or re-enables the given token.
+func (qc *QlCache) SetTokenDisabled(id int64, disabled bool) error {
+	const command = `UPDATE tokens SET disabled = ?2 WHERE id() == ?1`
+	_, err := performExec(qc.db, command, id, disabled)
+	return err
+}
+
+// TouchToken sets the last used time of the given token.
+func (qc *QlCache) TouchToken(id int64, when time.Time) error {
+	const command = `UPDATE tokens SET lastused = ?2 WHERE id() == ?1`
+	_, err := performExec(qc.db, command, id, when)
+	return err
+}
+
+// DeleteToken removes the given token.
+func (qc *QlCache) DeleteToken(id int64) error {
+	_, err := performExec(qc.db, `DELETE FROM tokens WHERE id() == ?1`, id)
+	return err
+}
+
+// AddAudit appends a record to the audit log.
+func (qc *QlCache) AddAudit(record AuditRecord) error {
+	const command = `INSERT INTO audit
+		(logged, requestid, username, remote, action, item, txid, detail, outcome)
+		VALUES (?1, ?2, ?3, ?4, ?5, ?6, ?7, ?8, ?9)`
+
+	_, err := performExec(qc.db, command, record.Time, record.RequestID,
+		record.User, record.Remote, record.Action, record.Item,
+		record.Transaction, record.Detail, record.Outcome)
+	return err
+}
+
+// SearchAudit returns the audit records matching the query, newest first.
+func (qc *QlCache) SearchAudit(q AuditQuery) ([]AuditRecord, error) {
+	// as with buildQLQuery, every parameter is passed and the query uses
+	// the ones it needs.
+	var query bytes.Buffer
+	query.WriteString(`SELECT id(), logged, requestid, username, remote,
+		action, item, txid, detail, outcome FROM audit`)
+	conjunction := " WHERE "
+	for _, c := range []struct {
+		use   bool
+		where string
+	}{
+		{!q.Start.IsZero(), "logged >= ?1"},
+		{!q.End.IsZero(), "logged <= ?2"},
+		{q.User != "", "username == ?3"},
+		{q.Action != "", "action == ?4"},
+		{q.Item != "", "item == ?5"},
+		{q.Transaction != "", "txid == ?6"},
+	} {
+		if c.use {
+			query.WriteString(conjunction + c.where)
+			conjunction = " AND "
+		}
+	}
+	query.WriteString(" ORDER BY id() DESC")
+	if q.Limit > 0 {
+		fmt.Fprintf(&query, " LIMIT %d", q.Limit)
+	}
+
+	rows, err := qc.db.Query(query.String(), q.Start, q.End, q.User,
+		q.Action, q.Item, q.Transaction)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []AuditRecord
+	for rows.Next() {
+		var rec AuditRecord
+		err = rows.Scan(&rec.ID, &rec.Time, &rec.RequestID, &rec.User,
+			&rec.Remote, &rec.Action, &rec.Item, &rec.Transaction,
+			&rec.Detail, &rec.Outcome)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, rec)
+	}
+	return result, rows.Err()
+}
+
 func performExec(db *sql.DB, query string, args ...interface{}) (sql.Result, error) {
 	tx, err := db.Begin()
 	if err != nil {
@@ -544,3 +800,61 @@ func qlschema3(tx migration.LimitedTx) error {
 	_, err := tx.Exec(s)
 	return err
 }
+
+func qlschema4(tx migration.LimitedTx) error {
+	// API tokens managed through /admin/tokens
+	const s = `
+		CREATE TABLE IF NOT EXISTS tokens (
+			username string,
+			role int,
+			hash string,
+			created time,
+			creator string,
+			expires time,
+			lastused time,
+			disabled bool
+		);
+		CREATE INDEX IF NOT EXISTS token_hash ON tokens (hash);
+		`
+
+	_, err := tx.Exec(s)
+	return err
+}
+
+func qlschema5(tx migration.LimitedTx) error {
+	// the items each API token may be used for
+	const s = `ALTER TABLE tokens ADD scope string;`
+
+	_, err := tx.Exec(s)
+	return err
+}
+
+func qlschema6(tx migration.LimitedTx) error {
+	// the audit log
+	const s = `
+		CREATE TABLE IF NOT EXISTS audit (
+			logged time,
+			requestid string,
+			username string,
+			remote string,
+			action string,
+			item string,
+			txid string,
+			detail string,
+			outcome string
+		);
+		CREATE INDEX IF NOT EXISTS audit_logged ON audit (logged);
+		CREATE INDEX IF NOT EXISTS audit_item ON audit (item);
+		`
+
+	_, err := tx.Exec(s)
+	return err
+}
+
+func qlschema7(tx migration.LimitedTx) error {
+	// support looking up blobs by their checksum
+	const s = `CREATE INDEX IF NOT EXISTS blob_sha256 ON blobs (SHA256);`
+
+	_, err := tx.Exec(s)
+	return err
+}
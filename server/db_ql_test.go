@@ -48,6 +48,24 @@ func TestQLDeleteFixity(t *testing.T) {
 	qc.db.Close()
 }
 
+func TestQlTokens(t *testing.T) {
+	qc, err := NewQlCache("mem--tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runTokenSequence(t, qc)
+	qc.db.Close()
+}
+
+func TestQlAudit(t *testing.T) {
+	qc, err := NewQlCache("mem--audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runAuditSequence(t, qc)
+	qc.db.Close()
+}
+
 func TestQLIndexItem(t *testing.T) {
 	qc, err := NewQlCache("mem--indexitem")
 	if err != nil {
@@ -107,3 +125,18 @@ func TestQLIndexItem(t *testing.T) {
 		}
 	}
 }
+
+func TestQlBlobChecksum(t *testing.T) {
+	qc, err := NewQlCache("mem--blobchecksum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runBlobChecksumSequence(t, qc)
+	// the lookup has an index to use
+	var n int
+	err = qc.db.QueryRow(`SELECT count(*) FROM __Index WHERE Name == "blob_sha256"`).Scan(&n)
+	if err != nil || n != 1 {
+		t.Errorf("Received %d, %v, expected index blob_sha256", n, err)
+	}
+	qc.db.Close()
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ndlib/bendo/items"
+)
+
+// VersionDiffHandler handles requests to GET /item/:id/@diff/:v1/:v2
+// (It is called from the SlotHandler.)
+//
+// It returns the slots which were added, removed, renamed, or modified
+// going from version v1 to version v2 of the item.
+func (s *RESTServer) VersionDiffHandler(w http.ResponseWriter, r *http.Request, item *items.Item, slot string) {
+	var diff *items.VersionDiff
+	pieces := strings.Split(strings.TrimPrefix(slot, "@diff/"), "/")
+	if len(pieces) == 2 {
+		v1, err1 := strconv.ParseUint(pieces[0], 10, 0)
+		v2, err2 := strconv.ParseUint(pieces[1], 10, 0)
+		if err1 == nil && err2 == nil {
+			diff = item.DiffVersions(items.VersionID(v1), items.VersionID(v2))
+		}
+	}
+	if diff == nil {
+		w.WriteHeader(404)
+		fmt.Fprintf(w, "Invalid Version")
+		return
+	}
+	// the representation returned depends on the Accept-Encoding header
+	w.Header().Set("Vary", "Accept-Encoding")
+	writeHTMLorJSON(w, r, diffTemplate, diff)
+}
+
+var (
+	diffTemplate = template.Must(template.New("diff").Parse(`
+<html><head><style>
+tbody tr:nth-child(even) { background-color: #eeeeee; }
+</style></head><body>
+<h1>Changes from version {{ .From }} to version {{ .To }}</h1>
+{{ define "blob" }}{{ if . }}{{ .ID }} ({{ .Size }} bytes, sha256 {{ .SHA256 }}){{ end }}{{ end }}
+{{ define "entries" }}
+<table>
+	<thead><tr>
+		<th>Slot</th>
+		<th>Old Blob</th>
+		<th>New Blob</th>
+	</tr></thead><tbody>
+{{ range . }}
+	<tr>
+		<td>{{ if .OldSlot }}{{ .OldSlot }} &rarr; {{ end }}{{ .Slot }}</td>
+		<td>{{ template "blob" .Old }}</td>
+		<td>{{ template "blob" .New }}</td>
+	</tr>
+{{ end }}
+</tbody></table>
+{{ end }}
+<h2>Added</h2>
+{{ template "entries" .Added }}
+<h2>Removed</h2>
+{{ template "entries" .Removed }}
+<h2>Renamed</h2>
+{{ template "entries" .Renamed }}
+<h2>Modified</h2>
+{{ template "entries" .Modified }}
+</body></html>`))
+)
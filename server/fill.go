@@ -0,0 +1,159 @@
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// A cacheFill is a blob being copied from tape into the blob cache. The bytes
+// are also written to a temporary file, so they can be served to any number
+// of readers while the copy is still going on. Readers wanting bytes that
+// have not arrived yet wait for them. The last byte is held back until the
+// copy has finished without error, so a reader never receives all of a blob
+// which failed verification.
+//
+// The temporary file is removed once the copy has finished and every reader
+// has been closed.
+type cacheFill struct {
+	key  string        // the cache key being filled
+	done chan struct{} // closed when the copy has finished
+
+	m        sync.Mutex
+	cond     *sync.Cond // signaled whenever n or finished changes
+	f        *os.File   // temporary file holding the bytes copied so far
+	n        int64      // the number of bytes in f
+	finished bool       // has the copy stopped?
+	err      error      // the reason the copy stopped early, if any
+	refs     int        // number of open readers, plus one for the copy itself
+}
+
+// newCacheFill creates a cacheFill for the given key, keeping its temporary
+// file in dir. The returned fill has a reference held for the copy, which is
+// released by calling finish().
+func newCacheFill(dir string, key string) (*cacheFill, error) {
+	f, err := ioutil.TempFile(dir, "bendo-fill-")
+	if err != nil {
+		return nil, err
+	}
+	c := &cacheFill{
+		key:  key,
+		done: make(chan struct{}),
+		f:    f,
+		refs: 1,
+	}
+	c.cond = sync.NewCond(&c.m)
+	return c, nil
+}
+
+// Write appends p to the fill and wakes any readers waiting for it. It should
+// only be called by the goroutine doing the copy.
+func (c *cacheFill) Write(p []byte) (int, error) {
+	n, err := c.f.Write(p)
+	c.m.Lock()
+	c.n += int64(n)
+	c.m.Unlock()
+	c.cond.Broadcast()
+	return n, err
+}
+
+// finish marks the copy as stopped and releases the reference held for it.
+// If err is not nil, readers asking for bytes past the ones copied will
+// receive it.
+func (c *cacheFill) finish(err error) {
+	c.m.Lock()
+	c.finished = true
+	c.err = err
+	c.m.Unlock()
+	c.cond.Broadcast()
+	close(c.done)
+	c.release()
+}
+
+// wait blocks until some bytes have been copied or the copy has stopped. It
+// returns the reason the copy stopped if that happened before any bytes were
+// copied.
+func (c *cacheFill) wait() error {
+	c.m.Lock()
+	defer c.m.Unlock()
+	for c.n == 0 && !c.finished {
+		c.cond.Wait()
+	}
+	if c.n == 0 {
+		return c.err
+	}
+	return nil
+}
+
+// available returns the number of bytes readers may read. The lock must be
+// held when calling this.
+func (c *cacheFill) available() int64 {
+	if c.n > 0 && (!c.finished || c.err != nil) {
+		return c.n - 1
+	}
+	return c.n
+}
+
+// newReader returns a reader for the contents of the fill. It must be closed
+// when finished. It is not safe to call newReader once the fill has finished
+// and all of its readers have been closed.
+func (c *cacheFill) newReader() *fillReader {
+	c.m.Lock()
+	c.refs++
+	c.m.Unlock()
+	return &fillReader{c: c}
+}
+
+func (c *cacheFill) release() {
+	c.m.Lock()
+	c.refs--
+	last := c.refs == 0
+	c.m.Unlock()
+	if last {
+		c.f.Close()
+		os.Remove(c.f.Name())
+	}
+}
+
+// A fillReader is an open handle to a cacheFill. It implements
+// store.ReadAtCloser.
+type fillReader struct {
+	c    *cacheFill
+	once sync.Once
+}
+
+// ReadAt waits until the bytes asked for have been copied or the copy has
+// stopped, and then returns as many of them as it can.
+func (r *fillReader) ReadAt(p []byte, off int64) (int, error) {
+	c := r.c
+	want := off + int64(len(p))
+	c.m.Lock()
+	for c.available() < want && !c.finished {
+		c.cond.Wait()
+	}
+	avail, copyErr := c.available(), c.err
+	c.m.Unlock()
+
+	if copyErr == nil {
+		copyErr = io.EOF
+	}
+	if off >= avail {
+		return 0, copyErr
+	}
+	short := avail < want
+	if short {
+		p = p[:avail-off]
+	}
+	n, err := c.f.ReadAt(p, off)
+	if err == nil && short {
+		err = copyErr
+	}
+	return n, err
+}
+
+// Close releases the reader's hold on the fill.
+func (r *fillReader) Close() error {
+	r.once.Do(r.c.release)
+	return nil
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCacheFill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bendo-filltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fill, err := newCacheFill(dir, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := fill.f.Name()
+	if filepath.Dir(name) != dir {
+		t.Errorf("Temporary file %s is not in %s", name, dir)
+	}
+	r1 := fill.newReader()
+	r2 := fill.newReader()
+
+	fill.Write([]byte("hello "))
+	// bytes already copied are available right away
+	p := make([]byte, 5)
+	n, err := r1.ReadAt(p, 0)
+	if n != 5 || err != nil || string(p) != "hello" {
+		t.Errorf("Received %d, %v, %q", n, err, p[:n])
+	}
+
+	// a reader asking for more waits for the copy
+	result := make(chan string)
+	go func() {
+		b, _ := ioutil.ReadAll(NewReadCloser(r2))
+		result <- string(b)
+	}()
+	select {
+	case <-result:
+		t.Fatal("Reader did not wait for the copy")
+	case <-time.After(10 * time.Millisecond):
+	}
+	fill.Write([]byte("world"))
+	fill.finish(nil)
+	if s := <-result; s != "hello world" {
+		t.Errorf("Received %q, expected %q", s, "hello world")
+	}
+
+	// the temporary file is kept until the last reader is closed
+	r2.Close()
+	if _, err := os.Stat(name); err != nil {
+		t.Errorf("Temporary file removed early: %v", err)
+	}
+	r1.Close()
+	r1.Close()
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("Temporary file was not removed: %v", err)
+	}
+}
+
+func TestCacheFillError(t *testing.T) {
+	fill, err := newCacheFill("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := fill.newReader()
+	defer r.Close()
+	fill.Write([]byte("partial"))
+	expected := errors.New("tape error")
+	fill.finish(expected)
+	// the last byte is never given out
+	p := make([]byte, 20)
+	n, err := r.ReadAt(p, 0)
+	if n != 6 || err != expected {
+		t.Errorf("Received %d, %v, expected 6, %v", n, err, expected)
+	}
+	n, err = r.ReadAt(p, 6)
+	if n != 0 || err != expected {
+		t.Errorf("Received %d, %v, expected 0, %v", n, err, expected)
+	}
+}
@@ -74,9 +74,15 @@ var (
 )
 
 // StartFixity starts the background goroutines to check item fixity. It
-// returns immediately and does not block.
+// returns immediately and does not block. Nothing is started if there is no
+// FixityDatabase.
 func (s *RESTServer) StartFixity() {
+	if s.FixityDatabase == nil {
+		log.Println("No fixity database. Fixity checking is not started")
+		return
+	}
 	xFixityRunning.Add(1)
+	s.fixityStarted = true
 
 	go s.fixity()
 
@@ -84,7 +90,7 @@ func (s *RESTServer) StartFixity() {
 	// this will keep running it in a loop with 24 hour rest in between.
 	go func() {
 		for {
-			if s.useTape {
+			if s.useTape && !s.DisableFixity {
 				s.scanfixity()
 			}
 			time.Sleep(24 * time.Hour)
@@ -92,6 +98,16 @@ func (s *RESTServer) StartFixity() {
 	}()
 }
 
+// SetFixity turns the background fixity checking on or off while the server
+// is running. A check already in progress is finished. Once turned back on,
+// checking may not resume for up to an hour.
+func (s *RESTServer) SetFixity(enable bool) {
+	s.DisableFixity = !enable
+	if enable && !s.fixityStarted {
+		s.StartFixity()
+	}
+}
+
 const (
 	// by default schedule the next fixity sometime between 6 and 12 months in
 	// the future. This range is completely arbitrary.
@@ -105,7 +121,7 @@ func (s *RESTServer) fixity() {
 	log.Println("Starting fixity loop")
 	for {
 		id := s.FixityDatabase.NextFixity(time.Now())
-		if id == 0 || !s.useTape {
+		if id == 0 || !s.useTape || s.DisableFixity {
 			// sleep if there are no ids available.
 			// an hour is arbitrary.
 			time.Sleep(time.Hour)
@@ -231,6 +247,15 @@ func (s *RESTServer) GetFixityHandler(w http.ResponseWriter, r *http.Request, ps
 	}
 
 	result := s.FixityDatabase.SearchFixity(startValue, endValue, item, statusValue)
+	if scope := requestScope(r); scope != nil {
+		var allowed []*Fixity
+		for _, record := range result {
+			if scope.Allows(record.Item) {
+				allowed = append(allowed, record)
+			}
+		}
+		result = allowed
+	}
 	if result == nil {
 		fmt.Fprintln(w, "[]")
 		return
@@ -253,6 +278,9 @@ func (s *RESTServer) GetFixityIdHandler(w http.ResponseWriter, r *http.Request,
 		fmt.Fprintln(w, "GET /fixity/", id, " Not Found")
 		return
 	}
+	if !checkScope(w, r, result.Item) {
+		return
+	}
 
 	enc := json.NewEncoder(w)
 	enc.Encode(result)
@@ -268,6 +296,16 @@ func (s *RESTServer) DeleteFixityHandler(w http.ResponseWriter, r *http.Request,
 		w.WriteHeader(404)
 		return
 	}
+	// the route gives a record id, so the item is checked against the
+	// token's scope here
+	record := s.FixityDatabase.GetFixity(id0)
+	if record == nil {
+		w.WriteHeader(404)
+		return
+	}
+	if !checkScope(w, r, record.Item) {
+		return
+	}
 	err = s.FixityDatabase.DeleteFixity(id0)
 	if err != nil {
 		w.WriteHeader(500)
@@ -287,6 +325,9 @@ func (s *RESTServer) PutFixityHandler(w http.ResponseWriter, r *http.Request, ps
 		w.WriteHeader(404)
 		return
 	}
+	if !checkScope(w, r, record.Item) {
+		return
+	}
 	record.ScheduledTime = time.Now()
 	_, err = s.FixityDatabase.UpdateFixity(*record)
 
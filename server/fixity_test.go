@@ -236,3 +236,11 @@ func runDeleteFixity(t *testing.T, fx FixityDB) {
 	}
 
 }
+
+func TestFixityWithoutDatabase(t *testing.T) {
+	s := &RESTServer{DisableFixity: true}
+	s.SetFixity(true)
+	if s.fixityStarted {
+		t.Errorf("Fixity checking started without a fixity database")
+	}
+}
@@ -1,6 +1,8 @@
 package server
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/hex"
 	"expvar"
 	"fmt"
@@ -8,12 +10,12 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
 	raven "github.com/getsentry/raven-go"
 	"github.com/julienschmidt/httprouter"
-	"golang.org/x/sync/singleflight"
 
 	"github.com/ndlib/bendo/items"
 	"github.com/ndlib/bendo/store"
@@ -24,12 +26,12 @@ var (
 	nCacheMiss = expvar.NewInt("cache.miss")
 )
 
-// blobDB are the methods we need to interact with the new item metadata caching.
+// BlobDB are the methods we need to interact with the new item metadata caching.
 // This interface is expected to grow as more functionality is moved to the database.
 //
 // The goal is to remove the original database Cache interface along with its hooks into the
 // item package.
-type blobDB interface {
+type BlobDB interface {
 	// Look up the metadata for the given item+blob id. Returns error if error encountered.
 	// returns nil,nil if the blob was not found in the index.
 	FindBlob(item string, blobid int) (*items.Blob, error)
@@ -40,11 +42,28 @@ type blobDB interface {
 	// Use version = 0 to refer to the most recent version of the item.
 	FindBlobBySlot(item string, version int, slot string) (*items.Blob, error)
 
+	// Look up every blob, in any item, having the given SHA-256 checksum.
+	// Returns an empty list if there are none.
+	FindBlobsBySHA256(sum []byte) ([]BlobRef, error)
+
+	// Summarize the contents of the index.
+	IndexStats() (IndexStats, error)
+
+	// List the items in the index matching the given query, in order of
+	// their ids. At most q.Limit items are returned.
+	ListItems(q ItemQuery) ([]ItemSummary, error)
+
 	// Index the given item using the given id.
 	// (The item id should already be in the item structure. can that parameter be removed?)
 	IndexItem(itemid string, item *items.Item) error
 }
 
+// A BlobRef identifies a blob inside a particular item.
+type BlobRef struct {
+	Item string
+	Blob *items.Blob
+}
+
 // SlotHandler handles requests to GET /item/:id/*slot
 //                and requests to HEAD /item/:id/*slot
 func (s *RESTServer) SlotHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
@@ -75,6 +94,15 @@ func (s *RESTServer) SlotHandler(w http.ResponseWriter, r *http.Request, ps http
 		s.ItemHandler(w, r, ps)
 		return
 	}
+	if strings.HasPrefix(slot, "@diff/") {
+		s.VersionDiffHandler(w, r, item, slot)
+		return
+	}
+	// "@nnn.zip" and "@nnn.tar" are the entire version nnn as a bag
+	if vid, format := parseArchiveSlot(slot); vid > 0 {
+		s.VersionArchiveHandler(w, r, id, item, vid, format)
+		return
+	}
 	// slot might have a "@nnn" version prefix
 	bid := item.BlobByExtendedSlot(slot)
 	if bid == 0 {
@@ -82,106 +110,111 @@ func (s *RESTServer) SlotHandler(w http.ResponseWriter, r *http.Request, ps http
 		fmt.Fprintf(w, "Invalid Version")
 		return
 	}
-	w.Header().Set("X-Content-Sha256", hex.EncodeToString(item.Blobs[bid-1].SHA256))
-	w.Header().Set("X-Content-Md5", hex.EncodeToString(item.Blobs[bid-1].MD5))
+	setRequestBlob(r, bid)
+	blob := item.Blobs[bid-1]
+	w.Header().Set("X-Content-Sha256", hex.EncodeToString(blob.SHA256))
+	w.Header().Set("X-Content-Md5", hex.EncodeToString(blob.MD5))
 	w.Header().Set("Location", fmt.Sprintf("/item/%s/@blob/%d", id, bid))
-	s.getblob(w, r, id, items.BlobID(bid))
+	setBlobHeaders(w, slot, blob)
+	if checkNotModified(w, r, blob.SaveDate) {
+		return
+	}
+	s.getblob(w, r, id, items.BlobID(bid), blob.SaveDate)
 }
 
 // getblob will find the given blob, either in the cache or on
 // tape, and then send it as a response. If there is an error, it
-// will return an error response.
-func (s *RESTServer) getblob(w http.ResponseWriter, r *http.Request, id string, bid items.BlobID) {
+// will return an error response. The modtime is used to evaluate any
+// If-Range header and may be the zero time.
+func (s *RESTServer) getblob(w http.ResponseWriter, r *http.Request, id string, bid items.BlobID, modtime time.Time) {
 	// GET requests always cache content. HEAD requests cache content only if
 	// the Request-Cache header is passed (with any value)
 	docache := r.Method == "GET" || r.Header.Get("Request-Cache") != ""
-	key := fmt.Sprintf("%s+%04d", id, bid)
-	firsttime := true
-retry:
-	content, err := s.findContent(key, id, bid, docache)
+	key := blobKey(id, bid)
+	// with an If-Range header the whole blob may be sent
+	rng := r.Header.Get("Range")
+	if r.Header.Get("If-Range") != "" {
+		rng = ""
+	}
+	if docache && s.useTape && s.needsTape(key, id, bid, rng) {
+		release := s.startTapeRead(w, r)
+		if release == nil {
+			return
+		}
+		defer release()
+	}
+	content, err := s.findContent(key, id, bid, docache, requestID(r))
+	if err == nil && content.status == ContentFilling && r.Method == "GET" {
+		// wait for the blob to start arriving, so an error reading it can
+		// still be given a status code.
+		err = content.fill.wait()
+		if err != nil {
+			content.r.Close()
+		}
+	}
 	if err == items.ErrNoStore {
-		w.WriteHeader(503)
-		fmt.Fprintln(w, err)
+		writeBlobError(w, 503, err)
 		return
 	} else if err == items.ErrDeleted {
-		w.WriteHeader(410)
-		fmt.Fprintln(w, err)
+		writeBlobError(w, 410, err)
 		return
 	} else if _, ok := err.(items.NoBlobError); ok {
-		w.WriteHeader(404)
-		fmt.Fprintln(w, err)
+		writeBlobError(w, 404, err)
 		return
 	} else if err != nil {
 		log.Println("getblob", key, err)
-		w.WriteHeader(500)
-		fmt.Fprintln(w, err)
+		writeBlobError(w, 500, err)
 		return
 	}
 	switch content.status {
 	case ContentCached:
-		if firsttime {
-			nCacheHit.Add(1)
-			log.Println("Cache Hit", key)
-			w.Header().Set("X-Cached", "1")
-		}
+		nCacheHit.Add(1)
+		log.Println("Cache Hit", key)
+		w.Header().Set("X-Cached", "1")
 		defer content.r.Close()
 	case ContentLarge:
 		log.Println("Cache Miss (too large)", key)
 		w.Header().Set("X-Cached", "2")
 		defer content.r.Close()
-	case ContentWaiting:
-		if !firsttime {
-			// why are we waiting for content a second time?
-			log.Println("getblob", key, "unexpectedly waiting for content a second time")
-			w.WriteHeader(500)
-			fmt.Fprintln(w, "The file cannot be accessed at this time")
-			return
-		}
+	case ContentChunked:
+		log.Println("Cache Miss (chunked)", key)
+		w.Header().Set("X-Cached", "3")
+		defer content.r.Close()
+	case ContentWaiting, ContentFilling:
 		nCacheMiss.Add(1)
 		log.Println("Cache Miss", key)
 		w.Header().Set("X-Cached", "0")
-		// Since content is not returned for non-GET requests, don't wait
-		// for it to be cached.
-		if r.Method != "GET" {
-			break
-		}
-		select {
-		case <-content.done:
-			log.Println("Waiting for content is done, trying again", key)
-			firsttime = false
-			goto retry
-		case <-time.After(60 * time.Second):
-			log.Println("getblob", key, "timeout")
-			w.WriteHeader(504)
-			fmt.Fprintln(w, "timeout")
-			return
+		if content.r != nil {
+			defer content.r.Close()
 		}
 	default:
 		log.Println("getblob received status", content.status)
-		w.WriteHeader(500)
-		fmt.Fprintln(w, "received status", content.status)
+		writeBlobError(w, 500, fmt.Sprintln("received status", content.status))
 		return
 	}
 
-	w.Header().Set("ETag", fmt.Sprintf(`"%d"`, bid))
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", content.size))
-
-	// all the headers have been set, now do we need to copy bits?
-	if r.Method != "GET" {
+	// HEAD requests for uncached content have no stream to serve from.
+	if content.r == nil {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", content.size))
 		return
 	}
-	n, err := io.Copy(w, content.r)
-	if err != nil {
-		log.Printf("getblob (%s,%d) %d,%s", id, bid, n, err.Error())
-	}
+	// ServeContent handles HEAD requests and the Range and If-Range headers
+	w.Header().Set("Accept-Ranges", "bytes")
+	http.ServeContent(w, r, "", modtime, content.r)
+}
+
+// blobKey returns the key used to store the given blob in the blob cache.
+func blobKey(id string, bid items.BlobID) string {
+	return fmt.Sprintf("%s+%04d", id, bid)
 }
 
-// contentSource is either a ReadCloser that contains the requested data, or it is a promise of a future data stream, which is ready when the done channel is closed.
+// contentSource is either a ReadCloser that contains the requested data, or,
+// for HEAD requests of uncached content, just the size of the data.
 type contentSource struct {
 	status ContentStatus
-	r      io.ReadCloser              // valid if status is Cached or Large
-	size   int64                      // valid if status is Cached, Large, or Waiting
-	done   <-chan singleflight.Result // valid if status is Waiting
+	r      ReadSeekCloser // valid if status is Cached, Large, Chunked, or Filling
+	size   int64          // always valid
+	fill   *cacheFill     // valid if status is Filling
 }
 
 type ContentStatus int
@@ -190,7 +223,9 @@ const (
 	ContentUnknown ContentStatus = iota
 	ContentCached                // the content was sourced from the cache
 	ContentLarge                 // the content was very big and is not cached
-	ContentWaiting               // the content is being copied into the cache
+	ContentWaiting               // the content is not cached and was not asked to be
+	ContentFilling               // the content is being copied into the cache and read as it arrives
+	ContentChunked               // the content is very big and is cached in pieces
 )
 
 // An errorlist is a simple goroutine safe map that expires entries
@@ -252,7 +287,8 @@ out:
 // findContent will look in the cache and on tape for the given blob. If
 // it is not in the cache, it will load it into the cache, if doLoad is true.
 // (This is to facilitate HEAD requests that shouldn't recall content).
-func (s *RESTServer) findContent(key string, id string, bid items.BlobID, doLoad bool) (contentSource, error) {
+// The reqid is the id of the request asking for the content, used for logging.
+func (s *RESTServer) findContent(key string, id string, bid items.BlobID, doLoad bool, reqid string) (contentSource, error) {
 	var result contentSource
 	cacheContents, length, err := s.Cache.Get(key)
 	if err != nil {
@@ -261,7 +297,10 @@ func (s *RESTServer) findContent(key string, id string, bid items.BlobID, doLoad
 	if cacheContents != nil {
 		// item was cached
 		result.status = ContentCached
-		result.r = NewReadCloser(cacheContents)
+		result.r = &countReadSeekCloser{
+			ReadSeekCloser: NewReadSeekCloser(cacheContents, length),
+			count:          xCacheServedBytes,
+		}
 		result.size = length
 		return result, nil
 	}
@@ -285,89 +324,165 @@ func (s *RESTServer) findContent(key string, id string, bid items.BlobID, doLoad
 		return result, err
 	}
 	// cache this item if it is not too large.
-	// doing 1/8th of the cache size is arbitrary.
-	// not sure what a good cutoff would be.
-	// (remember maxsize == 0 means infinite)
-	cacheMaxSize := s.Cache.MaxSize()
-	if cacheMaxSize == 0 || length < cacheMaxSize/8 {
-		// single flight the requests
-		// lazy initialize
-		if s.tapeinflight == nil {
-			s.tapeinflight = &singleflight.Group{}
+	if s.cacheable(length) {
+		fr, err := s.joinFill(key, id, bid, blobinfo.SHA256, reqid)
+		if err != nil {
+			return result, err
 		}
-		c := s.tapeinflight.DoChan(key, func() (interface{}, error) {
-			s.copyBlobIntoCache(key, id, bid)
-			return nil, nil
-		})
-		result.status = ContentWaiting
-		result.done = c
+		result.status = ContentFilling
+		result.r = NewReadSeekCloser(fr, length)
+		result.fill = fr.c
+		return result, nil
+	}
+	// item is too large to be cached in one piece.
+	// cache it in chunks, if that is turned on
+	if s.ChunkSize > 0 && s.cacheable(s.ChunkSize) {
+		result.status = ContentChunked
+		result.r = NewReadSeekCloser(s.newChunkReader(id, bid, length, reqid), length)
 		return result, nil
 	}
-	// item is too large to be cached
-	// get it directly from tape
-	realContents, _, err := s.Items.Blob(id, bid)
+	// otherwise get it directly from tape
+	realContents, _, err := s.openBlob(id, bid)
 	if err != nil {
 		return result, err
 	}
 	result.status = ContentLarge
-	result.r = realContents
+	result.r = newStreamSeeker(realContents, length, func() (io.ReadCloser, error) {
+		rc, _, err := s.openBlob(id, bid)
+		return rc, err
+	})
 	return result, nil
 }
 
-// copyBlobIntoCache copies the given blob of the item id into s's blobcache
-// under the given key. Closes the given channel when the item is copied or if
-// there was an error. Errors are added to the errorledger.
-func (s *RESTServer) copyBlobIntoCache(key, id string, bid items.BlobID) {
-	starttime := time.Now()
-	var keepcopy bool
-	// defer this first so it is the last to run at exit.
-	// because cw needs to be Closed() before the Delete().
-	// And defered funcs are run LIFO.
-	defer func() {
-		if !keepcopy {
-			s.Cache.Delete(key)
+// cacheable returns whether a blob of the given length may be copied into the
+// cache in one piece.
+func (s *RESTServer) cacheable(length int64) bool {
+	// doing 1/8th of the cache size is arbitrary.
+	// not sure what a good cutoff would be.
+	// (remember maxsize == 0 means infinite)
+	cacheMaxSize := s.Cache.MaxSize()
+	return cacheMaxSize == 0 || length < cacheMaxSize/8
+}
+
+// joinFill returns a reader for the copy of the given blob into the cache,
+// starting the copy if there is not one already going on. This way a blob is
+// only read from tape once no matter how many requests want it, and every
+// request gets the bytes as soon as they arrive. The sha256 is the blob's
+// checksum, used to verify the copy. The reqid is the id of the request
+// asking for the content, used for logging.
+func (s *RESTServer) joinFill(key, id string, bid items.BlobID, sha []byte, reqid string) (*fillReader, error) {
+	s.fillM.Lock()
+	defer s.fillM.Unlock()
+	fill := s.fills[key]
+	if fill == nil {
+		var err error
+		fill, err = s.addFill(key)
+		if err != nil {
+			return nil, err
 		}
-		log.Println("copyblob finished", key, time.Now().Sub(starttime))
-	}()
-	cw, err := s.Cache.Put(key)
+		go s.copyBlobIntoCache(fill, id, bid, sha, reqid)
+	}
+	return fill.newReader(), nil
+}
+
+// addFill makes a new fill for the given key and adds it to s.fills. The
+// caller needs to hold s.fillM and to start the copy.
+func (s *RESTServer) addFill(key string) (*cacheFill, error) {
+	fill, err := newCacheFill(s.FillDir, key)
 	if err != nil {
-		// since there is a gaurd around calling copyBlobIntoCache() we
-		// shouldn't be receiving ErrPutPending errors here...
-		log.Printf("cache put %s: %s", key, err.Error())
-		keepcopy = true // in case someone else added a copy already
-		return
+		return nil, err
 	}
-	defer func() {
-		err := cw.Close()
+	if s.fills == nil {
+		s.fills = make(map[string]*cacheFill)
+	}
+	s.fills[key] = fill
+	return fill, nil
+}
+
+// copyBlobIntoCache copies the given blob of the item id into both fill and
+// s's blobcache under the fill's key. The copy into the fill continues even
+// if the cache cannot take the blob. If sha is not empty, the copy is only
+// kept if its SHA-256 checksum matches. Errors are added to the errorledger.
+// The reqid is the id of the request which triggered the copy, and is only
+// used for logging.
+func (s *RESTServer) copyBlobIntoCache(fill *cacheFill, id string, bid items.BlobID, sha []byte, reqid string) {
+	s.copyIntoCache(fill, reqid, func(w io.Writer) error {
+		cr, length, err := s.openBlob(id, bid)
 		if err != nil {
-			// also want to also put this into the errorlog, but don't want to
-			// potentially shadow any earlier errors that may have been put
-			// there in this effort. So for now we just log it.
-			log.Println("cache close", key, err)
-			keepcopy = false
+			return err
 		}
-	}()
-	cr, length, err := s.Items.Blob(id, bid)
+		defer cr.Close()
+		h := sha256.New()
+		// should we put a timeout on the copy?
+		n, err := io.Copy(io.MultiWriter(w, h), cr)
+		if err == nil && n != length {
+			err = fmt.Errorf("cache length mismatch: read %d, expected %d", n, length)
+		}
+		if err == nil && len(sha) > 0 && !bytes.Equal(h.Sum(nil), sha) {
+			err = fmt.Errorf("cache checksum mismatch: read %x, expected %x", h.Sum(nil), sha)
+			s.cacheMismatch(fill.key, "copy")
+		}
+		return err
+	})
+}
+
+// copyIntoCache calls copy to write the content of fill, sending what it
+// writes into both fill and s's blobcache under the fill's key. The cache
+// entry is only kept if copy returns nil. Once copy returns the fill is
+// finished and removed from s.fills.
+func (s *RESTServer) copyIntoCache(fill *cacheFill, reqid string, copy func(w io.Writer) error) {
+	starttime := time.Now()
+	key := fill.key
+	cw, err := s.Cache.Put(key)
 	if err != nil {
-		log.Printf("cache items get %s: %s", key, err.Error())
-		s.errorledger.add(key, err)
-		return
+		// someone else may be adding a copy, or the cache is full. In either
+		// case the readers of the fill still need the content.
+		log.Printf("cache put %s (request %s): %s", key, reqid, err.Error())
+		cw = nil
 	}
-	defer cr.Close()
-	// should we put a timeout on the copy?
-	n, err := io.Copy(cw, cr)
+	tee := &cacheTee{w: cw}
+	err = copy(io.MultiWriter(fill, tee))
 	if err != nil {
-		log.Printf("cache copy %s: %s", key, err.Error())
+		log.Printf("cache copy %s (request %s): %s", key, reqid, err.Error())
 		s.errorledger.add(key, err)
-		return
 	}
-	if n != length {
-		err = fmt.Errorf("cache length mismatch: read %d, expected %d", n, length)
-		log.Println(err)
-		s.errorledger.add(key, err)
-		return
+	if cw != nil {
+		keepcopy := err == nil
+		if tee.err != nil {
+			log.Println("cache write", key, "request", reqid, tee.err)
+			keepcopy = false
+		}
+		// cw needs to be Closed() before any Delete()
+		if cerr := cw.Close(); cerr != nil {
+			log.Println("cache close", key, "request", reqid, cerr)
+			keepcopy = false
+		}
+		if !keepcopy {
+			s.Cache.Delete(key)
+		}
+	}
+	// remove the fill only after the content is in the cache, so later
+	// requests find it in one or the other.
+	s.fillM.Lock()
+	delete(s.fills, key)
+	s.fillM.Unlock()
+	fill.finish(err)
+	log.Println("copyblob finished", key, time.Now().Sub(starttime), "request", reqid)
+}
+
+// A cacheTee passes writes on to w until w returns an error. The error is
+// remembered, and all writes appear to succeed so a copy being made alongside
+// is not interrupted. A nil w discards everything.
+type cacheTee struct {
+	w   io.Writer
+	err error
+}
+
+func (t *cacheTee) Write(p []byte) (int, error) {
+	if t.w != nil && t.err == nil {
+		_, t.err = t.w.Write(p)
 	}
-	keepcopy = true
+	return len(p), nil
 }
 
 // NewReadCloser converts a ReadAtCloser into a ReadCloser.
@@ -410,14 +525,63 @@ func (s *RESTServer) ItemHandler(w http.ResponseWriter, r *http.Request, ps http
 		fmt.Fprintln(w, err.Error())
 		return
 	}
+	// the representation returned depends on the Accept-Encoding header
+	w.Header().Set("Vary", "Accept-Encoding")
+	w.Header().Set("Cache-Control", cacheRevalidate)
 	// sometimes when there are storage errors no Version list gets saved to tape.
 	if len(item.Versions) > 0 {
-		vid := item.Versions[len(item.Versions)-1].ID
-		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, vid))
+		v := item.Versions[len(item.Versions)-1]
+		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, v.ID))
+		if !v.SaveDate.IsZero() {
+			w.Header().Set("Last-Modified", v.SaveDate.UTC().Format(http.TimeFormat))
+		}
+		if checkNotModified(w, r, v.SaveDate) {
+			return
+		}
 	}
 	writeHTMLorJSON(w, r, itemTemplate, item)
 }
 
+// BlobChecksumHandler handles requests to GET /blob/sha256/:hex
+// It returns every (item, blob) pair in the blob index having the given
+// SHA-256 checksum. Only items in the scope of the token are included.
+func (s *RESTServer) BlobChecksumHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	sum, err := hex.DecodeString(ps.ByName("hex"))
+	if err != nil || len(sum) != 32 {
+		w.WriteHeader(400)
+		fmt.Fprintln(w, "Bad SHA-256 checksum")
+		return
+	}
+	if s.BlobDatabase == nil {
+		w.WriteHeader(503)
+		fmt.Fprintln(w, "No blob index is available")
+		return
+	}
+	result, err := s.BlobDatabase.FindBlobsBySHA256(sum)
+	if err != nil {
+		log.Println("GET /blob/sha256:", err)
+		raven.CaptureError(err, nil)
+		w.WriteHeader(500)
+		fmt.Fprintln(w, err)
+		return
+	}
+	if scope := requestScope(r); scope != nil {
+		var allowed []BlobRef
+		for _, ref := range result {
+			if scope.Allows(ref.Item) {
+				allowed = append(allowed, ref)
+			}
+		}
+		result = allowed
+	}
+	if len(result) == 0 {
+		w.WriteHeader(404)
+		fmt.Fprintln(w, "No blobs have that checksum")
+		return
+	}
+	writeHTMLorJSON(w, r, blobChecksumTemplate, result)
+}
+
 func minus1(a interface{}) int {
 	// the template calls this with something having type BlobID, so we make a
 	// have type interface{}, and type switch to get the right value
@@ -435,6 +599,31 @@ var (
 		"minus1": minus1,
 	}
 
+	blobChecksumTemplate = template.Must(template.New("blobchecksum").Parse(`
+<html><head><style>
+tbody tr:nth-child(even) { background-color: #eeeeee; }
+</style></head><body>
+<h1>Blobs having SHA-256 {{ (index . 0).Blob.SHA256 | printf "%x" }}</h1>
+<table>
+	<thead><tr>
+		<th>Item</th>
+		<th>Blob</th>
+		<th>Size</th>
+		<th>Date</th>
+		<th>Deleted</th>
+	</tr></thead><tbody>
+{{ range . }}
+	<tr>
+		<td><a href="/item/{{ .Item }}">{{ .Item }}</a></td>
+		<td><a href="/item/{{ .Item }}/@blob/{{ .Blob.ID }}">{{ .Blob.ID }}</a></td>
+		<td>{{ .Blob.Size }}</td>
+		<td>{{ .Blob.SaveDate }}</td>
+		<td>{{ if not .Blob.DeleteDate.IsZero }}{{ .Blob.DeleteDate }}{{ end }}</td>
+	</tr>
+{{ end }}
+</tbody></table>
+</body></html>`))
+
 	itemTemplate = template.Must(template.New("items").Funcs(itemfns).Parse(`
 <html><head><style>
 tbody tr:nth-child(even) { background-color: #eeeeee; }
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"github.com/ndlib/bendo/items"
+)
+
+// runBlobChecksumSequence checks looking up blobs by their checksum.
+func runBlobChecksumSequence(t *testing.T, db BlobDB) {
+	same := sha256.Sum256([]byte("same"))
+	other := sha256.Sum256([]byte("other"))
+	for _, id := range []string{"sum2", "sum1"} {
+		err := db.IndexItem(id, &items.Item{
+			ID:        id,
+			MaxBundle: 1,
+			Blobs: []*items.Blob{
+				{ID: 1, Size: 4, Bundle: 1, SHA256: same[:]},
+				{ID: 2, Size: 5, Bundle: 1, SHA256: other[:]},
+				{ID: 3, Size: 4, Bundle: 1, SHA256: same[:]},
+			},
+			Versions: []*items.Version{{ID: 1, Slots: map[string]items.BlobID{"a": 1}}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var table = []struct {
+		sum      []byte
+		expected []BlobRef
+	}{
+		{same[:], []BlobRef{{Item: "sum1"}, {Item: "sum1"}, {Item: "sum2"}, {Item: "sum2"}}},
+		{other[:], []BlobRef{{Item: "sum1"}, {Item: "sum2"}}},
+		{[]byte("nothing"), nil},
+	}
+	for _, tab := range table {
+		refs, err := db.FindBlobsBySHA256(tab.sum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(refs) != len(tab.expected) {
+			t.Errorf("Received %d blobs, expected %d", len(refs), len(tab.expected))
+			continue
+		}
+		for i, ref := range refs {
+			if ref.Item != tab.expected[i].Item || string(ref.Blob.SHA256) != string(tab.sum) {
+				t.Errorf("Received %s blob %d, expected item %s", ref.Item, ref.Blob.ID, tab.expected[i].Item)
+			}
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	raven "github.com/getsentry/raven-go"
+	"github.com/julienschmidt/httprouter"
+)
+
+// An ItemSummary is the information about an item returned by an item listing.
+type ItemSummary struct {
+	ID       string
+	Created  time.Time // when the first version was saved
+	Modified time.Time // when the most recent version was saved
+	Size     int64     // total size of all the blobs, in bytes
+}
+
+// An ItemQuery selects which items to return in an item listing. Items are
+// listed in order of their identifiers. Use the zero value for a field to
+// not filter on it.
+type ItemQuery struct {
+	Prefix         string    // only items whose id begins with this
+	After          string    // only items whose id sorts after this
+	Limit          int       // the maximum number of items to return
+	ModifiedAfter  time.Time // only items modified at or after this time
+	ModifiedBefore time.Time // only items modified at or before this time
+	Creator        string    // only items having a version saved by this user
+	MinSize        int64     // only items having at least this many bytes
+	MaxSize        int64     // only items having at most this many bytes
+}
+
+const (
+	// the number of items returned by a listing if no limit is given
+	defaultItemLimit = 100
+	// the largest number of items that will be returned by a listing
+	maxItemLimit = 1000
+)
+
+// An ItemList is the response to GET /item. Next is the value to pass as the
+// "after" parameter to get the next page of results. It is empty if there
+// are no more results.
+type ItemList struct {
+	Items []ItemSummary
+	Next  string `json:",omitempty"`
+}
+
+// ItemListHandler handles requests to GET /item
+//
+// It takes the optional query parameters prefix, after, limit,
+// modified_after, modified_before, creator, min_size, and max_size. Only
+// items in the scope of the token are listed, so a page may have fewer
+// items than the limit even when there are more pages.
+func (s *RESTServer) ItemListHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	q, err := parseItemQuery(r)
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintln(w, err)
+		return
+	}
+	if s.BlobDatabase == nil {
+		w.WriteHeader(503)
+		fmt.Fprintln(w, "No item index is available")
+		return
+	}
+	result, err := s.BlobDatabase.ListItems(q)
+	if err != nil {
+		log.Println("GET /item:", err)
+		raven.CaptureError(err, nil)
+		w.WriteHeader(500)
+		fmt.Fprintln(w, err)
+		return
+	}
+	list := ItemList{Items: result}
+	if len(result) == q.Limit {
+		list.Next = result[len(result)-1].ID
+	}
+	if scope := requestScope(r); scope != nil {
+		list.Items = nil
+		for _, item := range result {
+			if scope.Allows(item.ID) {
+				list.Items = append(list.Items, item)
+			}
+		}
+	}
+	if list.Items == nil {
+		list.Items = []ItemSummary{}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(list)
+}
+
+// parseItemQuery builds an ItemQuery from the query parameters of the request.
+func parseItemQuery(r *http.Request) (ItemQuery, error) {
+	q := ItemQuery{
+		Prefix:  r.FormValue("prefix"),
+		After:   r.FormValue("after"),
+		Creator: r.FormValue("creator"),
+		Limit:   defaultItemLimit,
+	}
+	var err error
+	if v := r.FormValue("limit"); v != "" {
+		q.Limit, err = strconv.Atoi(v)
+		if err != nil || q.Limit <= 0 || q.Limit > maxItemLimit {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxItemLimit)
+		}
+	}
+	q.ModifiedAfter, err = timeValidate(r.FormValue("modified_after"), time.Time{})
+	if err != nil {
+		return q, err
+	}
+	q.ModifiedBefore, err = timeValidate(r.FormValue("modified_before"), time.Time{})
+	if err != nil {
+		return q, err
+	}
+	q.MinSize, err = sizeValidate(r.FormValue("min_size"))
+	if err != nil {
+		return q, err
+	}
+	q.MaxSize, err = sizeValidate(r.FormValue("max_size"))
+	return q, err
+}
+
+func sizeValidate(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid size %q", s)
+	}
+	return n, nil
+}
@@ -0,0 +1,291 @@
+package server
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+)
+
+// A JWTValidator is a TokenValidator for JSON Web Tokens signed using either
+// HS256 or RS256. Tokens must have an expiration time ("exp") and must not
+// be used before any not-before time ("nbf"). The user name and the role are
+// taken from claims in the token. The role claim should have one of the
+// values accepted by AtoRole. A token may be limited to some items by a scope
+// claim, which is either a list of patterns or a string as accepted by
+// ParseScope.
+type JWTValidator struct {
+	// Keys are the keys tokens may be signed with, by key id. They are
+	// either []byte for HS256 or *rsa.PublicKey for RS256. Keys without an
+	// id are under "", and are used for tokens not giving a key id.
+	Keys map[string]interface{}
+
+	// If Audience is not empty, the "aud" claim of tokens must include it.
+	Audience string
+
+	// The claims to use for the user name, the role, and the scope. If
+	// empty, they default to "sub", "role", and "items".
+	UserClaim  string
+	RoleClaim  string
+	ScopeClaim string
+
+	// Leeway is the allowance for clock skew when checking times.
+	Leeway time.Duration
+}
+
+// NewJWTValidatorFile returns a JWTValidator using the keys in the given
+// file, which should be a JSON Web Key Set. See ReadKeySet.
+func NewJWTValidatorFile(fname string) (*JWTValidator, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	keys, err := ReadKeySet(f)
+	if err != nil {
+		return nil, err
+	}
+	return &JWTValidator{Keys: keys}, nil
+}
+
+// ReadKeySet decodes a JSON Web Key Set from r. Only symmetric keys
+// ("kty" of "oct") and RSA public keys are used; others are ignored. The
+// result maps each key id to either a []byte or an *rsa.PublicKey.
+func ReadKeySet(r io.Reader) (map[string]interface{}, error) {
+	var set struct {
+		Keys []struct {
+			Kty string
+			Kid string
+			Alg string
+			K   string // for oct keys
+			N   string // for RSA keys
+			E   string
+		}
+	}
+	err := json.NewDecoder(r).Decode(&set)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]interface{})
+	for _, key := range set.Keys {
+		switch key.Kty {
+		case "oct":
+			if key.Alg != "" && key.Alg != "HS256" {
+				continue
+			}
+			k, err := base64.RawURLEncoding.DecodeString(key.K)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: %s", key.Kid, err)
+			}
+			result[key.Kid] = k
+		case "RSA":
+			if key.Alg != "" && key.Alg != "RS256" {
+				continue
+			}
+			n, err1 := base64.RawURLEncoding.DecodeString(key.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(key.E)
+			if err1 != nil || err2 != nil || len(e) == 0 || len(e) > 4 {
+				return nil, fmt.Errorf("key %q: bad RSA key", key.Kid)
+			}
+			result[key.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		}
+	}
+	return result, nil
+}
+
+var (
+	errJWTFormat    = errors.New("malformed token")
+	errJWTSignature = errors.New("bad signature")
+	errJWTExpired   = errors.New("token expired or not yet valid")
+	errJWTAudience  = errors.New("wrong audience")
+)
+
+// TokenValid returns the user and role given by the claims in token, if it
+// is a valid JWT. Invalid tokens return the user "" with RoleUnknown.
+func (v *JWTValidator) TokenValid(token string) (string, Role, error) {
+	user, role, _, err := v.TokenScope(token)
+	return user, role, err
+}
+
+// TokenScope returns the user, role, and scope given by the claims in token,
+// if it is a valid JWT.
+func (v *JWTValidator) TokenScope(token string) (string, Role, Scope, error) {
+	claims, err := v.verify(token, time.Now())
+	if err != nil {
+		return "", RoleUnknown, nil, nil
+	}
+	userClaim := v.UserClaim
+	if userClaim == "" {
+		userClaim = "sub"
+	}
+	roleClaim := v.RoleClaim
+	if roleClaim == "" {
+		roleClaim = "role"
+	}
+	scopeClaim := v.ScopeClaim
+	if scopeClaim == "" {
+		scopeClaim = "items"
+	}
+	user, _ := claims[userClaim].(string)
+	role, _ := claims[roleClaim].(string)
+	if user == "" {
+		return "", RoleUnknown, nil, nil
+	}
+	var scope Scope
+	switch c := claims[scopeClaim].(type) {
+	case nil:
+	case string:
+		scope = ParseScope(c)
+	case []interface{}:
+		for _, pattern := range c {
+			if p, ok := pattern.(string); ok {
+				scope = append(scope, p)
+			}
+		}
+	}
+	if scope == nil && claims[scopeClaim] != nil {
+		// the claim is present, so the token must not allow every item
+		scope = Scope{}
+	}
+	return user, AtoRole(role), scope, nil
+}
+
+// verify checks the signature and the times and audience of the token, and
+// returns its claims.
+func (v *JWTValidator) verify(token string, now time.Time) (map[string]interface{}, error) {
+	pieces := strings.Split(token, ".")
+	if len(pieces) != 3 {
+		return nil, errJWTFormat
+	}
+	var header struct {
+		Alg string
+		Kid string
+	}
+	err := decodeJWTPart(pieces[0], &header)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(pieces[2])
+	if err != nil {
+		return nil, errJWTFormat
+	}
+	signed := pieces[0] + "." + pieces[1]
+	// the type of the key must match the algorithm, otherwise an RSA
+	// public key could be used as an HMAC secret.
+	switch key := v.Keys[header.Kid].(type) {
+	case []byte:
+		if header.Alg != "HS256" {
+			return nil, errJWTSignature
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return nil, errJWTSignature
+		}
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" {
+			return nil, errJWTSignature
+		}
+		digest := sha256.Sum256([]byte(signed))
+		err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature)
+		if err != nil {
+			return nil, errJWTSignature
+		}
+	default:
+		return nil, errJWTSignature
+	}
+
+	var claims map[string]interface{}
+	err = decodeJWTPart(pieces[1], &claims)
+	if err != nil {
+		return nil, err
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.Add(-v.Leeway).Unix() >= int64(exp) {
+		return nil, errJWTExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(v.Leeway).Unix() < int64(nbf) {
+		return nil, errJWTExpired
+	}
+	if v.Audience != "" && !hasAudience(claims["aud"], v.Audience) {
+		return nil, errJWTAudience
+	}
+	return claims, nil
+}
+
+// decodeJWTPart decodes one of the base64 encoded JSON parts of a JWT into v.
+func decodeJWTPart(s string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return errJWTFormat
+	}
+	if json.Unmarshal(b, v) != nil {
+		return errJWTFormat
+	}
+	return nil
+}
+
+// hasAudience returns whether the "aud" claim aud, which may be either a
+// string or a list of strings, includes audience.
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// A MultiValidator tries each of its validators in turn, and returns the
+// result from the first one recognizing the token. This allows, for example,
+// both a token file and JWTs to be used.
+type MultiValidator []TokenValidator
+
+// TokenValid returns the user and role from the first validator recognizing
+// the token.
+func (mv MultiValidator) TokenValid(token string) (string, Role, error) {
+	user, role, _, err := mv.TokenScope(token)
+	return user, role, err
+}
+
+// TokenScope returns the user, role, and scope from the first validator
+// recognizing the token.
+func (mv MultiValidator) TokenScope(token string) (string, Role, Scope, error) {
+	for _, v := range mv {
+		user, role, scope, err := tokenScope(v, token)
+		if err != nil || role != RoleUnknown {
+			return user, role, scope, err
+		}
+	}
+	return "", RoleUnknown, nil, nil
+}
+
+// TokenLimit returns the limit for the token from the first validator having
+// one.
+func (mv MultiValidator) TokenLimit(token string) (Limit, bool) {
+	for _, v := range mv {
+		if tl, ok := v.(TokenLimiter); ok {
+			if limit, ok := tl.TokenLimit(token); ok {
+				return limit, true
+			}
+		}
+	}
+	return Limit{}, false
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJWTValidator(t *testing.T) {
+	rsakey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("0123456789abcdef")
+	keyset := fmt.Sprintf(`{"keys": [
+		{"kty": "oct", "kid": "h1", "k": %q},
+		{"kty": "RSA", "kid": "r1", "alg": "RS256", "n": %q, "e": %q},
+		{"kty": "EC", "kid": "e1"}
+	]}`,
+		base64.RawURLEncoding.EncodeToString(secret),
+		base64.RawURLEncoding.EncodeToString(rsakey.N.Bytes()),
+		base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsakey.E)).Bytes()))
+	keys, err := ReadKeySet(strings.NewReader(keyset))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("Read %d keys, expected 2", len(keys))
+	}
+	v := &JWTValidator{Keys: keys, Audience: "bendo"}
+
+	now := time.Now().Unix()
+	var table = []struct {
+		alg    string
+		kid    string
+		claims string
+		user   string
+		role   Role
+	}{
+		{"HS256", "h1", fmt.Sprintf(`{"sub":"a","role":"write","aud":"bendo","exp":%d}`, now+60), "a", RoleWrite},
+		{"RS256", "r1", fmt.Sprintf(`{"sub":"b","role":"read","aud":["x","bendo"],"exp":%d}`, now+60), "b", RoleRead},
+		// expired
+		{"HS256", "h1", fmt.Sprintf(`{"sub":"a","role":"write","aud":"bendo","exp":%d}`, now-60), "", RoleUnknown},
+		// no expiry
+		{"HS256", "h1", `{"sub":"a","role":"write","aud":"bendo"}`, "", RoleUnknown},
+		// not yet valid
+		{"HS256", "h1", fmt.Sprintf(`{"sub":"a","role":"write","aud":"bendo","exp":%d,"nbf":%d}`, now+60, now+30), "", RoleUnknown},
+		// wrong audience
+		{"RS256", "r1", fmt.Sprintf(`{"sub":"b","role":"read","aud":"other","exp":%d}`, now+60), "", RoleUnknown},
+		// unknown key
+		{"HS256", "h2", fmt.Sprintf(`{"sub":"a","role":"write","aud":"bendo","exp":%d}`, now+60), "", RoleUnknown},
+		// algorithm does not match the key
+		{"HS256", "r1", fmt.Sprintf(`{"sub":"a","role":"write","aud":"bendo","exp":%d}`, now+60), "", RoleUnknown},
+	}
+	for i, tab := range table {
+		var token string
+		if tab.alg == "HS256" && tab.kid == "r1" {
+			// try to use the RSA public key as an HMAC secret
+			token = makeJWT(t, tab.alg, tab.kid, tab.claims, keys["r1"])
+		} else if tab.alg == "HS256" {
+			token = makeJWT(t, tab.alg, tab.kid, tab.claims, secret)
+		} else {
+			token = makeJWT(t, tab.alg, tab.kid, tab.claims, rsakey)
+		}
+		user, role, err := v.TokenValid(token)
+		if err != nil {
+			t.Errorf("%d: received error %s", i, err)
+		}
+		if user != tab.user || role != tab.role {
+			t.Errorf("%d: received %q, %v, expected %q, %v", i, user, role, tab.user, tab.role)
+		}
+	}
+
+	// a tampered token
+	token := makeJWT(t, "HS256", "h1", fmt.Sprintf(`{"sub":"a","role":"read","aud":"bendo","exp":%d}`, now+60), secret)
+	pieces := strings.Split(token, ".")
+	pieces[1] = base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"sub":"a","role":"admin","aud":"bendo","exp":%d}`, now+60)))
+	if _, role, _ := v.TokenValid(strings.Join(pieces, ".")); role != RoleUnknown {
+		t.Errorf("Tampered token received role %v", role)
+	}
+
+	// a token limited to some items
+	token = makeJWT(t, "HS256", "h1", fmt.Sprintf(`{"sub":"a","role":"write","aud":"bendo","exp":%d,"items":["und:etd*"]}`, now+60), secret)
+	if _, _, scope, _ := v.TokenScope(token); !scope.Allows("und:etd1") || scope.Allows("und:abc") {
+		t.Errorf("Received scope %v", scope)
+	}
+	token = makeJWT(t, "HS256", "h1", fmt.Sprintf(`{"sub":"a","role":"read","aud":"bendo","exp":%d}`, now+60), secret)
+
+	// a MultiValidator falls through to the JWT validator
+	list, _ := NewListValidatorString("c admin 1234 concurrent=1")
+	mv := MultiValidator{list, v}
+	if user, role, _ := mv.TokenValid("1234"); user != "c" || role != RoleAdmin {
+		t.Errorf("Received %q, %v from token list", user, role)
+	}
+	if user, role, _ := mv.TokenValid(token); user != "a" || role != RoleRead {
+		t.Errorf("Received %q, %v from JWT", user, role)
+	}
+	if limit, ok := mv.TokenLimit("1234"); !ok || limit.Concurrent != 1 {
+		t.Errorf("Received limit %v, %v", limit, ok)
+	}
+}
+
+// makeJWT returns a token with the given claims, signed using key.
+func makeJWT(t *testing.T, alg, kid, claims string, key interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(claims))
+	var signature []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PublicKey:
+		// the HMAC secret is the encoded public key
+		mac := hmac.New(sha256.New, key.N.Bytes())
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
@@ -0,0 +1,371 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// A Limit bounds the requests a single client may make. A zero in any field
+// means there is no bound on that resource.
+type Limit struct {
+	Concurrent int     // number of requests in progress at once
+	Rate       float64 // sustained requests per second
+	Burst      int     // requests allowed at once above Rate. Defaults to Rate, but at least 1
+	TapeReads  int     // number of requests for uncached content in progress at once
+}
+
+// A TokenLimiter is a TokenValidator which also knows the limits for some of
+// its tokens. For example, the token file may give limits for each token.
+type TokenLimiter interface {
+	// TokenLimit returns the limit for the given token, and whether the
+	// token has one.
+	TokenLimit(token string) (Limit, bool)
+}
+
+// A Limiter tracks the number of requests each client has in progress and
+// decides whether a new request is allowed. Every token of every user is
+// counted separately, so a role limit applies to each token having that role,
+// and requests without a user are counted by their remote address. A limit for
+// a specific token takes precedence over the limit for its user, which takes
+// precedence over the limit for its role.
+//
+// A nil Limiter permits everything. Use SetLimits to change the limits once
+// the Limiter is in use.
+type Limiter struct {
+	Roles map[Role]Limit
+	Users map[string]Limit
+
+	m         sync.Mutex        // protects everything
+	usage     map[client]*usage // by client
+	lastSweep time.Time
+}
+
+// A client is what the requests are counted against: a user and the token
+// they used, or for requests without a user, the remote address.
+type client struct {
+	user   string
+	source string // an id for the token, or the remote address
+}
+
+// requestClient returns the client making request r. Only the user and token
+// of a valid token are used, since otherwise a client could make up a new
+// token for each request.
+func requestClient(r *http.Request) client {
+	info := getRequestInfo(r)
+	if info == nil || info.User == "" {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		return client{source: host}
+	}
+	c := client{user: info.User}
+	if info.Token != "" {
+		// do not keep the token itself, since the usage is shown to admins
+		sum := sha256.Sum256([]byte(info.Token))
+		c.source = hex.EncodeToString(sum[:4])
+	}
+	return c
+}
+
+// usage is the resources a client is currently using.
+type usage struct {
+	role     Role
+	limit    Limit
+	active   int       // requests in progress
+	tape     int       // tape reads in progress
+	tokens   float64   // the token bucket for Rate
+	last     time.Time // time tokens was last updated
+	rejected int64     // number of requests rejected for being over a limit
+}
+
+// SetLimits replaces the role and user limits. Requests in progress are
+// still counted.
+func (l *Limiter) SetLimits(roles map[Role]Limit, users map[string]Limit) {
+	l.m.Lock()
+	l.Roles = roles
+	l.Users = users
+	l.m.Unlock()
+}
+
+// limitFor returns the limit for the request r. The validator v is consulted
+// first for the limit of the token used, if it is a TokenLimiter.
+func (l *Limiter) limitFor(r *http.Request, v TokenValidator) (Role, Limit) {
+	var user, token string
+	var role Role
+	if info := getRequestInfo(r); info != nil {
+		user, token, role = info.User, info.Token, info.Role
+	}
+	if tl, ok := v.(TokenLimiter); ok && user != "" && token != "" {
+		if limit, ok := tl.TokenLimit(token); ok {
+			return role, limit
+		}
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	if limit, ok := l.Users[user]; ok && user != "" {
+		return role, limit
+	}
+	return role, l.Roles[role]
+}
+
+// get returns the usage for c, creating it if needed. The lock must be
+// held.
+func (l *Limiter) get(c client, role Role, limit Limit, now time.Time) *usage {
+	if l.usage == nil {
+		l.usage = make(map[client]*usage)
+	}
+	u := l.usage[c]
+	if u == nil {
+		u = &usage{tokens: float64(limit.burst()), last: now}
+		l.usage[c] = u
+	}
+	u.role = role
+	u.limit = limit
+	return u
+}
+
+func (limit Limit) burst() int {
+	if limit.Burst > 0 {
+		return limit.Burst
+	}
+	if limit.Rate > 1 {
+		return int(math.Ceil(limit.Rate))
+	}
+	return 1
+}
+
+// start records the beginning of a request by the given client. If the request
+// is over a limit it returns false and a suggested time to wait before
+// trying again. Otherwise it returns true and the request must be ended with
+// a call to finish.
+func (l *Limiter) start(c client, role Role, limit Limit) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	now := time.Now()
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.sweep(now)
+	u := l.get(c, role, limit, now)
+	if limit.Concurrent > 0 && u.active >= limit.Concurrent {
+		u.rejected++
+		return false, time.Second
+	}
+	if limit.Rate > 0 {
+		u.refill(now)
+		if u.tokens < 1 {
+			u.rejected++
+			wait := time.Duration((1 - u.tokens) / limit.Rate * float64(time.Second))
+			return false, wait
+		}
+		u.tokens--
+	}
+	u.active++
+	return true, 0
+}
+
+// finish records the end of a request started with start.
+func (l *Limiter) finish(c client) {
+	if l == nil {
+		return
+	}
+	l.m.Lock()
+	if u := l.usage[c]; u != nil {
+		u.active--
+	}
+	l.m.Unlock()
+}
+
+// startTape records the beginning of a read of uncached content by the given
+// client. It returns false if the client is reading too much already. Otherwise
+// it returns true and the read must be ended with a call to finishTape.
+func (l *Limiter) startTape(c client, role Role, limit Limit) bool {
+	if l == nil {
+		return true
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	u := l.get(c, role, limit, time.Now())
+	if limit.TapeReads > 0 && u.tape >= limit.TapeReads {
+		u.rejected++
+		return false
+	}
+	u.tape++
+	return true
+}
+
+// finishTape records the end of a read started with startTape.
+func (l *Limiter) finishTape(c client) {
+	if l == nil {
+		return
+	}
+	l.m.Lock()
+	if u := l.usage[c]; u != nil {
+		u.tape--
+	}
+	l.m.Unlock()
+}
+
+// refill adds the tokens accumulated since the last refill.
+func (u *usage) refill(now time.Time) {
+	u.tokens += now.Sub(u.last).Seconds() * u.limit.Rate
+	if max := float64(u.limit.burst()); u.tokens > max {
+		u.tokens = max
+	}
+	u.last = now
+}
+
+// sweep removes idle clients whose token buckets are full, since they are the
+// same as clients we have never seen. It only does this once a minute. The lock
+// must be held.
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for c, u := range l.usage {
+		if u.active > 0 || u.tape > 0 {
+			continue
+		}
+		u.refill(now)
+		if u.limit.Rate == 0 || u.tokens >= float64(u.limit.burst()) {
+			delete(l.usage, c)
+		}
+	}
+}
+
+// A UserUsage describes the current resources used by a client, and their
+// limits. Client is an id for the token used, or for requests without a user,
+// the remote address.
+type UserUsage struct {
+	User      string
+	Client    string
+	Role      string
+	Limit     Limit
+	Active    int // requests in progress
+	TapeReads int // uncached reads in progress
+	Rejected  int64
+}
+
+// Usage returns the current usage of every client having requests in
+// progress or having made a request recently, sorted by user name.
+func (l *Limiter) Usage() []UserUsage {
+	if l == nil {
+		return nil
+	}
+	var result []UserUsage
+	l.m.Lock()
+	for c, u := range l.usage {
+		result = append(result, UserUsage{
+			User:      c.user,
+			Client:    c.source,
+			Role:      u.role.String(),
+			Limit:     u.limit,
+			Active:    u.active,
+			TapeReads: u.tape,
+			Rejected:  u.rejected,
+		})
+	}
+	l.m.Unlock()
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].User != result[j].User {
+			return result[i].User < result[j].User
+		}
+		return result[i].Client < result[j].Client
+	})
+	return result
+}
+
+// limitWrapper returns a handler which first makes sure the client making the
+// request is within their limits. If not, a 429 error is returned. It needs
+// to be inside the authzWrapper so the user and token are known.
+func (s *RESTServer) limitWrapper(handler httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if s.Limits == nil {
+			handler(w, r, ps)
+			return
+		}
+		c := requestClient(r)
+		role, limit := s.Limits.limitFor(r, s.validator())
+		ok, wait := s.Limits.start(c, role, limit)
+		if !ok {
+			writeTooMany(w, wait)
+			return
+		}
+		defer s.Limits.finish(c)
+		handler(w, r, ps)
+	}
+}
+
+// startTapeRead checks that the client making request r may start a read of
+// uncached content. If so, it returns a function to call when the read is
+// done. Otherwise it writes a 429 error and returns nil.
+func (s *RESTServer) startTapeRead(w http.ResponseWriter, r *http.Request) func() {
+	if s.Limits == nil {
+		return func() {}
+	}
+	c := requestClient(r)
+	role, limit := s.Limits.limitFor(r, s.validator())
+	if !s.Limits.startTape(c, role, limit) {
+		writeTooMany(w, time.Second)
+		return nil
+	}
+	return func() { s.Limits.finishTape(c) }
+}
+
+// writeTooMany returns a 429 error asking the client to wait for the given
+// duration, rounded up to the next second.
+func writeTooMany(w http.ResponseWriter, wait time.Duration) {
+	secs := int(math.Ceil(wait.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", secs))
+	w.WriteHeader(429)
+	fmt.Fprintln(w, "Too Many Requests")
+}
+
+// LimitsHandler handles requests to GET /admin/limits
+func (s *RESTServer) LimitsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	writeHTMLorJSON(w, r, limitsTemplate, s.Limits.Usage())
+}
+
+var (
+	limitsTemplate = template.Must(template.New("limits").Parse(`<html>
+	<h1>Current Usage</h1>
+	<table><thead><tr>
+		<th>User</th>
+		<th>Client</th>
+		<th>Role</th>
+		<th>Requests</th>
+		<th>Tape Reads</th>
+		<th>Rate</th>
+		<th>Rejected</th>
+	</tr></thead><tbody>
+	{{ range . }}
+	<tr>
+		<td>{{ .User }}</td>
+		<td>{{ .Client }}</td>
+		<td>{{ .Role }}</td>
+		<td>{{ .Active }}{{ with .Limit.Concurrent }} / {{ . }}{{ end }}</td>
+		<td>{{ .TapeReads }}{{ with .Limit.TapeReads }} / {{ . }}{{ end }}</td>
+		<td>{{ with .Limit.Rate }}{{ . }}/s{{ end }}</td>
+		<td>{{ .Rejected }}</td>
+	</tr>
+	{{ else }}
+	<tr><td colspan="7">No users</td></tr>
+	{{ end }}
+	</tbody></table>
+	</html>`))
+)
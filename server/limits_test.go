@@ -0,0 +1,165 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestLimiter(t *testing.T) {
+	l := &Limiter{}
+	limit := Limit{Concurrent: 2, TapeReads: 1}
+	a, b := client{user: "a"}, client{user: "b"}
+
+	if ok, _ := l.start(a, RoleRead, limit); !ok {
+		t.Fatal("first request rejected")
+	}
+	if ok, _ := l.start(a, RoleRead, limit); !ok {
+		t.Fatal("second request rejected")
+	}
+	if ok, wait := l.start(a, RoleRead, limit); ok || wait <= 0 {
+		t.Errorf("third request received %v, %v, expected rejection", ok, wait)
+	}
+	// other clients are counted separately
+	if ok, _ := l.start(b, RoleRead, limit); !ok {
+		t.Errorf("request by b rejected")
+	}
+	l.finish(a)
+	if ok, _ := l.start(a, RoleRead, limit); !ok {
+		t.Errorf("request after finish rejected")
+	}
+
+	if !l.startTape(a, RoleRead, limit) {
+		t.Fatal("first tape read rejected")
+	}
+	if l.startTape(a, RoleRead, limit) {
+		t.Errorf("second tape read allowed")
+	}
+	l.finishTape(a)
+	if !l.startTape(a, RoleRead, limit) {
+		t.Errorf("tape read after finish rejected")
+	}
+
+	usage := l.Usage()
+	if len(usage) != 2 || usage[0].User != "a" || usage[0].Active != 2 ||
+		usage[0].TapeReads != 1 || usage[0].Rejected != 2 {
+		t.Errorf("Received usage %+v", usage)
+	}
+}
+
+func TestLimiterRate(t *testing.T) {
+	l := &Limiter{}
+	limit := Limit{Rate: 0.5, Burst: 2}
+	a := client{user: "a"}
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.start(a, RoleRead, limit); !ok {
+			t.Fatalf("request %d rejected", i)
+		}
+		l.finish(a)
+	}
+	ok, wait := l.start(a, RoleRead, limit)
+	if ok {
+		t.Fatal("request over burst allowed")
+	}
+	// tokens come back at one every two seconds
+	if wait <= 0 || wait.Seconds() > 2 {
+		t.Errorf("Received wait %v, expected between 0 and 2s", wait)
+	}
+}
+
+func TestLimitWrapper(t *testing.T) {
+	s := &RESTServer{
+		Validator: NobodyValidator{},
+		Limits: &Limiter{
+			Roles: map[Role]Limit{RoleUnknown: {Rate: 0.01}},
+		},
+	}
+	h := s.limitWrapper(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {})
+	var table = []struct {
+		status     int
+		retryAfter string
+	}{
+		{200, ""},
+		{429, "100"},
+	}
+	for _, tab := range table {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", "/", nil), nil)
+		if w.Code != tab.status {
+			t.Errorf("Received status %d, expected %d", w.Code, tab.status)
+		}
+		if v := w.Header().Get("Retry-After"); v != tab.retryAfter {
+			t.Errorf("Received Retry-After %q, expected %q", v, tab.retryAfter)
+		}
+	}
+}
+
+func TestLimitClients(t *testing.T) {
+	v, _ := NewListValidatorString(`a read 123 concurrent=1
+	a read 234 concurrent=1`)
+	s := &RESTServer{
+		Validator: v,
+		Limits: &Limiter{
+			Roles: map[Role]Limit{RoleUnknown: {Concurrent: 1}},
+		},
+	}
+	release := make(chan struct{})
+	started := make(chan struct{})
+	h := s.authzWrapper(s.limitWrapper(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		if r.Header.Get("X-Hold") != "" {
+			started <- struct{}{}
+			<-release
+		}
+	}), RoleUnknown)
+	send := func(token, remote string, hold bool) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remote
+		if token != "" {
+			r.Header.Set("X-Api-Key", token)
+		}
+		if hold {
+			r.Header.Set("X-Hold", "1")
+		}
+		h(w, r, nil)
+		return w.Code
+	}
+	// hold a request open for each of these
+	var table = []struct {
+		token string
+		host  string
+	}{
+		{"", "10.0.0.1"},
+		{"", "10.0.0.2"},
+		{"123", "10.0.0.1"},
+		{"234", "10.0.0.1"},
+	}
+	var wg sync.WaitGroup
+	for _, tab := range table {
+		wg.Add(1)
+		go func(token, remote string) {
+			defer wg.Done()
+			if status := send(token, remote, true); status != 200 {
+				t.Errorf("Token %q from %s: received status %d", token, remote, status)
+				started <- struct{}{}
+			}
+		}(tab.token, tab.host+":1000")
+		<-started
+	}
+	// now each of them is at its limit
+	for _, tab := range table {
+		if status := send(tab.token, tab.host+":2000", false); status != 429 {
+			t.Errorf("Token %q from %s: received status %d, expected 429", tab.token, tab.host, status)
+		}
+	}
+	// a made up token is counted by its remote address
+	if status := send("999", "10.0.0.1:3000", false); status != 429 {
+		t.Errorf("Invalid token: received status %d, expected 429", status)
+	}
+	close(release)
+	wg.Wait()
+}
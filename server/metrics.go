@@ -0,0 +1,367 @@
+package server
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	raven "github.com/getsentry/raven-go"
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/ndlib/bendo/blobcache"
+	"github.com/ndlib/bendo/items"
+	"github.com/ndlib/bendo/transaction"
+)
+
+// This file provides the /stats and /metrics routes. The /metrics route
+// returns everything in the Prometheus text exposition format. It is written
+// by hand so we do not need to pull in the Prometheus client library.
+
+var (
+	xTapeReadBytes    = expvar.NewInt("tape.read.bytes")
+	xCacheServedBytes = expvar.NewInt("cache.served.bytes")
+)
+
+// ServerStats is the summary of the server state returned by GET /stats.
+type ServerStats struct {
+	Items         int64 // number of items in the item index
+	ItemBytes     int64 // total size of the items in the item index
+	DeletedBlobs  int64 // number of deleted blobs in the item index
+	CacheSize     int64 // bytes used by the blob cache
+	CacheMaxSize  int64 // capacity of the blob cache, 0 means unlimited
+	CacheHits     int64
+	CacheMisses   int64
+	CacheServed   int64                // bytes returned from the blob cache
+	CacheTiers    *blobcache.TierStats `json:",omitempty"` // nil unless the cache has a memory tier
+	TapeEnabled   bool
+	TapeReadBytes int64          // bytes read from tape to return blob content
+	Transactions  map[string]int // number of transactions in each state
+	FixityBacklog int            // number of fixity checks which are past due
+	UploadFiles   int            // number of files in the upload area
+	UploadBytes   int64          // total size of the files in the upload area
+}
+
+// An IndexStats summarizes the contents of the item index.
+type IndexStats struct {
+	Items        int64
+	ItemBytes    int64
+	DeletedBlobs int64
+}
+
+// StatsHandler handles requests to GET /stats
+func (s *RESTServer) StatsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	stats := s.gatherStats()
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// gatherStats collects the current server statistics.
+func (s *RESTServer) gatherStats() ServerStats {
+	stats := ServerStats{
+		CacheHits:     nCacheHit.Value(),
+		CacheMisses:   nCacheMiss.Value(),
+		CacheServed:   xCacheServedBytes.Value(),
+		TapeEnabled:   s.useTape,
+		TapeReadBytes: xTapeReadBytes.Value(),
+		Transactions:  make(map[string]int),
+	}
+	if s.BlobDatabase != nil {
+		index, err := s.BlobDatabase.IndexStats()
+		if err != nil {
+			log.Println("stats:", err)
+			raven.CaptureError(err, nil)
+		}
+		stats.Items = index.Items
+		stats.ItemBytes = index.ItemBytes
+		stats.DeletedBlobs = index.DeletedBlobs
+	}
+	if s.Cache != nil {
+		stats.CacheSize = s.Cache.Size()
+		stats.CacheMaxSize = s.Cache.MaxSize()
+	}
+	if tc, ok := s.Cache.(*blobcache.Tiered); ok {
+		tiers := tc.Stats()
+		stats.CacheTiers = &tiers
+	}
+	if s.TxStore != nil {
+		for _, txid := range s.TxStore.List() {
+			tx := s.TxStore.Lookup(txid)
+			if tx == nil {
+				continue
+			}
+			tx.M.RLock()
+			status := tx.Status
+			tx.M.RUnlock()
+			stats.Transactions[statusName(status)]++
+		}
+	}
+	if s.FixityDatabase != nil {
+		backlog := s.FixityDatabase.SearchFixity(time.Time{}, time.Now(), "", "scheduled")
+		stats.FixityBacklog = len(backlog)
+	}
+	if s.FileStore != nil {
+		for _, fid := range s.FileStore.List() {
+			f := s.FileStore.Lookup(fid)
+			if f == nil {
+				continue
+			}
+			stats.UploadFiles++
+			stats.UploadBytes += f.Stat().Size
+		}
+	}
+	return stats
+}
+
+// statusName turns a transaction status into a label, e.g. "waiting".
+func statusName(status transaction.Status) string {
+	return strings.ToLower(strings.TrimPrefix(status.String(), "Status"))
+}
+
+// MetricsHandler handles requests to GET /metrics
+func (s *RESTServer) MetricsHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	stats := s.gatherStats()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	httpMetrics.write(w)
+
+	writeMetric(w, "bendo_cache_hits_total", "counter", "Blob requests answered from the cache.", stats.CacheHits)
+	writeMetric(w, "bendo_cache_misses_total", "counter", "Blob requests which needed to go to tape.", stats.CacheMisses)
+	writeMetric(w, "bendo_cache_served_bytes_total", "counter", "Bytes of blob content returned from the cache.", stats.CacheServed)
+	writeMetric(w, "bendo_cache_size_bytes", "gauge", "Bytes used by the blob cache.", stats.CacheSize)
+	writeMetric(w, "bendo_cache_max_bytes", "gauge", "Capacity of the blob cache. 0 means unlimited.", stats.CacheMaxSize)
+	if t := stats.CacheTiers; t != nil {
+		writeMetric(w, "bendo_cache_memory_hits_total", "counter", "Cache reads answered from memory.", t.MemoryHits)
+		writeMetric(w, "bendo_cache_memory_misses_total", "counter", "Cache reads not in memory.", t.MemoryMisses)
+		writeMetric(w, "bendo_cache_store_hits_total", "counter", "Cache reads not in memory but in the cache store.", t.StoreHits)
+		writeMetric(w, "bendo_cache_store_misses_total", "counter", "Cache reads in neither memory nor the cache store.", t.StoreMisses)
+		writeMetric(w, "bendo_cache_memory_size_bytes", "gauge", "Bytes of the blob cache kept in memory.", t.MemorySize)
+		writeMetric(w, "bendo_cache_memory_max_bytes", "gauge", "Capacity of the memory part of the blob cache.", t.MemoryMaxSize)
+	}
+
+	writeMetric(w, "bendo_cache_verified_total", "counter", "Cache entries whose checksums were rechecked.", xCacheVerified.Value())
+	writeMetric(w, "bendo_cache_verified_bytes_total", "counter", "Bytes of cache entries rechecked.", xCacheVerifiedBytes.Value())
+	writeMetric(w, "bendo_cache_mismatches_total", "counter", "Blobs not matching their checksums when read into or from the cache.", xCacheMismatch.Value())
+
+	var enabled int
+	if stats.TapeEnabled {
+		enabled = 1
+	}
+	writeMetric(w, "bendo_tape_enabled", "gauge", "Whether the tape store is being used.", enabled)
+	writeMetric(w, "bendo_tape_read_bytes_total", "counter", "Bytes of blob content read from tape.", stats.TapeReadBytes)
+
+	writeMetric(w, "bendo_transaction_queue_depth", "gauge", "Transactions waiting to be committed.",
+		stats.Transactions[statusName(transaction.StatusWaiting)])
+	writeHeader(w, "bendo_transactions", "gauge", "Transactions in each state.")
+	var names []string
+	for name := range stats.Transactions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "bendo_transactions{status=%q} %d\n", name, stats.Transactions[name])
+	}
+	writeMetric(w, "bendo_transactions_committed_total", "counter", "Transactions processed.", xTransactionCount.Value())
+	writeMetric(w, "bendo_transaction_seconds_total", "counter", "Time spent processing transactions.", xTransactionTime.Value())
+
+	writeMetric(w, "bendo_fixity_backlog", "gauge", "Fixity checks which are past due.", stats.FixityBacklog)
+	writeMetric(w, "bendo_fixity_checks_total", "counter", "Items checked for fixity.", xFixityItemsChecked.Value())
+	writeMetric(w, "bendo_fixity_checked_bytes_total", "counter", "Bytes checked for fixity.", xFixityBytesChecked.Value())
+	writeMetric(w, "bendo_fixity_seconds_total", "counter", "Time spent checking fixity.", xFixityDuration.Value())
+	writeMetric(w, "bendo_fixity_errors_total", "counter", "Fixity checks which could not be completed.", xFixityError.Value())
+	writeMetric(w, "bendo_fixity_mismatches_total", "counter", "Fixity checks which found a problem.", xFixityMismatch.Value())
+
+	writeMetric(w, "bendo_upload_files", "gauge", "Files in the upload area.", stats.UploadFiles)
+	writeMetric(w, "bendo_upload_bytes", "gauge", "Bytes used by the upload area.", stats.UploadBytes)
+
+	writeMetric(w, "bendo_items", "gauge", "Items in the item index.", stats.Items)
+	writeMetric(w, "bendo_item_bytes", "gauge", "Total size of the items in the item index.", stats.ItemBytes)
+	writeMetric(w, "bendo_deleted_blobs", "gauge", "Deleted blobs in the item index.", stats.DeletedBlobs)
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// writeMetric writes a metric having a single unlabeled value.
+func writeMetric(w io.Writer, name, kind, help string, value interface{}) {
+	writeHeader(w, name, kind, help)
+	if f, ok := value.(float64); ok {
+		value = formatFloat(f)
+	}
+	fmt.Fprintf(w, "%s %v\n", name, value)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// metricsWrapper records the duration and status code of each request made
+// to the given route.
+func metricsWrapper(route string, handler httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			httpMetrics.observe(requestLabels{
+				route:  route,
+				method: r.Method,
+				status: sw.Status(),
+			}, time.Since(start))
+		}()
+		handler(sw, r, ps)
+	}
+}
+
+// A statusWriter wraps a ResponseWriter and remembers the status code and
+// the number of bytes written.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(p)
+	sw.size += int64(n)
+	return n, err
+}
+
+// Flush passes flushes through, if the underlying writer supports them.
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Status returns the status code sent, which is 200 if nothing has been
+// written.
+func (sw *statusWriter) Status() int {
+	if sw.status == 0 {
+		return http.StatusOK
+	}
+	return sw.status
+}
+
+// the upper bounds of the request latency histogram buckets, in seconds.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+type requestLabels struct {
+	route  string
+	method string
+	status int
+}
+
+type histogram struct {
+	counts []int64 // counts[i] is the number of observations <= latencyBuckets[i]
+	count  int64
+	sum    float64
+}
+
+// requestMetrics tracks a latency histogram for each combination of labels.
+type requestMetrics struct {
+	m sync.Mutex
+	h map[requestLabels]*histogram
+}
+
+var httpMetrics = &requestMetrics{h: make(map[requestLabels]*histogram)}
+
+func (rm *requestMetrics) observe(labels requestLabels, d time.Duration) {
+	seconds := d.Seconds()
+	rm.m.Lock()
+	defer rm.m.Unlock()
+	h := rm.h[labels]
+	if h == nil {
+		h = &histogram{counts: make([]int64, len(latencyBuckets))}
+		rm.h[labels] = h
+	}
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+func (rm *requestMetrics) write(w io.Writer) {
+	const name = "bendo_http_request_duration_seconds"
+	writeHeader(w, name, "histogram", "Time taken to answer HTTP requests.")
+	rm.m.Lock()
+	defer rm.m.Unlock()
+	var labels []requestLabels
+	for l := range rm.h {
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		a, b := labels[i], labels[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.status < b.status
+	})
+	for _, l := range labels {
+		h := rm.h[l]
+		ls := fmt.Sprintf("route=%q,method=%q,status=\"%d\"", l.route, l.method, l.status)
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, ls, formatFloat(bound), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, ls, h.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", name, ls, formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, ls, h.count)
+	}
+}
+
+// openBlob returns the content of the given blob from the item store. The
+// bytes read are counted in the tape metrics.
+func (s *RESTServer) openBlob(id string, bid items.BlobID) (io.ReadCloser, int64, error) {
+	rc, size, err := s.Items.Blob(id, bid)
+	if err != nil {
+		return nil, size, err
+	}
+	return &countReadCloser{ReadCloser: rc, count: xTapeReadBytes}, size, nil
+}
+
+// countReadCloser adds the number of bytes read to an expvar counter.
+type countReadCloser struct {
+	io.ReadCloser
+	count *expvar.Int
+}
+
+func (c *countReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.count.Add(int64(n))
+	return n, err
+}
+
+// countReadSeekCloser adds the number of bytes read to an expvar counter.
+type countReadSeekCloser struct {
+	ReadSeekCloser
+	count *expvar.Int
+}
+
+func (c *countReadSeekCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadSeekCloser.Read(p)
+	c.count.Add(int64(n))
+	return n, err
+}
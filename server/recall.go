@@ -0,0 +1,446 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	raven "github.com/getsentry/raven-go"
+	"github.com/julienschmidt/httprouter"
+
+	"github.com/ndlib/bendo/items"
+)
+
+// A RecallJob copies a group of blobs from an item into the blob cache in the
+// background, so they can be served quickly later. Jobs are only kept in
+// memory, and are forgotten a while after they finish.
+type RecallJob struct {
+	M        sync.RWMutex `json:"-"`
+	ID       string
+	Item     string
+	Creator  string
+	Started  time.Time
+	Finished time.Time // zero while the job is running
+	Blobs    []*RecallBlob
+}
+
+// A RecallBlob is the status of a single blob in a recall job.
+type RecallBlob struct {
+	ID     items.BlobID
+	Slot   string // the first slot asked for having this blob
+	Bundle int
+	Size   int64
+	Status RecallStatus
+	Err    string `json:",omitempty"`
+}
+
+// RecallStatus is the state of a blob in a recall job.
+type RecallStatus string
+
+const (
+	RecallWaiting  RecallStatus = "waiting"   // not yet copied
+	RecallCopying  RecallStatus = "copying"   // being copied into the cache
+	RecallCached   RecallStatus = "cached"    // in the cache
+	RecallTooLarge RecallStatus = "too large" // too large to be cached, even in chunks
+	RecallDeleted  RecallStatus = "deleted"   // the blob has been deleted
+	RecallError    RecallStatus = "error"     // there was an error copying it
+)
+
+// how long a recall job is kept after it finishes
+var recallKeep = 24 * time.Hour
+
+// the most recall jobs kept at once. Once there are this many, the oldest
+// finished job is forgotten to make room for a new one, and new jobs are
+// refused if none of them has finished.
+var recallMaxJobs = 1000
+
+// recallList holds the recall jobs. The zero value is ready to use.
+type recallList struct {
+	m    sync.Mutex
+	jobs map[string]*RecallJob
+}
+
+// add saves the job and assigns it an id. Jobs which finished long ago are
+// removed. It returns false, without saving the job, if there are already
+// recallMaxJobs jobs running.
+func (rl *recallList) add(job *RecallJob) bool {
+	rl.m.Lock()
+	defer rl.m.Unlock()
+	if rl.jobs == nil {
+		rl.jobs = make(map[string]*RecallJob)
+	}
+	cutoff := time.Now().Add(-recallKeep)
+	var oldest string // the job which finished first
+	var oldestTime time.Time
+	for id, j := range rl.jobs {
+		j.M.RLock()
+		finished := j.Finished
+		j.M.RUnlock()
+		if finished.IsZero() {
+			continue
+		}
+		if finished.Before(cutoff) {
+			delete(rl.jobs, id)
+			continue
+		}
+		if oldest == "" || finished.Before(oldestTime) {
+			oldest, oldestTime = id, finished
+		}
+	}
+	if len(rl.jobs) >= recallMaxJobs {
+		if oldest == "" {
+			return false
+		}
+		delete(rl.jobs, oldest)
+	}
+	for {
+		var b [8]byte
+		rand.Read(b[:])
+		job.ID = hex.EncodeToString(b[:])
+		if _, ok := rl.jobs[job.ID]; !ok {
+			break
+		}
+	}
+	rl.jobs[job.ID] = job
+	return true
+}
+
+// lookup returns the job with the given id, or nil if there is none.
+func (rl *recallList) lookup(id string) *RecallJob {
+	rl.m.Lock()
+	defer rl.m.Unlock()
+	return rl.jobs[id]
+}
+
+// list returns every job, oldest first.
+func (rl *recallList) list() []*RecallJob {
+	rl.m.Lock()
+	var result []*RecallJob
+	for _, job := range rl.jobs {
+		result = append(result, job)
+	}
+	rl.m.Unlock()
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Started.Before(result[j].Started)
+	})
+	return result
+}
+
+// A recallRequest is the body of a request to POST /item/:id/recall.
+type recallRequest struct {
+	Version items.VersionID
+	Slots   []string
+}
+
+// RecallHandler handles requests to POST /item/:id/recall
+//
+// The body is an optional JSON object giving a version and a list of slots,
+// e.g. {"Version": 3, "Slots": ["a.txt", "b.txt"]}. With no slots, every slot
+// in the version is recalled. The version defaults to the most recent one.
+// Without a version, the slots may use the extended slot names, such as
+// "@blob/12". The blobs are copied into the cache in the background, and the
+// Location header gives the job to poll for their status.
+func (s *RESTServer) RecallHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	id := ps.ByName("id")
+	var req recallRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil && err != io.EOF {
+		w.WriteHeader(400)
+		fmt.Fprintln(w, err)
+		return
+	}
+	item, err := s.Items.Item(id)
+	if err != nil {
+		switch err {
+		case items.ErrNoStore:
+			w.WriteHeader(503)
+		case items.ErrNoItem:
+			w.WriteHeader(404)
+		default:
+			raven.CaptureError(err, nil)
+			log.Println("recall", id, ":", err)
+			w.WriteHeader(500)
+		}
+		fmt.Fprintln(w, err)
+		return
+	}
+	bids, slots, err := recallBlobs(item, req)
+	if err != nil {
+		w.WriteHeader(404)
+		fmt.Fprintln(w, err)
+		return
+	}
+
+	job := &RecallJob{
+		Item:    id,
+		Creator: ps.ByName("username"),
+		Started: time.Now(),
+	}
+	var uncached []items.BlobID
+	for i, bid := range bids {
+		blob := item.Blobs[bid-1]
+		rb := &RecallBlob{
+			ID:     bid,
+			Slot:   slots[i],
+			Bundle: blob.Bundle,
+			Size:   blob.Size,
+			Status: RecallWaiting,
+		}
+		switch {
+		case blob.Bundle == 0:
+			rb.Status = RecallDeleted
+		case !s.needsTape(blobKey(id, bid), id, bid, ""):
+			rb.Status = RecallCached
+		default:
+			uncached = append(uncached, bid)
+		}
+		job.Blobs = append(job.Blobs, rb)
+	}
+	release := func() {}
+	if len(uncached) > 0 {
+		if !s.useTape {
+			w.WriteHeader(503)
+			fmt.Fprintln(w, items.ErrNoStore)
+			return
+		}
+		release = s.startTapeRead(w, r)
+		if release == nil {
+			return
+		}
+	}
+	if !s.recalls.add(job) {
+		release()
+		w.WriteHeader(503)
+		fmt.Fprintln(w, "Too many recall jobs are running")
+		return
+	}
+	go s.runRecall(job, uncached, release)
+	w.Header().Set("Location", "/recall/"+job.ID)
+	w.WriteHeader(202)
+}
+
+// recallBlobs returns the blobs of item asked for by req, without
+// duplicates, along with the first slot naming each one. It returns an error
+// if the version or any slot does not exist.
+func recallBlobs(item *items.Item, req recallRequest) ([]items.BlobID, []string, error) {
+	if len(item.Versions) == 0 {
+		return nil, nil, fmt.Errorf("Item %s has no versions", item.ID)
+	}
+	if req.Version == 0 && len(req.Slots) == 0 {
+		req.Version = item.Versions[len(item.Versions)-1].ID
+	}
+	slots := req.Slots
+	if len(slots) == 0 {
+		var version *items.Version
+		for _, v := range item.Versions {
+			if v.ID == req.Version {
+				version = v
+				break
+			}
+		}
+		if version == nil {
+			return nil, nil, fmt.Errorf("Invalid Version %d", req.Version)
+		}
+		for name := range version.Slots {
+			slots = append(slots, name)
+		}
+		sort.Strings(slots)
+	}
+	var bids []items.BlobID
+	var names []string
+	seen := make(map[items.BlobID]bool)
+	for _, slot := range slots {
+		var bid items.BlobID
+		if req.Version == 0 {
+			bid = item.BlobByExtendedSlot(slot)
+		} else {
+			bid = item.BlobByVersionSlot(req.Version, slot)
+		}
+		if bid == 0 {
+			return nil, nil, fmt.Errorf("No slot %s", slot)
+		}
+		if seen[bid] {
+			continue
+		}
+		seen[bid] = true
+		bids = append(bids, bid)
+		names = append(names, slot)
+	}
+	return bids, names, nil
+}
+
+// runRecall asks the store to stage the uncached blobs of the job and then
+// copies each one into the cache, one at a time. The release function is
+// called when it is done.
+func (s *RESTServer) runRecall(job *RecallJob, uncached []items.BlobID, release func()) {
+	defer release()
+	log.Println("recall", job.ID, "started for", job.Item, len(uncached), "blobs")
+	// ask for everything on tape at once
+	s.Items.StageBlobs(job.Item, uncached)
+	job.M.RLock()
+	blobs := job.Blobs
+	job.M.RUnlock()
+	for _, rb := range blobs {
+		job.M.RLock()
+		waiting := rb.Status == RecallWaiting
+		job.M.RUnlock()
+		if waiting {
+			s.recallBlob(job, rb)
+		}
+	}
+	job.M.Lock()
+	job.Finished = time.Now()
+	job.M.Unlock()
+	log.Println("recall", job.ID, "finished", job.Finished.Sub(job.Started))
+}
+
+// recallBlob copies a single blob of the job into the cache and records the
+// outcome. It uses findContent, so a blob being recalled for some other
+// request is only copied once. A blob too large to cache whole is copied in
+// chunks if the server has a ChunkSize.
+func (s *RESTServer) recallBlob(job *RecallJob, rb *RecallBlob) {
+	setStatus := func(status RecallStatus, err error) {
+		job.M.Lock()
+		rb.Status = status
+		if err != nil {
+			rb.Err = err.Error()
+		}
+		job.M.Unlock()
+	}
+	setStatus(RecallCopying, nil)
+	key := blobKey(job.Item, rb.ID)
+	if s.Cache.Contains(key) {
+		setStatus(RecallCached, nil)
+		return
+	}
+	// look at the size first, so a blob too large to cache is not opened
+	blob, err := s.Items.BlobInfo(job.Item, rb.ID)
+	if err != nil {
+		setStatus(RecallError, err)
+		return
+	}
+	if !s.cacheable(blob.Size) {
+		if s.ChunkSize <= 0 || !s.cacheable(s.ChunkSize) {
+			setStatus(RecallTooLarge, nil)
+			return
+		}
+		// cache it in chunks, the same way reading it would
+		cr := s.newChunkReader(job.Item, rb.ID, blob.Size, job.ID)
+		err = cr.warm()
+		cr.Close()
+		if err != nil {
+			setStatus(RecallError, err)
+			return
+		}
+		setStatus(RecallCached, nil)
+		return
+	}
+	content, err := s.findContent(key, job.Item, rb.ID, true, job.ID)
+	if err != nil {
+		setStatus(RecallError, err)
+		return
+	}
+	switch content.status {
+	case ContentCached:
+		content.r.Close()
+		setStatus(RecallCached, nil)
+	case ContentLarge, ContentChunked:
+		content.r.Close()
+		setStatus(RecallTooLarge, nil)
+	case ContentFilling:
+		content.r.Close()
+		<-content.fill.done
+		if s.Cache.Contains(key) {
+			setStatus(RecallCached, nil)
+			return
+		}
+		err = s.errorledger.find(key)
+		if err == nil {
+			err = fmt.Errorf("blob was not cached")
+		}
+		setStatus(RecallError, err)
+	default:
+		setStatus(RecallError, fmt.Errorf("received status %d", content.status))
+	}
+}
+
+// RecallInfoHandler handles requests to GET /recall/:rid
+func (s *RESTServer) RecallInfoHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	job := s.recalls.lookup(ps.ByName("rid"))
+	if job == nil {
+		w.WriteHeader(404)
+		fmt.Fprintln(w, "cannot find recall job")
+		return
+	}
+	if !checkScope(w, r, job.Item) {
+		return
+	}
+	job.M.RLock()
+	defer job.M.RUnlock()
+	writeHTMLorJSON(w, r, recallInfoTemplate, job)
+}
+
+// ListRecallHandler handles requests to GET /recall
+//
+// Only jobs on items in the scope of the token are listed.
+func (s *RESTServer) ListRecallHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	scope := requestScope(r)
+	result := []string{}
+	for _, job := range s.recalls.list() {
+		if scope.Allows(job.Item) {
+			result = append(result, job.ID)
+		}
+	}
+	writeHTMLorJSON(w, r, listRecallTemplate, result)
+}
+
+var (
+	listRecallTemplate = template.Must(template.New("listrecall").Parse(`<html>
+<h1>Recall Jobs</h1>
+<ul>
+{{ range . }}
+	<li><a href="/recall/{{ . }}">{{ . }}</a></li>
+{{ else }}
+	<li>No Recall Jobs</li>
+{{ end }}
+</ul>
+</html>`))
+
+	recallInfoTemplate = template.Must(template.New("recallinfo").Parse(`<html>
+	<h1>Recall Job</h1>
+	{{ $item := .Item }}
+	<dl>
+	<dt>ID</dt><dd>{{ .ID }}</dd>
+	<dt>For Item</dt><dd><a href="/item/{{ .Item }}">{{ .Item }}</a></dd>
+	<dt>Creator</dt><dd>{{ .Creator }}</dd>
+	<dt>Started</dt><dd>{{ .Started }}</dd>
+	<dt>Finished</dt><dd>{{ if not .Finished.IsZero }}{{ .Finished }}{{ end }}</dd>
+	</dl>
+	<table><thead><tr>
+		<th>Blob</th>
+		<th>Slot</th>
+		<th>Bundle</th>
+		<th>Size</th>
+		<th>Status</th>
+	</tr></thead><tbody>
+	{{ range .Blobs }}
+	<tr>
+		<td><a href="/item/{{ $item }}/@blob/{{ .ID }}">{{ .ID }}</a></td>
+		<td>{{ .Slot }}</td>
+		<td>{{ .Bundle }}</td>
+		<td>{{ .Size }}</td>
+		<td>{{ .Status }}{{ if .Err }}: {{ .Err }}{{ end }}</td>
+	</tr>
+	{{ end }}
+	</tbody></table>
+	<a href="/recall">Back</a>
+	</html>`))
+)
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/json"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ndlib/bendo/blobcache"
+	"github.com/ndlib/bendo/items"
+	"github.com/ndlib/bendo/store"
+)
+
+func TestRecall(t *testing.T) {
+	// the test cache holds 400 bytes, so the last file is too large to cache
+	var files = []struct{ name, content string }{
+		{"a.txt", "recall a"},
+		{"b.txt", "recall b"},
+		{"c.txt", "recall c"},
+		{"big.txt", strings.Repeat("too large ", 10)},
+	}
+	itemid := "recall" + randomid()
+	var commands [][]string
+	for _, f := range files {
+		filePath := uploadstring(t, "POST", "/upload", f.content)
+		commands = append(commands,
+			[]string{"add", path.Base(filePath)},
+			[]string{"slot", f.name, path.Base(filePath)})
+	}
+	txpath := sendtransaction(t, "/item/"+itemid+"/transaction", commands, 202)
+	waitTransaction(t, txpath)
+
+	route := "/item/" + itemid + "/recall"
+	uploadstringhash(t, "POST", route, `{"Slots": ["a.txt", "nothere"]}`, "", 404)
+	uploadstringhash(t, "POST", route, `{"Version": 2}`, "", 404)
+	uploadstringhash(t, "POST", route, `not json`, "", 400)
+	uploadstringhash(t, "POST", "/item/nothere"+randomid()+"/recall", "", "", 404)
+	checkStatus(t, "GET", "/recall/nothere", 404)
+
+	// recall three blobs, naming one of them twice
+	job := waitRecall(t, uploadstringhash(t, "POST", route,
+		`{"Slots": ["a.txt", "@blob/2", "big.txt", "@1/a.txt"]}`, "", 202))
+	expected := []RecallStatus{RecallCached, RecallCached, RecallTooLarge}
+	if len(job.Blobs) != len(expected) {
+		t.Fatalf("Received blobs %v, expected %d", job.Blobs, len(expected))
+	}
+	for i, b := range job.Blobs {
+		if b.Status != expected[i] {
+			t.Errorf("Blob %d (%s) has status %q, expected %q", b.ID, b.Slot, b.Status, expected[i])
+		}
+	}
+	resp := checkRoute(t, "GET", "/item/"+itemid+"/a.txt", 200)
+	resp.Body.Close()
+	if resp.Header.Get("X-Cached") != "1" {
+		t.Errorf("Recalled blob was not cached")
+	}
+
+	// an empty request is the entire version
+	job = waitRecall(t, uploadstringhash(t, "POST", route, "", "", 202))
+	if len(job.Blobs) != len(files) {
+		t.Errorf("Received blobs %v, expected %d", job.Blobs, len(files))
+	}
+	body := getbody(t, "GET", "/recall", 200)
+	if !strings.Contains(body, job.ID) {
+		t.Errorf("Recall list %s does not contain %s", body, job.ID)
+	}
+}
+
+// waitRecall waits for the recall job at the given path to finish and then
+// returns it. It waits at most one second.
+func waitRecall(t *testing.T, jobpath string) *RecallJob {
+	for i := 0; i < 100; i++ {
+		var job RecallJob
+		resp := checkRoute(t, "GET", jobpath, 200)
+		if resp == nil {
+			t.Fatal("Cannot get recall job", jobpath)
+		}
+		err := json.NewDecoder(resp.Body).Decode(&job)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !job.Finished.IsZero() {
+			return &job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Timeout waiting for recall job", jobpath)
+	return nil
+}
+
+func TestRecallChunks(t *testing.T) {
+	const content = "0123456789abcdefghijklmnopqrstuvwxyz" // 36 bytes
+	s := &RESTServer{
+		Items:     items.New(store.NewMemory()),
+		Cache:     blobcache.NewLRU(store.NewMemory(), 160),
+		ChunkSize: 10,
+		useTape:   true,
+	}
+	w, err := s.Items.Open("recall", "nobody")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := md5.Sum([]byte(content))
+	h := sha256.Sum256([]byte(content))
+	bid, err := w.WriteBlob(strings.NewReader(content), int64(len(content)), m[:], h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	// the blob is too large to cache whole, so its chunks are cached
+	rb := &RecallBlob{ID: bid, Status: RecallWaiting}
+	job := &RecallJob{ID: "job", Item: "recall", Blobs: []*RecallBlob{rb}}
+	s.recallBlob(job, rb)
+	if rb.Status != RecallCached {
+		t.Errorf("Received status %q (%s), expected %q", rb.Status, rb.Err, RecallCached)
+	}
+	if s.needsTape(blobKey("recall", bid), "recall", bid, "") {
+		t.Errorf("Recalled blob was not cached in chunks")
+	}
+
+	// without chunks it is too large
+	s.ChunkSize = 0
+	rb.Status = RecallWaiting
+	s.recallBlob(job, rb)
+	if rb.Status != RecallTooLarge {
+		t.Errorf("Received status %q, expected %q", rb.Status, RecallTooLarge)
+	}
+}
+
+func TestRecallListFull(t *testing.T) {
+	defer func(n int) { recallMaxJobs = n }(recallMaxJobs)
+	recallMaxJobs = 2
+	var rl recallList
+	first := &RecallJob{Finished: time.Now().Add(-time.Hour)}
+	second := &RecallJob{Finished: time.Now()}
+	if !rl.add(first) || !rl.add(second) {
+		t.Fatal("Jobs were refused")
+	}
+	// the job which finished first makes room
+	running := &RecallJob{}
+	if !rl.add(running) {
+		t.Fatal("Job was refused")
+	}
+	if rl.lookup(first.ID) != nil || rl.lookup(second.ID) == nil {
+		t.Errorf("Wrong job was removed")
+	}
+	if !rl.add(&RecallJob{}) {
+		t.Fatal("Job was refused")
+	}
+	// every job is running, so there is no room
+	if rl.add(&RecallJob{}) {
+		t.Errorf("Job was added to a full list")
+	}
+	if len(rl.list()) != 2 {
+		t.Errorf("Received %d jobs, expected 2", len(rl.list()))
+	}
+}
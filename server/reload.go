@@ -0,0 +1,60 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// SetValidator changes the token validator. It is safe to call while the
+// server is running. Requests already authenticated are not affected.
+func (s *RESTServer) SetValidator(v TokenValidator) {
+	s.validatorM.Lock()
+	s.Validator = v
+	s.validatorM.Unlock()
+}
+
+// validator returns the current token validator.
+func (s *RESTServer) validator() TokenValidator {
+	s.validatorM.RLock()
+	defer s.validatorM.RUnlock()
+	return s.Validator
+}
+
+// SetCertValidator changes the client certificate validator. It is safe to
+// call while the server is running.
+func (s *RESTServer) SetCertValidator(v TokenValidator) {
+	s.validatorM.Lock()
+	s.CertValidator = v
+	s.validatorM.Unlock()
+}
+
+// certValidator returns the current client certificate validator.
+func (s *RESTServer) certValidator() TokenValidator {
+	s.validatorM.RLock()
+	defer s.validatorM.RUnlock()
+	return s.CertValidator
+}
+
+// ReloadHandler handles requests to POST /admin/reload
+//
+// It calls s.Reload to reload the token file and the configuration. If there
+// is an error nothing is changed.
+func (s *RESTServer) ReloadHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.Reload == nil {
+		w.WriteHeader(501)
+		fmt.Fprintln(w, "Reloading is not supported")
+		return
+	}
+	log.Println("Reload requested by", ps.ByName("username"))
+	err := s.Reload()
+	if err != nil {
+		log.Println("Reload:", err)
+		w.WriteHeader(500)
+		fmt.Fprintln(w, err)
+		return
+	}
+	fmt.Fprintln(w, "Reloaded")
+}
@@ -2,18 +2,22 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"expvar"
 	"fmt"
 	"html/template"
 	"log"
 	"net/http"
 	_ "net/http/pprof" // for pprof server
+	"runtime/debug"
+	"strings"
 	"sync"
+	"time"
 
 	raven "github.com/getsentry/raven-go"
 	"github.com/julienschmidt/httprouter"
-	"golang.org/x/sync/singleflight"
 
 	"github.com/ndlib/bendo/blobcache"
 	"github.com/ndlib/bendo/fragment"
@@ -24,8 +28,9 @@ import (
 // RESTServer holds the configuration for a Bendo REST API server.
 //
 // Set all the public fields and then call Run. Run will listen on the given
-// port and handle requests. At the moment there is no maximum simultaneous
-// request limit. Do not change any fields after calling Run.
+// port and handle requests. The number and rate of requests each token may
+// make is bounded by Limits; a request over a limit gets a 429 error with a
+// Retry-After header. Do not change any fields after calling Run.
 //
 // Run will also start a goroutine to handle serializing new file uploads
 // into storage bags, and a goroutine to do fixity checking.
@@ -36,6 +41,19 @@ type RESTServer struct {
 	// Port number to run bendo on. defaults to 14000
 	PortNumber string
 
+	// TLSConfig, if not nil, is used to serve HTTPS instead of HTTP. It
+	// should provide the certificate, either directly or through
+	// GetCertificate (see CertReloader). To accept client certificates
+	// set ClientAuth and ClientCAs.
+	TLSConfig *tls.Config
+
+	// CertValidator maps the subjects of verified client certificates to a
+	// user and role (see NewSubjectValidator). A certificate is only used
+	// if the request does not have an API key. If nil, client certificates
+	// are ignored. Use SetCertValidator to change it once the server is
+	// running.
+	CertValidator TokenValidator
+
 	// Port to run the profiler/inspector on. If empty, the goroutine is not
 	// started. It provides information on the "/debug/" route.
 	PProfPort string
@@ -49,7 +67,7 @@ type RESTServer struct {
 
 	// Validator does authentication by validating any user tokens
 	// presented to the API. If this is nil then no authentication will be
-	// done.
+	// done. Use SetValidator to change it once the server is running.
 	Validator TokenValidator
 
 	// TxStore keeps information on transactions in progress. If this is
@@ -63,27 +81,74 @@ type RESTServer struct {
 	// Cache keeps smallish blobs retreived from tape.
 	Cache blobcache.T
 
+	// ChunkSize, if not zero, is the size in bytes of the pieces that blobs
+	// too large to be cached whole are cached in. It should be much smaller
+	// than the cache. If zero, such blobs are always read from tape.
+	ChunkSize int64
+
+	// FillDir is the directory holding the temporary files that blobs being
+	// copied into the cache are served from while the copy goes on. They are
+	// not counted against the size of the cache. If empty, the system's
+	// temporary directory is used.
+	FillDir string
+
+	// CacheScrubRate is the number of bytes per second to read when
+	// rechecking the checksums of the blobs in the cache. If zero, the cache
+	// is not rechecked. Use SetCacheScrubRate to change it once the server
+	// is running.
+	CacheScrubRate int64
+
 	// Fixity stores the records tracking past and future fixity checks.
 	FixityDatabase FixityDB
 	DisableFixity  bool
 
+	// BlobDatabase indexes the blobs of every item. It is used to find
+	// blobs by their checksum. If nil, those lookups are not available.
+	BlobDatabase BlobDB
+
+	// TokenDatabase keeps the API tokens managed through /admin/tokens. If
+	// nil, those routes are not available. (To have the tokens accepted,
+	// Validator should include a DBValidator.)
+	TokenDatabase TokenDB
+
+	// AuditDatabase keeps a record of every change made through the API.
+	// If nil, no record is kept.
+	AuditDatabase AuditDB
+
+	// Limits bounds the number of requests each token may make, and the
+	// number made without a token from each remote address. If nil, there
+	// are no limits. Use Limits.SetLimits to change them once the server
+	// is running.
+	Limits *Limiter
+
+	// SigningKey is the secret used to sign URLs which allow access to
+	// content without an API key. If empty, URLs cannot be signed.
+	SigningKey []byte
+
+	// Reload, if not nil, is called by the /admin/reload route to reload
+	// the token file and configuration.
+	Reload func() error
+
 	server   *http.Server   // used to close our listening socket
 	txqueue  chan string    // channel to feed background transaction workers. contains tx ids
 	txwg     sync.WaitGroup // for waiting for all background tx workers to exit
 	txcancel chan struct{}  // Is closed to indicate tx workers should exit
 	useTape  bool           // Is Bendo reading/writing from tape?
 
-	// tapeinflight tracks whether a blob is being copied into the cache. If
-	// one is, then a channel is returned that will signal when the copy is
-	// finished. When that happens calling findContent() again will return
-	// either a reader for the blob or the error that happened while copying it
-	// into the cache.
-	tapeinflight *singleflight.Group
+	validatorM    sync.RWMutex // protects Validator once the server is running
+	fixityStarted bool         // have the fixity goroutines been started?
+
+	// fills holds the blobs being copied into the cache, so requests for one
+	// can read it as it is copied instead of starting another copy.
+	fillM sync.Mutex
+	fills map[string]*cacheFill
+
+	// recalls holds the jobs copying groups of blobs into the cache.
+	recalls recallList
 
 	// errorledger tracks the errors that happen when copying blobs into the
-	// cache. The errors are only kept for a short amount of time (at least
-	// long enough that others waiting on the channel can call findContent
-	// again to get the error).
+	// cache. The errors are only kept for a short amount of time, so a blob
+	// which failed to copy is not immediately read from tape again.
 	errorledger errorlist
 }
 
@@ -119,6 +184,7 @@ func (s *RESTServer) Run() error {
 		if c, ok := s.Cache.(Scanner); ok {
 			go c.Scan()
 		}
+		go s.scrubCache()
 	}
 
 	log.Println("Scanning Transactions")
@@ -150,10 +216,17 @@ func (s *RESTServer) Run() error {
 	log.Println("Listening on", s.PortNumber)
 
 	s.server = &http.Server{
-		Handler: raven.Recoverer(s.addRoutes()),
-		Addr:    ":" + s.PortNumber,
+		Handler:   recoverer(s.addRoutes()),
+		Addr:      ":" + s.PortNumber,
+		TLSConfig: s.TLSConfig,
+	}
+	var err error
+	if s.TLSConfig != nil {
+		// the certificate is in the TLSConfig
+		err = s.server.ListenAndServeTLS("", "")
+	} else {
+		err = s.server.ListenAndServe()
 	}
-	err := s.server.ListenAndServe()
 
 	// being shutdown is not an error
 	if err == http.ErrServerClosed {
@@ -171,7 +244,16 @@ func (s *RESTServer) Stop() error {
 	s.txwg.Wait() // wait for all tx workers to exit
 
 	// then shutdown all the HTTP connections
-	return s.server.Shutdown(context.Background())
+	err := s.server.Shutdown(context.Background())
+
+	// let the cache save its usage information
+	type Stopper interface {
+		Stop()
+	}
+	if c, ok := s.Cache.(Stopper); ok {
+		c.Stop()
+	}
+	return err
 }
 
 // initCommitQueue adds all transactions in the tx store to the transaction queue.
@@ -202,6 +284,14 @@ func (s *RESTServer) addRoutes() http.Handler {
 		{"GET", "/item/:id/*slot", RoleUnknown, s.SlotHandler},
 		{"HEAD", "/item/:id/*slot", RoleUnknown, s.SlotHandler},
 		{"GET", "/item/:id", RoleUnknown, s.ItemHandler},
+		{"GET", "/item", RoleMDOnly, s.ItemListHandler},
+		{"GET", "/blob/sha256/:hex", RoleMDOnly, s.BlobChecksumHandler},
+		{"POST", "/sign/item/:id/*slot", RoleRead, s.SignURLHandler},
+
+		// staging content from tape into the cache
+		{"POST", "/item/:id/recall", RoleRead, s.RecallHandler},
+		{"GET", "/recall", RoleRead, s.ListRecallHandler},
+		{"GET", "/recall/:rid", RoleRead, s.RecallInfoHandler},
 
 		// all the transaction things.
 		{"POST", "/item/:id/transaction", RoleWrite, s.NewTxHandler},
@@ -228,6 +318,20 @@ func (s *RESTServer) addRoutes() http.Handler {
 		// /admin/tape_use (enable, disable, get status)
 		{"GET", "/admin/use_tape", RoleUnknown, s.GetTapeUseHandler},
 		{"PUT", "/admin/use_tape/:status", RoleAdmin, s.SetTapeUseHandler},
+		{"GET", "/admin/limits", RoleAdmin, s.LimitsHandler},
+		{"POST", "/admin/reload", RoleAdmin, s.ReloadHandler},
+		{"GET", "/admin/tokens", RoleAdmin, s.ListTokensHandler},
+		{"POST", "/admin/tokens", RoleAdmin, s.CreateTokenHandler},
+		{"GET", "/admin/tokens/:id", RoleAdmin, s.GetTokenHandler},
+		{"PUT", "/admin/tokens/:id/:action", RoleAdmin, s.DisableTokenHandler},
+		{"DELETE", "/admin/tokens/:id", RoleAdmin, s.RevokeTokenHandler},
+		{"GET", "/admin/audit", RoleAdmin, s.AuditHandler},
+		{"GET", "/admin/cache", RoleAdmin, s.CacheUsageHandler},
+		{"GET", "/admin/cache/entries", RoleAdmin, s.ListCacheHandler},
+		{"GET", "/admin/cache/entries/:key", RoleAdmin, s.GetCacheHandler},
+		{"DELETE", "/admin/cache/entries/:key", RoleAdmin, s.EvictCacheHandler},
+		{"PUT", "/admin/cache/entries/:key/:action", RoleAdmin, s.PinCacheHandler},
+		{"DELETE", "/admin/cache/item/:id", RoleAdmin, s.EvictCacheItemHandler},
 
 		// the read only bundle stuff
 		{"GET", "/bundle/list/:prefix", RoleRead, s.BundleListPrefixHandler},
@@ -236,7 +340,8 @@ func (s *RESTServer) addRoutes() http.Handler {
 
 		// other
 		{"GET", "/", RoleUnknown, WelcomeHandler},
-		{"GET", "/stats", RoleUnknown, NotImplementedHandler},
+		{"GET", "/stats", RoleUnknown, s.StatsHandler},
+		{"GET", "/metrics", RoleUnknown, s.MetricsHandler},
 		{"GET", "/debug/vars", RoleUnknown, VarHandler}, // standard route for expvars data
 	}
 
@@ -244,7 +349,10 @@ func (s *RESTServer) addRoutes() http.Handler {
 	for _, route := range routes {
 		r.Handle(route.method,
 			route.route,
-			logWrapper(s.authzWrapper(route.handler, route.role)))
+			metricsWrapper(route.route,
+				logWrapper(route.route,
+					s.auditWrapper(route.method, route.route,
+						s.authzWrapper(s.limitWrapper(route.handler), route.role)))))
 	}
 	return r
 }
@@ -273,6 +381,32 @@ func NotImplementedHandler(w http.ResponseWriter, r *http.Request, ps httprouter
 	fmt.Fprintf(w, "Not Implemented\n")
 }
 
+// recoverer is like raven.Recoverer, reporting panics in handlers to Sentry,
+// except that it passes on http.ErrAbortHandler. That panic is how a handler
+// which has already started a response says it failed, and net/http will then
+// close the connection so the client can tell the response is incomplete.
+func recoverer(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			rval := recover()
+			if rval == nil {
+				return
+			}
+			if rval == http.ErrAbortHandler {
+				panic(rval)
+			}
+			debug.PrintStack()
+			rvalStr := fmt.Sprint(rval)
+			packet := raven.NewPacket(rvalStr,
+				raven.NewException(errors.New(rvalStr), raven.NewStacktrace(2, 3, nil)),
+				raven.NewHttp(r))
+			raven.Capture(packet, nil)
+			w.WriteHeader(http.StatusInternalServerError)
+		}()
+		handler.ServeHTTP(w, r)
+	})
+}
+
 // writeHTMLorJSON will either return val as JSON or as rendered using the
 // given template, depending on the request header "Accept-Encoding".
 func writeHTMLorJSON(w http.ResponseWriter,
@@ -295,11 +429,12 @@ func writeHTMLorJSON(w http.ResponseWriter,
 
 // authzWrapper returns a Handler which will first verify the user token as
 // having at least the given Role. The user name is added as a parameter
-// "username".
+// "username". If the route is for an item, the item must also be in the scope
+// of the token.
 func (s *RESTServer) authzWrapper(handler httprouter.Handle, leastRole Role) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 		// the token may be passed in either the X-Api-Key header, or as the username
-		// or the password in basic auth (to support human use)
+		// or the password in basic auth (to support human use), or as a bearer token
 		token := r.Header.Get("X-Api-Key")
 		if token == "" {
 			// token in username field?
@@ -309,12 +444,31 @@ func (s *RESTServer) authzWrapper(handler httprouter.Handle, leastRole Role) htt
 			// token in password field?
 			_, token, _ = r.BasicAuth()
 		}
-		user, role, err := s.Validator.TokenValid(token)
+		if token == "" {
+			// bearer token? (as is usual for a JWT)
+			if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+				token = strings.TrimSpace(h[len("Bearer "):])
+			}
+		}
+		user, role, scope, err := tokenScope(s.validator(), token)
 		if err != nil {
 			w.WriteHeader(500)
 			fmt.Fprintln(w, err.Error())
 			return
 		}
+		if token == "" && role == RoleUnknown {
+			// without a token the request may have a client certificate
+			user, role, err = s.certUser(r)
+			if err != nil {
+				w.WriteHeader(500)
+				fmt.Fprintln(w, err.Error())
+				return
+			}
+		}
+		if token == "" && role == RoleUnknown {
+			// or it may use a signed URL
+			user, role = s.verifySignedURL(r)
+		}
 
 		// is role valid?
 		if role < leastRole {
@@ -324,7 +478,22 @@ func (s *RESTServer) authzWrapper(handler httprouter.Handle, leastRole Role) htt
 			return
 		}
 
-		log.Println("User", user)
+		info := getRequestInfo(r)
+		if info == nil {
+			info = &requestInfo{}
+			r = withRequestInfo(r, info)
+		}
+		info.User = user
+		info.Role = role
+		info.Scope = scope
+		if user != "" {
+			info.Token = token
+		}
+
+		// is the item in the scope of the token?
+		if item := scopeItem(r, ps); item != "" && !checkScope(w, r, item) {
+			return
+		}
 
 		// remove any previous username
 		for i := range ps {
@@ -341,10 +510,35 @@ func (s *RESTServer) authzWrapper(handler httprouter.Handle, leastRole Role) htt
 }
 
 // logWrapper takes a handler and returns a handler which does the same thing,
-// after first logging the request URL.
-func logWrapper(handler httprouter.Handle) httprouter.Handle {
+// and then writes an entry for the request to the access log. It assigns the
+// request an id, which is returned in the X-Request-Id header.
+func logWrapper(route string, handler httprouter.Handle) httprouter.Handle {
 	return func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-		log.Println(r.Method, r.URL)
-		handler(w, r, ps)
+		start := time.Now()
+		info := &requestInfo{ID: newRequestID(r)}
+		if strings.HasPrefix(route, "/item/") {
+			info.Item = ps.ByName("id")
+		}
+		w.Header().Set("X-Request-Id", info.ID)
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			writeAccessLog(accessEntry{
+				Time:      start,
+				RequestID: info.ID,
+				Method:    r.Method,
+				Path:      r.URL.String(),
+				Route:     route,
+				Remote:    r.RemoteAddr,
+				User:      info.User,
+				Role:      info.Role.String(),
+				Status:    sw.Status(),
+				Bytes:     sw.size,
+				Duration:  time.Since(start).Seconds(),
+				Cached:    sw.Header().Get("X-Cached"),
+				Item:      info.Item,
+				Blob:      info.Blob,
+			})
+		}()
+		handler(sw, withRequestInfo(r, info), ps)
 	}
 }
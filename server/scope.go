@@ -0,0 +1,102 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"unicode"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// A Scope limits a token to the items whose ids match one of its patterns.
+// The patterns use the syntax of path.Match, so "und:etd*" matches every item
+// whose id begins with "und:etd". A nil Scope allows every item.
+type Scope []string
+
+// ParseScope returns the Scope given by a list of patterns separated by
+// commas or whitespace. An empty list gives a nil Scope.
+func ParseScope(s string) Scope {
+	patterns := strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+	if len(patterns) == 0 {
+		return nil
+	}
+	return Scope(patterns)
+}
+
+// Allows returns whether the given item id is in the scope. A malformed
+// pattern matches nothing.
+func (sc Scope) Allows(item string) bool {
+	if sc == nil {
+		return true
+	}
+	for _, pattern := range sc {
+		if ok, _ := path.Match(pattern, item); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the patterns separated by spaces, in the form accepted by
+// ParseScope.
+func (sc Scope) String() string {
+	return strings.Join(sc, " ")
+}
+
+// A ScopedValidator is a TokenValidator whose tokens may be limited to some
+// items.
+type ScopedValidator interface {
+	TokenValidator
+
+	// TokenScope is the same as TokenValid, but also returns the scope of
+	// the token. Tokens which are not limited have a nil scope.
+	TokenScope(token string) (user string, role Role, scope Scope, err error)
+}
+
+// tokenScope returns the user, role, and scope of token using v. If v is not
+// a ScopedValidator the scope is nil.
+func tokenScope(v TokenValidator, token string) (string, Role, Scope, error) {
+	if sv, ok := v.(ScopedValidator); ok {
+		return sv.TokenScope(token)
+	}
+	user, role, err := v.TokenValid(token)
+	return user, role, nil, err
+}
+
+// scopeItem returns the item id given in the route parameters, or "" if the
+// route is not for a specific item. Item routes have the id in the parameter
+// "id", except for POST /fixity/:item. (The other routes using "id" are for
+// fixity records and tokens.)
+func scopeItem(r *http.Request, ps httprouter.Params) string {
+	if item := ps.ByName("item"); item != "" {
+		return item
+	}
+	p := r.URL.Path
+	if strings.HasPrefix(p, "/item/") || strings.HasPrefix(p, "/sign/item/") {
+		return ps.ByName("id")
+	}
+	return ""
+}
+
+// requestScope returns the scope of the token used for r.
+func requestScope(r *http.Request) Scope {
+	if info := getRequestInfo(r); info != nil {
+		return info.Scope
+	}
+	return nil
+}
+
+// checkScope returns whether the request r may access the given item. If
+// not, an error is written to w.
+func checkScope(w http.ResponseWriter, r *http.Request, item string) bool {
+	if requestScope(r).Allows(item) {
+		return true
+	}
+	w.WriteHeader(403)
+	fmt.Fprintln(w, "Item", item, "is not in the scope of this token")
+	return false
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ndlib/bendo/fragment"
+	"github.com/ndlib/bendo/items"
+	"github.com/ndlib/bendo/store"
+	"github.com/ndlib/bendo/transaction"
+)
+
+func TestScopeAllows(t *testing.T) {
+	var table = []struct {
+		scope string
+		item  string
+		ok    bool
+	}{
+		{"", "anything", true},
+		{"und:etd*", "und:etd123", true},
+		{"und:etd*", "und:abc", false},
+		{"und:etd*, und:abc", "und:abc", true},
+		{"und:[a-c]*", "und:b12", true},
+		{"und:[a-c]*", "und:d12", false},
+		{"und:[", "und:[", false}, // malformed pattern
+	}
+	for _, tab := range table {
+		if ok := ParseScope(tab.scope).Allows(tab.item); ok != tab.ok {
+			t.Errorf("Scope %q, item %q: received %v", tab.scope, tab.item, ok)
+		}
+	}
+}
+
+func TestScopeRoutes(t *testing.T) {
+	v, _ := NewListValidatorString(`etd write 123 items=und:etd*
+	etd write 456 items=und:etd2
+	etd write 567
+	other write 234
+	admin admin 345`)
+	db, err := NewQlCache("mem--scope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &RESTServer{
+		Validator:      v,
+		Items:          items.New(store.NewMemory()),
+		TxStore:        transaction.New(store.NewMemory()),
+		FileStore:      fragment.New(store.NewMemory()),
+		FixityDatabase: db,
+		BlobDatabase:   db,
+		SigningKey:     []byte("secret"),
+		txqueue:        make(chan string, 10),
+		useTape:        true,
+	}
+	ts := httptest.NewServer(s.addRoutes())
+	defer ts.Close()
+
+	send := func(method, route, token, body string, expstatus int) *http.Response {
+		req, _ := http.NewRequest(method, ts.URL+route, strings.NewReader(body))
+		req.Header.Set("X-Api-Key", token)
+		req.Header.Set("Accept-Encoding", "application/json")
+		if method == "POST" && strings.HasPrefix(route, "/upload") {
+			sum := md5.Sum([]byte(body))
+			req.Header.Set("X-Upload-Md5", hex.EncodeToString(sum[:]))
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != expstatus {
+			b, _ := ioutil.ReadAll(resp.Body)
+			t.Errorf("%s %s (%s): received status %d, expected %d: %s",
+				method, route, token, resp.StatusCode, expstatus, b)
+		}
+		return resp
+	}
+
+	// item routes
+	send("POST", "/sign/item/und:etd1/a", "123", "", 200).Body.Close()
+	send("POST", "/sign/item/und:abc/a", "123", "", 403).Body.Close()
+	send("POST", "/sign/item/und:abc/a", "234", "", 200).Body.Close()
+
+	// fixity records are checked against the scope of their item
+	newFixity := func(item string) int64 {
+		id, err := db.UpdateFixity(Fixity{Item: item, Status: "scheduled", ScheduledTime: time.Now().Add(time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	etdid, otherid := newFixity("und:etd1"), newFixity("und:abc")
+	etdfixity := "/fixity/" + strconv.FormatInt(etdid, 10)
+	otherfixity := "/fixity/" + strconv.FormatInt(otherid, 10)
+	send("GET", otherfixity, "123", "", 403).Body.Close()
+	send("PUT", otherfixity, "123", "", 403).Body.Close()
+	send("DELETE", otherfixity, "123", "", 403).Body.Close()
+	if db.GetFixity(otherid) == nil {
+		t.Errorf("Fixity record outside the scope was deleted")
+	}
+	send("PUT", etdfixity, "123", "", 200).Body.Close()
+	send("DELETE", etdfixity, "123", "", 200).Body.Close()
+	send("DELETE", otherfixity, "234", "", 200).Body.Close()
+	newFixity("und:abc")
+	resp := send("GET", "/fixity?start=*&end=*", "123", "", 200)
+	var fixities []*Fixity
+	json.NewDecoder(resp.Body).Decode(&fixities)
+	resp.Body.Close()
+	if len(fixities) != 0 {
+		t.Errorf("Received fixity records %v, expected none", fixities)
+	}
+
+	// listings only include items in the scope
+	sum := sha256.Sum256([]byte("scope"))
+	for _, id := range []string{"und:etd1", "und:abc"} {
+		db.Set(id, &items.Item{
+			ID:       id,
+			Blobs:    []*items.Blob{{ID: 1, Size: 5, Bundle: 1, SHA256: sum[:]}},
+			Versions: []*items.Version{{ID: 1, Slots: map[string]items.BlobID{"a": 1}}},
+		})
+	}
+	resp = send("GET", "/item?prefix=und:", "123", "", 200)
+	var itemlist ItemList
+	json.NewDecoder(resp.Body).Decode(&itemlist)
+	resp.Body.Close()
+	if len(itemlist.Items) != 1 || itemlist.Items[0].ID != "und:etd1" {
+		t.Errorf("Received item list %v, expected only und:etd1", itemlist.Items)
+	}
+	resp = send("GET", "/blob/sha256/"+hex.EncodeToString(sum[:]), "123", "", 200)
+	var refs []BlobRef
+	json.NewDecoder(resp.Body).Decode(&refs)
+	resp.Body.Close()
+	if len(refs) != 1 || refs[0].Item != "und:etd1" {
+		t.Errorf("Received blobs %v, expected only und:etd1", refs)
+	}
+	send("GET", "/blob/sha256/"+hex.EncodeToString(sum[:]), "234", "", 200).Body.Close()
+
+	// bundles are not sorted out by item
+	send("GET", "/bundle/open/und:abc-0001.zip", "123", "", 403).Body.Close()
+	send("GET", "/bundle/list/", "123", "", 403).Body.Close()
+	send("GET", "/bundle/list/und:abc", "123", "", 403).Body.Close()
+	send("GET", "/bundle/open/und:abc-0001.zip", "234", "", 404).Body.Close()
+	send("GET", "/bundle/list/", "234", "", 200).Body.Close()
+
+	// uploads belong to the user and the scope making them
+	add := func(file string) string {
+		return `[["add", "` + strings.TrimPrefix(file, "/upload/") + `"]]`
+	}
+	resp = send("POST", "/upload", "123", "hello", 200)
+	resp.Body.Close()
+	etdfile := resp.Header.Get("Location")
+	resp = send("POST", "/upload", "234", "goodbye", 200)
+	resp.Body.Close()
+	otherfile := resp.Header.Get("Location")
+	send("GET", etdfile, "123", "", 200).Body.Close()
+	send("GET", etdfile, "234", "", 403).Body.Close()
+	send("GET", etdfile, "345", "", 200).Body.Close()
+	// other tokens of the same user have a different scope
+	send("GET", etdfile, "456", "", 403).Body.Close()
+	send("GET", etdfile, "567", "", 403).Body.Close()
+	send("POST", etdfile, "234", "more", 403).Body.Close()
+	send("DELETE", etdfile, "234", "", 403).Body.Close()
+	var list []string
+	resp = send("GET", "/upload", "234", "", 200)
+	json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list) != 1 || "/upload/"+list[0] != otherfile {
+		t.Errorf("Received upload list %v, expected only %s", list, otherfile)
+	}
+
+	// transactions
+	send("POST", "/item/und:abc/transaction", "123", add(etdfile), 403).Body.Close()
+	send("POST", "/item/und:abc/transaction", "234", add(etdfile), 403).Body.Close()
+	resp = send("POST", "/item/und:etd1/transaction", "123", add(etdfile), 202)
+	resp.Body.Close()
+	etdtx := resp.Header.Get("Location")
+	resp = send("POST", "/item/und:xyz/transaction", "234", add(otherfile), 202)
+	resp.Body.Close()
+	othertx := resp.Header.Get("Location")
+	send("GET", etdtx, "123", "", 200).Body.Close()
+	send("GET", othertx, "123", "", 403).Body.Close()
+	send("GET", othertx, "234", "", 200).Body.Close()
+	resp = send("GET", "/transaction", "123", "", 200)
+	list = nil
+	json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list) != 1 || "/transaction/"+list[0] != etdtx {
+		t.Errorf("Received transaction list %v, expected only %s", list, etdtx)
+	}
+
+	// nor may a token of the same user with another scope
+	send("POST", "/item/und:etd2/transaction", "456", add(etdfile), 403).Body.Close()
+}
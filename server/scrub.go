@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"expvar"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	raven "github.com/getsentry/raven-go"
+
+	"github.com/ndlib/bendo/blobcache"
+	"github.com/ndlib/bendo/items"
+)
+
+// This file has the cache scrubber, which rereads the blobs in the cache to
+// make sure they still match their checksums. Blobs are also checked as they
+// are copied into the cache (see copyBlobIntoCache).
+
+var (
+	xCacheVerified      = expvar.NewInt("cache.verify.count")
+	xCacheVerifiedBytes = expvar.NewInt("cache.verify.bytes")
+	xCacheMismatch      = expvar.NewInt("cache.verify.mismatch")
+)
+
+// parseBlobKey is the inverse of blobKey. It returns false if the key is not
+// for an entire blob, such as the key of a chunk.
+func parseBlobKey(key string) (string, items.BlobID, bool) {
+	i := strings.LastIndex(key, "+")
+	if i <= 0 {
+		return "", 0, false
+	}
+	n, err := strconv.Atoi(key[i+1:])
+	if err != nil || n <= 0 {
+		return "", 0, false
+	}
+	return key[:i], items.BlobID(n), true
+}
+
+// cacheMismatch reports that the copy of a blob read from the cache, or read
+// while being copied into the cache, did not match the blob's checksum.
+func (s *RESTServer) cacheMismatch(key string, where string) {
+	xCacheMismatch.Add(1)
+	log.Println("cache checksum mismatch", key, "found by", where)
+	raven.CaptureMessage("cache checksum mismatch", map[string]string{"key": key, "found": where})
+}
+
+// SetCacheScrubRate changes the number of bytes per second the cache scrubber
+// reads while the server is running. A rate of 0 pauses the scrubber.
+func (s *RESTServer) SetCacheScrubRate(rate int64) {
+	atomic.StoreInt64(&s.CacheScrubRate, rate)
+}
+
+// scrubCache is an infinite loop verifying every blob in the cache against
+// its SHA-256 checksum, at the rate given by CacheScrubRate. Blobs which do
+// not match are removed from the cache. Chunks of large blobs are not
+// verified since there is no checksum to compare them to. This function does
+// not return.
+func (s *RESTServer) scrubCache() {
+	for {
+		var total int64
+		cache, ok := s.Cache.(blobcache.Manager)
+		if ok && atomic.LoadInt64(&s.CacheScrubRate) > 0 {
+			for _, e := range cache.Entries() {
+				rate := atomic.LoadInt64(&s.CacheScrubRate)
+				if rate <= 0 {
+					break
+				}
+				n := s.verifyCacheEntry(cache, e.Key)
+				total += n
+				time.Sleep(time.Duration(float64(n) / float64(rate) * float64(time.Second)))
+			}
+		}
+		if total == 0 {
+			// nothing to do. a minute is arbitrary.
+			time.Sleep(time.Minute)
+		}
+	}
+}
+
+// verifyCacheEntry checks the cache entry having the given key against the
+// checksum of its blob. A mismatched entry is removed from the cache, unless
+// it was replaced while being checked. It returns the number of bytes read.
+func (s *RESTServer) verifyCacheEntry(cache blobcache.Manager, key string) int64 {
+	id, bid, ok := parseBlobKey(key)
+	if !ok {
+		return 0
+	}
+	blob, err := s.Items.BlobInfo(id, bid)
+	if err != nil || len(blob.SHA256) == 0 {
+		return 0
+	}
+	entry, ok := cache.Entry(key)
+	if !ok {
+		return 0
+	}
+	r, size, err := cache.Peek(key)
+	if err != nil {
+		log.Println("cache scrub", key, err)
+		return 0
+	}
+	if r == nil {
+		// it was evicted since the entries were listed
+		return 0
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, io.NewSectionReader(r, 0, size))
+	r.Close()
+	if err != nil {
+		log.Println("cache scrub", key, err)
+		return n
+	}
+	xCacheVerified.Add(1)
+	xCacheVerifiedBytes.Add(n)
+	if n != blob.Size || !bytes.Equal(h.Sum(nil), blob.SHA256) {
+		// the entry changes if the blob was put again since it was read.
+		// (a read of the blob also changes it, but then the next pass
+		// will find the mismatch)
+		if now, ok := cache.Entry(key); !ok || now != entry {
+			return n
+		}
+		s.cacheMismatch(key, "scrub")
+		s.Cache.Delete(key)
+	}
+	return n
+}
@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ndlib/bendo/blobcache"
+	"github.com/ndlib/bendo/items"
+	"github.com/ndlib/bendo/store"
+)
+
+func TestParseBlobKey(t *testing.T) {
+	var table = []struct {
+		key string
+		id  string
+		bid items.BlobID
+		ok  bool
+	}{
+		{"abc+0001", "abc", 1, true},
+		{"a+b+0012", "a+b", 12, true},
+		{"abc+0001@0-9", "", 0, false},
+		{"LRU-LIST", "", 0, false},
+		{"+0001", "", 0, false},
+		{"abc+-001", "", 0, false},
+	}
+	for _, tab := range table {
+		id, bid, ok := parseBlobKey(tab.key)
+		if id != tab.id || bid != tab.bid || ok != tab.ok {
+			t.Errorf("%s: received %q, %d, %v", tab.key, id, bid, ok)
+		}
+	}
+}
+
+func TestVerifyCache(t *testing.T) {
+	cache := blobcache.NewLRU(store.NewMemory(), 1000)
+	defer cache.Stop()
+	s := &RESTServer{
+		Items:   items.New(store.NewMemory()),
+		Cache:   cache,
+		useTape: true,
+	}
+	w, err := s.Items.Open("scrub", "nobody")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, content := range []string{"good blob", "bad blob"} {
+		m := md5.Sum([]byte(content))
+		h := sha256.Sum256([]byte(content))
+		_, err = w.WriteBlob(strings.NewReader(content), int64(len(content)), m[:], h[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	put := func(key, content string) {
+		w, _ := cache.Put(key)
+		w.Write([]byte(content))
+		w.Close()
+	}
+	put("scrub+0001", "good blob")
+	put("scrub+0002", "bad blub")
+	mismatches := xCacheMismatch.Value()
+	if n := s.verifyCacheEntry(cache, "scrub+0001"); n != 9 {
+		t.Errorf("Received %d bytes read, expected 9", n)
+	}
+	s.verifyCacheEntry(cache, "scrub+0002")
+	if !cache.Contains("scrub+0001") || cache.Contains("scrub+0002") {
+		t.Errorf("Wrong entries were removed")
+	}
+	if xCacheMismatch.Value() != mismatches+1 {
+		t.Errorf("Mismatch was not counted")
+	}
+
+	// an entry put again while it is being checked is kept
+	put("scrub+0002", "bad blub")
+	reput := &reputCache{Manager: cache, content: "bad blob"}
+	s.verifyCacheEntry(reput, "scrub+0002")
+	if !cache.Contains("scrub+0002") {
+		t.Errorf("Entry put again while being checked was removed")
+	}
+
+	// a copy from tape is checked too
+	fill, err := newCacheFill("", "scrub+0001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Delete("scrub+0001")
+	s.copyBlobIntoCache(fill, "scrub", 1, []byte("wrong checksum"), "")
+	if cache.Contains("scrub+0001") {
+		t.Errorf("Blob having the wrong checksum was cached")
+	}
+	if s.errorledger.find("scrub+0001") == nil {
+		t.Errorf("Mismatch was not added to the error ledger")
+	}
+}
+
+// reputCache puts an item again, with the given content, whenever it is
+// peeked at.
+type reputCache struct {
+	blobcache.Manager
+	content string
+}
+
+func (c *reputCache) Peek(key string) (store.ReadAtCloser, int64, error) {
+	r, size, err := c.Manager.Peek(key)
+	if r != nil {
+		// read the old content before it is replaced
+		p := make([]byte, size)
+		r.ReadAt(p, 0)
+		r.Close()
+		r = memItem{bytes.NewReader(p)}
+		time.Sleep(time.Millisecond) // so the new entry has a different time
+		w, _ := c.Manager.Put(key)
+		w.Write([]byte(c.content))
+		w.Close()
+	}
+	return r, size, err
+}
+
+type memItem struct {
+	*bytes.Reader
+}
+
+func (memItem) Close() error { return nil }
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"github.com/ndlib/bendo/store"
+)
+
+// A ReadSeekCloser is a stream of blob content which can be positioned
+// anywhere. It is what http.ServeContent needs to answer range requests.
+type ReadSeekCloser interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// NewReadSeekCloser converts a ReadAtCloser holding size bytes into a
+// ReadSeekCloser.
+func NewReadSeekCloser(r store.ReadAtCloser, size int64) ReadSeekCloser {
+	return &sectionCloser{
+		SectionReader: io.NewSectionReader(r, 0, size),
+		c:             r,
+	}
+}
+
+type sectionCloser struct {
+	*io.SectionReader
+	c io.Closer
+}
+
+func (sc *sectionCloser) Close() error {
+	return sc.c.Close()
+}
+
+// sniffLen is the number of bytes http.ServeContent reads to guess a content
+// type. It is the same value used by http.DetectContentType.
+const sniffLen = 512
+
+var errNegativeSeek = errors.New("seek to a negative position")
+
+// A streamSeeker provides seeking on top of a stream that can only be read
+// from its beginning, such as a blob inside a bundle on tape. Seeking forward
+// discards the skipped bytes. Seeking backward closes the stream and opens it
+// again. The first sniffLen bytes are remembered so the content type sniffing
+// done by http.ServeContent does not cause the stream to be reopened.
+type streamSeeker struct {
+	open func() (io.ReadCloser, error) // reopens the stream from the start
+	size int64                         // total length of the stream
+
+	r    io.ReadCloser // the current stream. nil if it needs to be opened.
+	pos  int64         // the offset r is positioned at
+	off  int64         // the offset the next Read should start at
+	head []byte        // up to the first sniffLen bytes of the stream
+}
+
+// newStreamSeeker returns a ReadSeekCloser using r, which is assumed to be
+// positioned at the beginning of a stream of the given size. The function
+// open is called whenever the stream needs to be started over.
+func newStreamSeeker(r io.ReadCloser, size int64, open func() (io.ReadCloser, error)) *streamSeeker {
+	return &streamSeeker{
+		open: open,
+		size: size,
+		r:    r,
+	}
+}
+
+func (ss *streamSeeker) Read(p []byte) (int, error) {
+	if ss.off >= ss.size {
+		return 0, io.EOF
+	}
+	// can this be answered from the saved head of the stream?
+	if ss.off < int64(len(ss.head)) && (ss.off < ss.pos || ss.r == nil) {
+		n := copy(p, ss.head[ss.off:])
+		ss.off += int64(n)
+		return n, nil
+	}
+	if ss.r == nil || ss.pos > ss.off {
+		if ss.r != nil {
+			ss.r.Close()
+			ss.r = nil
+		}
+		r, err := ss.open()
+		if err != nil {
+			return 0, err
+		}
+		ss.r = r
+		ss.pos = 0
+	}
+	if ss.pos < ss.off {
+		n, err := io.CopyN(ioutil.Discard, ss.r, ss.off-ss.pos)
+		ss.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := ss.r.Read(p)
+	if ss.pos == int64(len(ss.head)) && len(ss.head) < sniffLen {
+		extra := n
+		if len(ss.head)+extra > sniffLen {
+			extra = sniffLen - len(ss.head)
+		}
+		ss.head = append(ss.head, p[:extra]...)
+	}
+	ss.pos += int64(n)
+	ss.off += int64(n)
+	return n, err
+}
+
+func (ss *streamSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += ss.off
+	case io.SeekEnd:
+		offset += ss.size
+	default:
+		return ss.off, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return ss.off, errNegativeSeek
+	}
+	ss.off = offset
+	return offset, nil
+}
+
+func (ss *streamSeeker) Close() error {
+	if ss.r == nil {
+		return nil
+	}
+	err := ss.r.Close()
+	ss.r = nil
+	return err
+}
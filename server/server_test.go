@@ -1,7 +1,10 @@
 package server
 
 import (
+	"archive/tar"
+	"bytes"
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"io/ioutil"
@@ -9,9 +12,11 @@ import (
 	"net/http/httptest"
 	"path"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/ndlib/bendo/bagit"
 	"github.com/ndlib/bendo/blobcache"
 	"github.com/ndlib/bendo/fragment"
 	"github.com/ndlib/bendo/items"
@@ -188,9 +193,15 @@ func TestHeadCacheSHA(t *testing.T) {
 		t.Errorf("X-Content-Md5 expected %s, received %s", fileMd5HexSum, md5HexSum)
 	}
 
-	// get file twice and see if second time was cached
+	// get file twice and see if second time was cached. The first time the
+	// content is streamed while it is copied into the cache.
 	resp = checkRoute(t, "GET", "/item/"+itemid+"/testFile1", 200)
+	body, _ := ioutil.ReadAll(resp.Body)
 	resp.Body.Close()
+	if string(body) != fileContent || resp.Header.Get("X-Cached") != "0" {
+		t.Errorf("Received %q with X-Cached %q, expected %q uncached",
+			body, resp.Header.Get("X-Cached"), fileContent)
+	}
 	time.Sleep(10 * time.Millisecond) // sleep a squinch so the caching can happen
 	resp = checkRoute(t, "GET", "/item/"+itemid+"/testFile1", 200)
 	if resp == nil {
@@ -211,6 +222,426 @@ func TestHeadCacheSHA(t *testing.T) {
 	}
 }
 
+func TestChecksumRoutes(t *testing.T) {
+	// make the content unique since the blob index is shared by all the tests
+	content := "checksum test " + randomid()
+	sha := sha256.Sum256([]byte(content))
+	md := md5.Sum([]byte(content))
+	shahex := hex.EncodeToString(sha[:])
+	mdhex := hex.EncodeToString(md[:])
+
+	filePath := uploadstring(t, "POST", "/upload", content)
+	itemid := "checksum" + randomid()
+	txpath := sendtransaction(t, "/item/"+itemid+"/transaction",
+		[][]string{{"add", path.Base(filePath)}, {"slot", "a.txt", path.Base(filePath)}}, 202)
+	waitTransaction(t, txpath)
+
+	var table = []struct {
+		route  string
+		status int
+	}{
+		{"/item/" + itemid + "/@sha256/" + shahex, 200},
+		{"/item/" + itemid + "/@sha256/" + strings.ToUpper(shahex), 200},
+		{"/item/" + itemid + "/@md5/" + mdhex, 200},
+		{"/item/" + itemid + "/@md5/" + shahex, 404},
+		{"/item/" + itemid + "/@sha256/" + mdhex, 404},
+		{"/item/" + itemid + "/@sha256/zzz", 404},
+	}
+	for _, tab := range table {
+		body := getbody(t, "GET", tab.route, tab.status)
+		if tab.status == 200 && body != content {
+			t.Errorf("%s: received %q, expected %q", tab.route, body, content)
+		}
+	}
+
+	resp := checkRoute(t, "GET", "/blob/sha256/"+shahex, 200)
+	var refs []BlobRef
+	err := json.NewDecoder(resp.Body).Decode(&refs)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 1 || refs[0].Item != itemid || refs[0].Blob.ID != 1 {
+		t.Errorf("Received %v, expected blob 1 of %s", refs, itemid)
+	}
+	sha[0]++
+	checkStatus(t, "GET", "/blob/sha256/"+hex.EncodeToString(sha[:]), 404)
+	checkStatus(t, "GET", "/blob/sha256/"+mdhex, 400)
+}
+
+func TestVersionArchive(t *testing.T) {
+	// the second file is too large to be cached
+	var files = map[string]string{
+		"a.txt":     "first file",
+		"dir/b.txt": strings.Repeat("second file ", 10),
+	}
+	itemid := "archive" + randomid()
+	var commands [][]string
+	for name, content := range files {
+		filePath := uploadstring(t, "POST", "/upload", content)
+		commands = append(commands,
+			[]string{"add", path.Base(filePath)},
+			[]string{"slot", name, path.Base(filePath)})
+	}
+	txpath := sendtransaction(t, "/item/"+itemid+"/transaction", commands, 202)
+	waitTransaction(t, txpath)
+
+	body := getbody(t, "GET", "/item/"+itemid+"/@1.zip", 200)
+	bag, err := bagit.NewReader(strings.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bag.Verify()
+	if err != nil {
+		t.Error(err)
+	}
+	if bag.Tags()["External-Identifier"] != itemid {
+		t.Errorf("Received tags %v, expected identifier %s", bag.Tags(), itemid)
+	}
+	for name, content := range files {
+		rc, err := bag.Open(name)
+		if err != nil {
+			t.Error(name, err)
+			continue
+		}
+		data, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		if string(data) != content {
+			t.Errorf("%s: received %q, expected %q", name, data, content)
+		}
+	}
+
+	body = getbody(t, "GET", "/item/"+itemid+"/@1.tar", 200)
+	tr := tar.NewReader(strings.NewReader(body))
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, hdr.Name)
+	}
+	if len(names) != 7 || names[0] != itemid+"-v1/data/a.txt" {
+		t.Errorf("Received tar file containing %v", names)
+	}
+
+	checkStatus(t, "GET", "/item/"+itemid+"/@2.zip", 404)
+	checkStatus(t, "GET", "/item/"+itemid+"/@0.zip", 404)
+}
+
+func TestItemList(t *testing.T) {
+	// the item index is shared by all the tests, so use a unique prefix
+	prefix := "list" + randomid()
+	for _, suffix := range []string{"a", "b", "c"} {
+		filePath := uploadstring(t, "POST", "/upload", "item list "+suffix)
+		txpath := sendtransaction(t, "/item/"+prefix+suffix+"/transaction",
+			[][]string{{"add", path.Base(filePath)}, {"slot", "file", path.Base(filePath)}}, 202)
+		waitTransaction(t, txpath)
+	}
+
+	var table = []struct {
+		query string
+		ids   string
+		next  string
+	}{
+		{"prefix=" + prefix, "abc", ""},
+		{"prefix=" + prefix + "&limit=2", "ab", "b"},
+		{"prefix=" + prefix + "&limit=2&after=" + prefix + "b", "c", ""},
+		{"prefix=" + prefix + "&creator=nobody", "abc", ""},
+		{"prefix=" + prefix + "&creator=somebody", "", ""},
+		{"prefix=" + prefix + "&min_size=10", "abc", ""},
+		{"prefix=" + prefix + "&max_size=5", "", ""},
+		{"prefix=" + prefix + "&modified_after=2000-01-01", "abc", ""},
+		{"prefix=" + prefix + "&modified_before=2000-01-01", "", ""},
+	}
+	for _, tab := range table {
+		resp := checkRoute(t, "GET", "/item?"+tab.query, 200)
+		var list ItemList
+		err := json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if err != nil {
+			t.Error(tab.query, err)
+			continue
+		}
+		var ids string
+		for _, item := range list.Items {
+			ids += strings.TrimPrefix(item.ID, prefix)
+		}
+		next := strings.TrimPrefix(list.Next, prefix)
+		if ids != tab.ids || next != tab.next {
+			t.Errorf("%s: received (%s, %s), expected (%s, %s)",
+				tab.query, ids, next, tab.ids, tab.next)
+		}
+	}
+
+	checkStatus(t, "GET", "/item?limit=0", 400)
+	checkStatus(t, "GET", "/item?min_size=abc", 400)
+	checkStatus(t, "GET", "/item?modified_after=yesterday", 400)
+}
+
+func TestVersionDiff(t *testing.T) {
+	itemid := "diff" + randomid()
+	first := uploadstring(t, "POST", "/upload", "diff one")
+	second := uploadstring(t, "POST", "/upload", "diff two")
+	txpath := sendtransaction(t, "/item/"+itemid+"/transaction",
+		[][]string{{"add", path.Base(first)}, {"slot", "a", path.Base(first)}}, 202)
+	waitTransaction(t, txpath)
+	txpath = sendtransaction(t, "/item/"+itemid+"/transaction",
+		[][]string{
+			{"add", path.Base(second)},
+			{"slot", "b", path.Base(second)},
+			{"slot", "c", "1"},
+			{"slot", "a", "0"},
+		}, 202)
+	waitTransaction(t, txpath)
+
+	resp := checkRoute(t, "GET", "/item/"+itemid+"/@diff/1/2", 200)
+	var diff items.VersionDiff
+	err := json.NewDecoder(resp.Body).Decode(&diff)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Added) != 1 || diff.Added[0].Slot != "b" || diff.Added[0].New.Size != 8 {
+		t.Errorf("Received added %v, expected b", diff.Added)
+	}
+	if len(diff.Renamed) != 1 || diff.Renamed[0].Slot != "c" || diff.Renamed[0].OldSlot != "a" {
+		t.Errorf("Received renamed %v, expected a to c", diff.Renamed)
+	}
+	if len(diff.Removed) != 0 || len(diff.Modified) != 0 {
+		t.Errorf("Received %v, expected no removed or modified entries", diff)
+	}
+
+	// without the JSON header we should get HTML
+	resp = getWithHeader(t, "/item/"+itemid+"/@diff/2/1", "", "")
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "c &rarr; a") {
+		t.Errorf("Received %s, expected it to contain a rename", body)
+	}
+	checkStatus(t, "GET", "/item/"+itemid+"/@diff/1/3", 404)
+	checkStatus(t, "GET", "/item/"+itemid+"/@diff/1", 404)
+}
+
+func TestMetrics(t *testing.T) {
+	// make sure there is at least one request recorded
+	checkStatus(t, "GET", "/item/not-an-item-"+randomid(), 404)
+
+	body := getbody(t, "GET", "/metrics", 200)
+	for _, want := range []string{
+		`bendo_http_request_duration_seconds_bucket{route="/item/:id",method="GET",status="404",le="+Inf"}`,
+		`bendo_http_request_duration_seconds_count{route="/item/:id",method="GET",status="404"}`,
+		"# TYPE bendo_http_request_duration_seconds histogram",
+		"bendo_cache_hits_total ",
+		"bendo_cache_max_bytes 400\n",
+		"bendo_tape_enabled 1\n",
+		"bendo_transaction_queue_depth ",
+		"bendo_fixity_backlog ",
+		"bendo_upload_bytes ",
+		"bendo_items ",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("Expected metrics to contain %q", want)
+		}
+	}
+
+	resp := checkRoute(t, "GET", "/stats", 200)
+	var stats ServerStats
+	err := json.NewDecoder(resp.Body).Decode(&stats)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.CacheMaxSize != 400 || !stats.TapeEnabled {
+		t.Errorf("Received %v", stats)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	var buf lockedBuffer
+	accessLogOutput = &buf
+	defer func() { accessLogOutput = nil }()
+
+	// a valid request id is passed through
+	resp := getWithHeader(t, "/blob/sha256/zz", "X-Request-Id", "abc-123")
+	resp.Body.Close()
+	if id := resp.Header.Get("X-Request-Id"); id != "abc-123" {
+		t.Errorf("Received request id %q, expected %q", id, "abc-123")
+	}
+	// an invalid one is replaced
+	resp = getWithHeader(t, "/blob/sha256/zz", "X-Request-Id", "abc 123")
+	resp.Body.Close()
+	if id := resp.Header.Get("X-Request-Id"); id == "" || id == "abc 123" {
+		t.Errorf("Received request id %q, expected a new one", id)
+	}
+
+	// the log line is written as the handler exits, which may be after
+	// the client has the response.
+	var entry accessEntry
+	for i := 0; i < 10; i++ {
+		line := strings.SplitN(buf.String(), "\n", 2)[0]
+		if line != "" {
+			err := json.Unmarshal([]byte(line), &entry)
+			if err != nil {
+				t.Fatal(line, err)
+			}
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if entry.RequestID != "abc-123" ||
+		entry.Route != "/blob/sha256/:hex" ||
+		entry.Status != 400 ||
+		entry.Bytes == 0 {
+		t.Errorf("Received log entry %+v", entry)
+	}
+}
+
+func TestReloadNotSupported(t *testing.T) {
+	checkStatus(t, "POST", "/admin/reload", 501)
+}
+
+func TestRangeRequest(t *testing.T) {
+	// the test cache holds 400 bytes, so the first blob is cached and the
+	// second one is too large and is read from the bundle every time.
+	const small = "0123456789abcdefghijklmnopqrstuvwxyz"
+	var large = strings.Repeat(small, 5)
+
+	blob1 := uploadstring(t, "POST", "/upload", small)
+	blob2 := uploadstring(t, "POST", "/upload", large)
+	itemid := "range" + randomid()
+	txpath := sendtransaction(t, "/item/"+itemid+"/transaction",
+		[][]string{{"add", path.Base(blob1)},
+			{"slot", "small", path.Base(blob1)},
+			{"add", path.Base(blob2)},
+			{"slot", "large", path.Base(blob2)}}, 202)
+	waitTransaction(t, txpath)
+	waitCached(t, itemid, "small")
+
+	var table = []struct {
+		slot    string
+		ranges  string
+		status  int
+		content string
+	}{
+		{"small", "bytes=0-9", 206, small[0:10]},
+		{"small", "bytes=30-", 206, small[30:]},
+		{"small", "bytes=-4", 206, small[32:]},
+		{"small", "bytes=100-", 416, ""},
+		{"large", "bytes=0-9", 206, large[0:10]},
+		{"large", "bytes=150-", 206, large[150:]},
+		{"large", "bytes=-10", 206, large[170:]},
+		{"large", "", 200, large},
+	}
+	for _, tab := range table {
+		resp := getWithHeader(t, "/item/"+itemid+"/"+tab.slot, "Range", tab.ranges)
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tab.status {
+			t.Errorf("%s %s: Received status %d, expected %d", tab.slot, tab.ranges, resp.StatusCode, tab.status)
+			continue
+		}
+		if tab.status < 300 && string(body) != tab.content {
+			t.Errorf("%s %s: Received %q, expected %q", tab.slot, tab.ranges, body, tab.content)
+		}
+	}
+
+	// multiple ranges are returned as a multipart response, including ones
+	// which require seeking backwards in the large blob.
+	for _, slot := range []string{"small", "large"} {
+		resp := getWithHeader(t, "/item/"+itemid+"/"+slot, "Range", "bytes=20-24,0-4")
+		resp.Body.Close()
+		if resp.StatusCode != 206 {
+			t.Errorf("%s: Received status %d, expected 206", slot, resp.StatusCode)
+		}
+		ctype := resp.Header.Get("Content-Type")
+		if !strings.HasPrefix(ctype, "multipart/byteranges") {
+			t.Errorf("%s: Received Content-Type %q, expected multipart/byteranges", slot, ctype)
+		}
+	}
+
+	// a stale If-Range causes the entire blob to be returned
+	req, _ := http.NewRequest("GET", testServer.URL+"/item/"+itemid+"/small", nil)
+	req.Header.Set("Range", "bytes=0-9")
+	req.Header.Set("If-Range", `"1000"`)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("If-Range: Received status %d, expected 200", resp.StatusCode)
+	}
+}
+
+func TestConditionalGet(t *testing.T) {
+	blob1 := uploadstring(t, "POST", "/upload", "<html><body>hello</body></html>")
+	itemid := "conditional" + randomid()
+	txpath := sendtransaction(t, "/item/"+itemid+"/transaction",
+		[][]string{{"add", path.Base(blob1)},
+			{"slot", "docs/hello world.txt", path.Base(blob1)}}, 202)
+	waitTransaction(t, txpath)
+
+	// headers are derived from the slot name
+	resp := checkRoute(t, "HEAD", "/item/"+itemid+"/docs/hello%20world.txt", 200)
+	if resp == nil {
+		t.Fatal("Unexpected nil response")
+	}
+	resp.Body.Close()
+	var expected = map[string]string{
+		"ETag":                `"1"`,
+		"Content-Type":        "text/plain; charset=utf-8",
+		"Content-Disposition": `inline; filename="hello world.txt"`,
+		"Cache-Control":       cacheRevalidate,
+	}
+	for header, value := range expected {
+		if v := resp.Header.Get(header); v != value {
+			t.Errorf("%s: Received %q, expected %q", header, v, value)
+		}
+	}
+	lastmod := resp.Header.Get("Last-Modified")
+	if lastmod == "" {
+		t.Error("No Last-Modified header")
+	}
+
+	// content referenced by blob number is immutable
+	resp = checkRoute(t, "HEAD", "/item/"+itemid+"/@blob/1", 200)
+	if resp == nil {
+		t.Fatal("Unexpected nil response")
+	}
+	resp.Body.Close()
+	if v := resp.Header.Get("Cache-Control"); v != cacheImmutable {
+		t.Errorf("Cache-Control: Received %q, expected %q", v, cacheImmutable)
+	}
+	if v := resp.Header.Get("Content-Disposition"); v != "" {
+		t.Errorf("Content-Disposition: Received %q, expected none", v)
+	}
+
+	var table = []struct {
+		route  string
+		header string
+		value  string
+		status int
+	}{
+		{"/item/" + itemid + "/@blob/1", "If-None-Match", `"1"`, 304},
+		{"/item/" + itemid + "/@blob/1", "If-None-Match", `"2", W/"1"`, 304},
+		{"/item/" + itemid + "/@blob/1", "If-None-Match", `"2"`, 200},
+		{"/item/" + itemid + "/@blob/1", "If-Modified-Since", lastmod, 304},
+		{"/item/" + itemid + "/@blob/1", "If-Modified-Since", "Mon, 02 Jan 2006 15:04:05 GMT", 200},
+		{"/item/" + itemid, "If-None-Match", `"1"`, 304},
+		{"/item/" + itemid, "If-None-Match", `"2"`, 200},
+		{"/item/" + itemid, "If-Modified-Since", lastmod, 304},
+	}
+	for _, tab := range table {
+		resp := getWithHeader(t, tab.route, tab.header, tab.value)
+		resp.Body.Close()
+		if resp.StatusCode != tab.status {
+			t.Errorf("%s %s: %s: Received status %d, expected %d",
+				tab.route, tab.header, tab.value, resp.StatusCode, tab.status)
+		}
+	}
+}
+
 func TestFixityHandler(t *testing.T) {
 	// DLTP-1199: does empty fixity search return "[]" and not "null"?
 	body := getbody(t, "GET", "/fixity?start=2018-12-18&end=2018-12-17", 200)
@@ -307,6 +738,41 @@ func checkRoute(t *testing.T, verb, route string, expstatus int) *http.Response
 	return resp
 }
 
+// getWithHeader does a GET request to route with the given header set, if
+// value is not empty.
+func getWithHeader(t *testing.T, route, header, value string) *http.Response {
+	req, err := http.NewRequest("GET", testServer.URL+route, nil)
+	if err != nil {
+		t.Fatal("Problem creating request", err)
+	}
+	if value != "" {
+		req.Header.Set(header, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(route, err)
+	}
+	return resp
+}
+
+// lockedBuffer is a bytes.Buffer that can be written to concurrently.
+type lockedBuffer struct {
+	m sync.Mutex
+	b bytes.Buffer
+}
+
+func (lb *lockedBuffer) Write(p []byte) (int, error) {
+	lb.m.Lock()
+	defer lb.m.Unlock()
+	return lb.b.Write(p)
+}
+
+func (lb *lockedBuffer) String() string {
+	lb.m.Lock()
+	defer lb.m.Unlock()
+	return lb.b.String()
+}
+
 // waitTransaction doesn't return until the given txpath
 // is done processing, either because of success or error,
 // or 100 ms have passed.
@@ -336,11 +802,14 @@ func init() {
 	db, _ := NewQlCache("memory--server")
 	server := &RESTServer{
 		Validator:      NobodyValidator{},
-		Items:          items.NewWithCache(store.NewMemory(), items.NewMemoryCache()),
+		Items:          items.NewWithCache(store.NewMemory(), db),
 		TxStore:        transaction.New(store.NewMemory()),
 		FileStore:      fragment.New(store.NewMemory()),
 		Cache:          blobcache.NewLRU(store.NewMemory(), 400),
 		FixityDatabase: db,
+		BlobDatabase:   db,
+		TokenDatabase:  db,
+		AuditDatabase:  db,
 		useTape:        true,
 	}
 	server.txqueue = make(chan string)
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const (
+	// the lifetime of a signed URL if none is given
+	defaultSignedURLLifetime = time.Hour
+
+	// the longest lifetime a signed URL may have
+	maxSignedURLLifetime = 7 * 24 * time.Hour
+)
+
+// A SignedURL is returned when a signed URL is made.
+type SignedURL struct {
+	URL     string // the path and query, relative to this server
+	Expires time.Time
+}
+
+// SignURLHandler handles requests to POST /sign/item/:id/*slot
+//
+// It returns a URL for GET /item/:id/*slot which does not need an API key,
+// and which stops working after the duration given by the "expires"
+// parameter. The slot may be anything SlotHandler accepts, such as
+// "@blob/nnn". Requests using the URL are made as the user signing it, but
+// with at most the read role. The URL keeps working until it expires, even if
+// the token which signed it is revoked in the meantime.
+func (s *RESTServer) SignURLHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if len(s.SigningKey) == 0 {
+		w.WriteHeader(501)
+		fmt.Fprintln(w, "URL signing is not configured")
+		return
+	}
+	slot := ps.ByName("slot")
+	if slot == "/" {
+		w.WriteHeader(400)
+		fmt.Fprintln(w, "No slot given")
+		return
+	}
+	lifetime := defaultSignedURLLifetime
+	if v := r.FormValue("expires"); v != "" {
+		var err error
+		lifetime, err = time.ParseDuration(v)
+		if err != nil || lifetime <= 0 || lifetime > maxSignedURLLifetime {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "Bad expires value %q. It must be a duration of at most %s\n",
+				v, maxSignedURLLifetime)
+			return
+		}
+	}
+	path := "/item/" + ps.ByName("id") + slot
+	user := ps.ByName("username")
+	expires := time.Now().Add(lifetime).Truncate(time.Second)
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("user", user)
+	query.Set("signature", s.signURL(path, expires.Unix(), user))
+	u := url.URL{Path: path, RawQuery: query.Encode()}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(SignedURL{URL: u.String(), Expires: expires})
+}
+
+// signURL returns the signature for a URL having the given path, expiry
+// time, and user, encoded in hex. The path and user are prefixed with their
+// lengths, since either may contain any character, so no choice of path can
+// shift part of it into the other fields.
+func (s *RESTServer) signURL(path string, expires int64, user string) string {
+	mac := hmac.New(sha256.New, s.SigningKey)
+	fmt.Fprintf(mac, "%d:%s\n%d\n%d:%s", len(path), path, expires, len(user), user)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifySignedURL checks whether r was made using a URL from SignURLHandler
+// that has not expired. If so it returns the user who signed it and the read
+// role. Otherwise it returns the user "" and RoleUnknown.
+func (s *RESTServer) verifySignedURL(r *http.Request) (string, Role) {
+	query := r.URL.Query()
+	signature := query.Get("signature")
+	if len(s.SigningKey) == 0 || signature == "" {
+		return "", RoleUnknown
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return "", RoleUnknown
+	}
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", RoleUnknown
+	}
+	user := query.Get("user")
+	expected := s.signURL(r.URL.Path, expires, user)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return "", RoleUnknown
+	}
+	return user, RoleRead
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestSignedURL(t *testing.T) {
+	v, _ := NewListValidatorString("reader read 1234\n")
+	s := &RESTServer{
+		Validator:  v,
+		SigningKey: []byte("secret"),
+	}
+	var gotUser string
+	content := s.authzWrapper(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		gotUser = ps.ByName("username")
+	}, RoleRead)
+	sign := s.authzWrapper(s.SignURLHandler, RoleRead)
+
+	// make a signed URL
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/sign/item/abc/@blob/2?expires=10m", nil)
+	r.Header.Set("X-Api-Key", "1234")
+	sign(w, r, httprouter.Params{{Key: "id", Value: "abc"}, {Key: "slot", Value: "/@blob/2"}})
+	if w.Code != 200 {
+		t.Fatalf("Received status %d, expected 200", w.Code)
+	}
+	var signed SignedURL
+	err := json.NewDecoder(w.Body).Decode(&signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(signed.URL, "/item/abc/@blob/2?") {
+		t.Errorf("Received URL %q", signed.URL)
+	}
+	if d := time.Until(signed.Expires); d < 9*time.Minute || d > 10*time.Minute {
+		t.Errorf("Received expiry %v", signed.Expires)
+	}
+
+	expired := strings.Replace(signed.URL,
+		"expires="+strconv.FormatInt(signed.Expires.Unix(), 10),
+		"expires="+strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10), 1)
+	var table = []struct {
+		method string
+		url    string
+		status int
+	}{
+		{"GET", signed.URL, 200},
+		{"HEAD", signed.URL, 200},
+		{"DELETE", signed.URL, 401},
+		{"GET", strings.Replace(signed.URL, "@blob/2", "@blob/3", 1), 401},
+		{"GET", strings.Replace(signed.URL, "user=reader", "user=admin", 1), 401},
+		{"GET", expired, 401},
+		{"GET", "/item/abc/@blob/2", 401},
+	}
+	for _, tab := range table {
+		gotUser = ""
+		w := httptest.NewRecorder()
+		content(w, httptest.NewRequest(tab.method, tab.url, nil), nil)
+		if w.Code != tab.status {
+			t.Errorf("%s %s: received status %d, expected %d",
+				tab.method, tab.url, w.Code, tab.status)
+		}
+		if tab.status == 200 && gotUser != "reader" {
+			t.Errorf("%s %s: received user %q, expected %q",
+				tab.method, tab.url, gotUser, "reader")
+		}
+	}
+
+	// bad expiry durations
+	for _, expires := range []string{"xyz", "-1h", "1000h"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/sign/item/abc/a?expires="+expires, nil)
+		r.Header.Set("X-Api-Key", "1234")
+		sign(w, r, httprouter.Params{{Key: "id", Value: "abc"}, {Key: "slot", Value: "/a"}})
+		if w.Code != 400 {
+			t.Errorf("expires=%s: received status %d, expected 400", expires, w.Code)
+		}
+	}
+}
+
+func TestSignURLFields(t *testing.T) {
+	s := &RESTServer{SigningKey: []byte("secret")}
+	// moving text between the fields must change the signature
+	a := s.signURL("/item/abc\n1", 2, "reader")
+	b := s.signURL("/item/abc", 1, "2\nreader")
+	if a == b {
+		t.Errorf("Different fields have the same signature")
+	}
+}
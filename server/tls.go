@@ -0,0 +1,170 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A CertReloader keeps a TLS certificate and key loaded from files, and loads
+// them again when the files change, for example when the certificate is
+// renewed. Use its GetCertificate method in a tls.Config.
+type CertReloader struct {
+	CertFile string
+	KeyFile  string
+
+	m       sync.RWMutex
+	cert    *tls.Certificate
+	modtime time.Time // the latest modification time of the files when loaded
+	checked time.Time // when the files were last checked for changes
+}
+
+// how often to check whether the certificate files have changed.
+var certCheckInterval = time.Minute
+
+// NewCertReloader returns a CertReloader for the given certificate and key
+// files, which are in PEM format. It returns an error if they cannot be
+// loaded.
+func NewCertReloader(certfile, keyfile string) (*CertReloader, error) {
+	cr := &CertReloader{CertFile: certfile, KeyFile: keyfile}
+	err := cr.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// Reload loads the certificate and key files. If there is an error the
+// previous certificate is kept.
+func (cr *CertReloader) Reload() error {
+	modtime, err := cr.filesModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.CertFile, cr.KeyFile)
+	if err != nil {
+		return err
+	}
+	cr.m.Lock()
+	cr.cert = &cert
+	cr.modtime = modtime
+	cr.checked = time.Now()
+	cr.m.Unlock()
+	return nil
+}
+
+// filesModified returns the latest modification time of the two files.
+func (cr *CertReloader) filesModified() (time.Time, error) {
+	var latest time.Time
+	for _, fname := range []string{cr.CertFile, cr.KeyFile} {
+		info, err := os.Stat(fname)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// GetCertificate returns the current certificate. It has the signature needed
+// for the GetCertificate field of a tls.Config. Every so often the files are
+// checked, and are loaded again if they have changed.
+func (cr *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.m.RLock()
+	cert := cr.cert
+	check := time.Since(cr.checked) >= certCheckInterval
+	modtime := cr.modtime
+	cr.m.RUnlock()
+	if !check {
+		return cert, nil
+	}
+	cr.m.Lock()
+	cr.checked = time.Now()
+	cr.m.Unlock()
+	latest, err := cr.filesModified()
+	if err == nil && latest.After(modtime) {
+		log.Println("Loading changed TLS certificate", cr.CertFile)
+		err = cr.Reload()
+		if err == nil {
+			cr.m.RLock()
+			cert = cr.cert
+			cr.m.RUnlock()
+		}
+	}
+	if err != nil {
+		// keep using the certificate we have
+		log.Println("TLS certificate:", err)
+	}
+	return cert, nil
+}
+
+// NewSubjectValidator returns a TokenValidator which maps the subjects of
+// client certificates to users. The reader r should consist of a sequence of
+// entries, separated by newlines. Each entry has the form:
+//
+//	<user name>  <role>  <subject>
+//
+// The user name and the role are the same as in NewListValidator. The subject
+// is the rest of the line, and is the distinguished name of the certificate in
+// the form given by the String method of pkix.Name, e.g.
+//
+//	ingest  write  CN=ingest1.library.example.edu,O=Example University,C=US
+//
+// Empty lines and lines beginning with a hash '#' are skipped.
+func NewSubjectValidator(r io.Reader) (TokenValidator, error) {
+	subjects := make(subjectValidator)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		pieces := strings.Fields(line)
+		if len(pieces) < 3 {
+			continue
+		}
+		// the subject may contain spaces, so it is the rest of the line
+		subject := strings.TrimSpace(strings.TrimPrefix(line, pieces[0]))
+		subject = strings.TrimSpace(strings.TrimPrefix(subject, pieces[1]))
+		subjects[subject] = userEntry{user: pieces[0], role: AtoRole(pieces[1])}
+	}
+	return subjects, scanner.Err()
+}
+
+// NewSubjectValidatorFile reads the given file into a validator using
+// NewSubjectValidator.
+func NewSubjectValidatorFile(fname string) (TokenValidator, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return NewSubjectValidator(f)
+}
+
+type subjectValidator map[string]userEntry
+
+func (sv subjectValidator) TokenValid(subject string) (string, Role, error) {
+	if entry, ok := sv[subject]; ok {
+		return entry.user, entry.role, nil
+	}
+	return "", RoleUnknown, nil
+}
+
+// certUser returns the user and role for the verified client certificate of
+// r, if there is one and there is a CertValidator.
+func (s *RESTServer) certUser(r *http.Request) (string, Role, error) {
+	v := s.certValidator()
+	if v == nil || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", RoleUnknown, nil
+	}
+	return v.TokenValid(r.TLS.VerifiedChains[0][0].Subject.String())
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bendo-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certfile := filepath.Join(dir, "cert.pem")
+	keyfile := filepath.Join(dir, "key.pem")
+
+	first := makeCert(t, "first", nil)
+	writeCert(t, first, certfile, keyfile)
+	cr, err := NewCertReloader(certfile, keyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := cr.GetCertificate(nil)
+	leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+	if leaf.Subject.CommonName != "first" {
+		t.Errorf("Received certificate for %s", leaf.Subject.CommonName)
+	}
+
+	// renew the certificate
+	defer func(d time.Duration) { certCheckInterval = d }(certCheckInterval)
+	certCheckInterval = 0
+	second := makeCert(t, "second", nil)
+	writeCert(t, second, certfile, keyfile)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certfile, later, later)
+	cert, _ = cr.GetCertificate(nil)
+	leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	if leaf.Subject.CommonName != "second" {
+		t.Errorf("Received certificate for %s after renewal", leaf.Subject.CommonName)
+	}
+
+	// a bad file keeps the current certificate
+	ioutil.WriteFile(keyfile, []byte("not a key"), 0600)
+	later = later.Add(time.Minute)
+	os.Chtimes(keyfile, later, later)
+	cert, _ = cr.GetCertificate(nil)
+	leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	if leaf.Subject.CommonName != "second" {
+		t.Errorf("Received certificate for %s after a bad key", leaf.Subject.CommonName)
+	}
+}
+
+func TestClientCert(t *testing.T) {
+	ca := makeCert(t, "Test CA", nil)
+	ingest := makeCert(t, "ingest", ca)
+	stranger := makeCert(t, "stranger", ca)
+	selfsigned := makeCert(t, "ingest", nil)
+
+	v, err := NewSubjectValidator(strings.NewReader(`# users
+	ingester  write  CN=ingest,O=Example University
+	`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, _ := NewListValidatorString("tokenuser read 1234")
+	s := &RESTServer{Validator: tokens, CertValidator: v}
+	var gotUser string
+	handler := s.authzWrapper(func(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+		gotUser = ps.ByName("username")
+	}, RoleRead)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler(w, r, nil)
+	}))
+	ts.TLS = &tls.Config{
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		ClientCAs:  x509.NewCertPool(),
+	}
+	ts.TLS.ClientCAs.AddCert(ca.Leaf)
+	ts.StartTLS()
+	defer ts.Close()
+
+	var table = []struct {
+		cert   *tls.Certificate
+		token  string
+		status int
+		user   string
+	}{
+		{ingest, "", 200, "ingester"},
+		{ingest, "1234", 200, "tokenuser"}, // the token is used first
+		{stranger, "", 401, ""},
+		{nil, "", 401, ""},
+	}
+	for i, tab := range table {
+		client := clientWithCert(ts, tab.cert)
+		req, _ := http.NewRequest("GET", ts.URL, nil)
+		if tab.token != "" {
+			req.Header.Set("X-Api-Key", tab.token)
+		}
+		gotUser = ""
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%d: %s", i, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tab.status || gotUser != tab.user {
+			t.Errorf("%d: received %d, %q, expected %d, %q",
+				i, resp.StatusCode, gotUser, tab.status, tab.user)
+		}
+	}
+
+	// a certificate not signed by the CA is not used, even though it has
+	// the right subject
+	gotUser = ""
+	client := clientWithCert(ts, selfsigned)
+	if resp, err := client.Get(ts.URL); err == nil {
+		resp.Body.Close()
+		if resp.StatusCode != 401 || gotUser != "" {
+			t.Errorf("Self signed certificate was accepted for %q", gotUser)
+		}
+	}
+}
+
+// clientWithCert returns a new client for the test server ts which uses the
+// given client certificate, if it is not nil.
+func clientWithCert(ts *httptest.Server, cert *tls.Certificate) *http.Client {
+	tr := ts.Client().Transport.(*http.Transport).Clone()
+	if cert != nil {
+		tr.TLSClientConfig.Certificates = []tls.Certificate{*cert}
+	}
+	return &http.Client{Transport: tr}
+}
+
+// makeCert returns a new certificate with the given common name, signed by
+// parent. If parent is nil, the certificate is a self signed CA.
+func makeCert(t *testing.T, name string, parent *tls.Certificate) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name, Organization: []string{"Example University"}},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, interface{}(key)
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// writeCert writes cert and its key to the given files in PEM format.
+func writeCert(t *testing.T, cert *tls.Certificate, certfile, keyfile string) {
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(certfile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	if err == nil {
+		err = ioutil.WriteFile(keyfile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: key}), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
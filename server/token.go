@@ -2,9 +2,12 @@ package server
 
 import (
 	"bufio"
+	"fmt"
 	"io"
+	"log"
 	"os"
 	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -47,6 +50,35 @@ func AtoRole(s string) Role {
 	}
 }
 
+// String returns the name of the role, in the form accepted by AtoRole.
+// RoleUnknown is "unknown".
+func (r Role) String() string {
+	switch r {
+	case RoleMDOnly:
+		return "mdonly"
+	case RoleRead:
+		return "read"
+	case RoleWrite:
+		return "write"
+	case RoleAdmin:
+		return "admin"
+	default:
+		return "unknown"
+	}
+}
+
+// MarshalText encodes the role as its name, so it appears as a string in
+// JSON.
+func (r Role) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalText decodes a role name, as given by AtoRole.
+func (r *Role) UnmarshalText(text []byte) error {
+	*r = AtoRole(string(text))
+	return nil
+}
+
 // A NobodyValidator is a TokenValidator that for every possible token
 // returns a user named "nobody" with the Admin role.
 type NobodyValidator struct{}
@@ -75,13 +107,30 @@ func (InvalidValidator) TokenValid(token string) (string, Role, error) {
 // not permit spaces in either the user name or the token. The role is one of
 // "MDOnly", "Read", "Write", "Admin" (case insensitive). Empty lines and lines
 // beginning with a hash '#' are skipped.
+//
+// An entry may be followed by request limits for the user, each of the form
+// <name>=<value>. The names are "concurrent", "rate", "burst", and "tape",
+// corresponding to the fields of a Limit. For example
+//
+//     harvester  read  abc123  concurrent=4 rate=2.5 tape=1
+//
+// The limits apply to the requests made with that token, so each token of a
+// user is limited separately.
+//
+// An entry may also limit its token to some items with the option
+// items=<patterns>, where the patterns are separated by commas. See Scope.
+// For example
+//
+//     etdloader  write  def456  items=und:etd*,und:thesis*
+//
+// Entries having a malformed option are skipped.
 func NewListValidator(r io.Reader) (TokenValidator, error) {
 	users, err := parseListFile(r)
 	if err != nil {
 		return nil, err
 	}
 	sort.Sort(byToken(users))
-	return listValidator{users}, nil
+	return listValidator{data: users}, nil
 }
 
 // NewListValidatorFile is a convenience function that reads the contents of
@@ -113,21 +162,72 @@ func parseListFile(r io.Reader) ([]userEntry, error) {
 		if len(pieces) == 0 || pieces[0][0] == '#' {
 			continue
 		}
-		if len(pieces) != 3 {
+		if len(pieces) < 3 {
 			// wrong number of columns
 			continue
 		}
+		var limit *Limit
+		var scope Scope
+		for _, option := range pieces[3:] {
+			if strings.HasPrefix(strings.ToLower(option), "items=") {
+				scope = ParseScope(option[len("items="):])
+				if scope == nil {
+					// an empty list must not allow every item
+					scope = Scope{}
+				}
+				continue
+			}
+			if limit == nil {
+				limit = new(Limit)
+			}
+			err := parseLimitOption(limit, option)
+			if err != nil {
+				// skip the line, the same as a wrong number of columns
+				log.Printf("Token file: user %s: %s", pieces[0], err)
+				goto skip
+			}
+		}
 		result = append(result, userEntry{
 			token: pieces[2],
 			user:  pieces[0],
 			role:  AtoRole(pieces[1]),
+			limit: limit,
+			scope: scope,
 		})
+	skip:
 	}
 	return result, scanner.Err()
 }
 
+// parseLimitOption sets the field of limit given by option, which has the
+// form "name=value".
+func parseLimitOption(limit *Limit, option string) error {
+	var err error
+	i := strings.IndexByte(option, '=')
+	if i == -1 {
+		return fmt.Errorf("bad limit %q", option)
+	}
+	value := option[i+1:]
+	switch strings.ToLower(option[:i]) {
+	case "concurrent":
+		limit.Concurrent, err = strconv.Atoi(value)
+	case "rate":
+		limit.Rate, err = strconv.ParseFloat(value, 64)
+	case "burst":
+		limit.Burst, err = strconv.Atoi(value)
+	case "tape":
+		limit.TapeReads, err = strconv.Atoi(value)
+	default:
+		return fmt.Errorf("unknown limit %q", option)
+	}
+	if err != nil {
+		return fmt.Errorf("bad limit %q", option)
+	}
+	return nil
+}
+
 type listValidator struct {
-	data []userEntry
+	data []userEntry // sorted by token
 }
 
 type byToken []userEntry
@@ -140,13 +240,35 @@ type userEntry struct {
 	token string
 	user  string
 	role  Role
+	limit *Limit // nil if no limits were given
+	scope Scope  // nil if the token is not limited to some items
 }
 
 func (ld listValidator) TokenValid(token string) (string, Role, error) {
+	user, role, _, err := ld.TokenScope(token)
+	return user, role, err
+}
+
+func (ld listValidator) TokenScope(token string) (string, Role, Scope, error) {
+	if u := ld.find(token); u != nil {
+		return u.user, u.role, u.scope, nil
+	}
+	return "", RoleUnknown, nil, nil
+}
+
+func (ld listValidator) TokenLimit(token string) (Limit, bool) {
+	if u := ld.find(token); u != nil && u.limit != nil {
+		return *u.limit, true
+	}
+	return Limit{}, false
+}
+
+// find returns the entry for the given token, or nil if there is none.
+func (ld listValidator) find(token string) *userEntry {
 	users := ld.data
 	i := sort.Search(len(users), func(i int) bool { return users[i].token >= token })
 	if i < len(users) && users[i].token == token {
-		return users[i].user, users[i].role, nil
+		return &users[i]
 	}
-	return "", RoleUnknown, nil
+	return nil
 }
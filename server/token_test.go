@@ -1,6 +1,7 @@
 package server
 
 import (
+	"reflect"
 	"strings"
 	"testing"
 )
@@ -117,12 +118,66 @@ func TestParseListFile(t *testing.T) {
 	}
 }
 
+func TestListLimits(t *testing.T) {
+	d, err := NewListValidatorString(`a  read  123  concurrent=4 rate=2.5 tape=1
+	b write 234
+	c read 345 speed=5`)
+	if err != nil {
+		t.Fatalf("Received %s", err.Error())
+	}
+	tl, ok := d.(TokenLimiter)
+	if !ok {
+		t.Fatal("list validator is not a TokenLimiter")
+	}
+	limit, ok := tl.TokenLimit("123")
+	if !ok || limit != (Limit{Concurrent: 4, Rate: 2.5, TapeReads: 1}) {
+		t.Errorf("Received %v, %v for token 123", limit, ok)
+	}
+	if _, ok := tl.TokenLimit("234"); ok {
+		t.Errorf("Received a limit for token 234")
+	}
+	// lines with bad limits are skipped
+	if user, _, _ := d.TokenValid("345"); user != "" {
+		t.Errorf("Received user %q for a token with a bad limit", user)
+	}
+}
+
+func TestListScopes(t *testing.T) {
+	d, err := NewListValidatorString(`a  write  123  items=und:etd*,und:x?? concurrent=2
+	b write 234
+	c write 345 items=`)
+	if err != nil {
+		t.Fatalf("Received %s", err.Error())
+	}
+	var table = []struct {
+		token string
+		item  string
+		ok    bool
+	}{
+		{"123", "und:etd1234", true},
+		{"123", "und:xyz", true},
+		{"123", "und:xyzw", false},
+		{"123", "und:abc", false},
+		{"234", "und:abc", true},
+		{"345", "und:abc", false},
+	}
+	for _, tab := range table {
+		_, _, scope, _ := tokenScope(d, tab.token)
+		if scope.Allows(tab.item) != tab.ok {
+			t.Errorf("Token %s, item %s: expected %v", tab.token, tab.item, tab.ok)
+		}
+	}
+	if limit, _ := d.(TokenLimiter).TokenLimit("123"); limit.Concurrent != 2 {
+		t.Errorf("Received limit %v for token 123", limit)
+	}
+}
+
 func userEntryEqual(a, b []userEntry) bool {
 	if len(a) != len(b) {
 		return false
 	}
 	for i := range a {
-		if a[i] != b[i] {
+		if !reflect.DeepEqual(a[i], b[i]) {
 			return false
 		}
 	}
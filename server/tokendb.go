@@ -0,0 +1,324 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	raven "github.com/getsentry/raven-go"
+	"github.com/julienschmidt/httprouter"
+)
+
+// A TokenRecord is an API token kept in the database. Only a hash of the
+// token itself is saved.
+type TokenRecord struct {
+	ID       int64
+	User     string
+	Role     Role
+	Scope    Scope  // nil if the token is not limited to some items
+	Hash     string `json:"-"` // hex encoded SHA-256 of the token
+	Created  time.Time
+	Creator  string    // the user who made the token
+	Expires  time.Time // zero if the token does not expire
+	LastUsed time.Time // zero if the token has not been used
+	Disabled bool
+}
+
+// TokenDB keeps API tokens in a database.
+type TokenDB interface {
+	// CreateToken saves a new token record and returns its id. The ID
+	// field of the record is ignored.
+	CreateToken(record TokenRecord) (int64, error)
+
+	// GetToken returns the token with the given id, or nil if there is none.
+	GetToken(id int64) (*TokenRecord, error)
+
+	// FindToken returns the token having the given hash, or nil if there is
+	// none.
+	FindToken(hash string) (*TokenRecord, error)
+
+	// ListTokens returns every token, in order of id.
+	ListTokens() ([]TokenRecord, error)
+
+	// SetTokenDisabled disables or re-enables the given token.
+	SetTokenDisabled(id int64, disabled bool) error
+
+	// TouchToken sets the last used time of the given token.
+	TouchToken(id int64, when time.Time) error
+
+	// DeleteToken removes the given token.
+	DeleteToken(id int64) error
+}
+
+// hashToken returns the hash of token as it is stored in a TokenDB.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// A DBValidator is a TokenValidator using the tokens in a TokenDB. Tokens
+// which are disabled or expired are not valid.
+type DBValidator struct {
+	DB TokenDB
+}
+
+// how often to update the last used time of a token. This is to avoid a
+// database write on every request.
+const tokenTouchInterval = time.Minute
+
+// TokenValid returns the user and role of the given token.
+func (v DBValidator) TokenValid(token string) (string, Role, error) {
+	user, role, _, err := v.TokenScope(token)
+	return user, role, err
+}
+
+// TokenScope returns the user, role, and scope of the given token.
+func (v DBValidator) TokenScope(token string) (string, Role, Scope, error) {
+	if token == "" {
+		return "", RoleUnknown, nil, nil
+	}
+	record, err := v.DB.FindToken(hashToken(token))
+	if err != nil {
+		return "", RoleUnknown, nil, err
+	}
+	now := time.Now()
+	if record == nil ||
+		record.Disabled ||
+		(!record.Expires.IsZero() && now.After(record.Expires)) {
+		return "", RoleUnknown, nil, nil
+	}
+	if now.Sub(record.LastUsed) > tokenTouchInterval {
+		err = v.DB.TouchToken(record.ID, now)
+		if err != nil {
+			log.Println("TouchToken:", err)
+		}
+	}
+	return record.User, record.Role, record.Scope, nil
+}
+
+// A NewToken is returned when a token is made. It is the only time the
+// token itself is available.
+type NewToken struct {
+	TokenRecord
+	Token string
+}
+
+// ListTokensHandler handles requests to GET /admin/tokens
+func (s *RESTServer) ListTokensHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.TokenDatabase == nil {
+		writeNoTokenDatabase(w)
+		return
+	}
+	result, err := s.TokenDatabase.ListTokens()
+	if err != nil {
+		log.Println("ListTokens:", err)
+		raven.CaptureError(err, nil)
+		w.WriteHeader(500)
+		fmt.Fprintln(w, err)
+		return
+	}
+	writeHTMLorJSON(w, r, listTokensTemplate, result)
+}
+
+// CreateTokenHandler handles requests to POST /admin/tokens
+//
+// The parameters "user" and "role" are required. The parameter "expires" is
+// optional, and gives how long the token is valid as a duration, e.g. "720h".
+// The optional parameter "items" limits the token to the items matching a
+// list of patterns, as given to ParseScope.
+//
+// Tokens may not be made using a token which is itself limited to some items,
+// since the new token could then have a wider scope.
+func (s *RESTServer) CreateTokenHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	if s.TokenDatabase == nil {
+		writeNoTokenDatabase(w)
+		return
+	}
+	if requestScope(r) != nil {
+		w.WriteHeader(403)
+		fmt.Fprintln(w, "A token limited to some items cannot make tokens")
+		return
+	}
+	user := r.FormValue("user")
+	role := AtoRole(r.FormValue("role"))
+	if user == "" || role == RoleUnknown {
+		w.WriteHeader(400)
+		fmt.Fprintln(w, "A user and a role are required")
+		return
+	}
+	now := time.Now()
+	record := TokenRecord{
+		User:    user,
+		Role:    role,
+		Scope:   ParseScope(r.FormValue("items")),
+		Created: now,
+		Creator: ps.ByName("username"),
+	}
+	if v := r.FormValue("expires"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "Bad expires value %q\n", v)
+			return
+		}
+		record.Expires = now.Add(d)
+	}
+	var b [32]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintln(w, err)
+		return
+	}
+	token := base64.RawURLEncoding.EncodeToString(b[:])
+	record.Hash = hashToken(token)
+	record.ID, err = s.TokenDatabase.CreateToken(record)
+	if err != nil {
+		log.Println("CreateToken:", err)
+		raven.CaptureError(err, nil)
+		w.WriteHeader(500)
+		fmt.Fprintln(w, err)
+		return
+	}
+	log.Printf("Token %d for %s (%s) created by %s", record.ID, user, role, record.Creator)
+	w.Header().Set("Location", fmt.Sprintf("/admin/tokens/%d", record.ID))
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(201)
+	json.NewEncoder(w).Encode(NewToken{TokenRecord: record, Token: token})
+}
+
+// GetTokenHandler handles requests to GET /admin/tokens/:id
+func (s *RESTServer) GetTokenHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	record := s.findTokenRecord(w, ps)
+	if record == nil {
+		return
+	}
+	writeHTMLorJSON(w, r, tokenInfoTemplate, record)
+}
+
+// DisableTokenHandler handles requests to PUT /admin/tokens/:id/:action
+// where the action is either "disable" or "enable".
+func (s *RESTServer) DisableTokenHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	var disable bool
+	switch ps.ByName("action") {
+	case "disable":
+		disable = true
+	case "enable":
+		disable = false
+	default:
+		w.WriteHeader(404)
+		return
+	}
+	record := s.findTokenRecord(w, ps)
+	if record == nil {
+		return
+	}
+	err := s.TokenDatabase.SetTokenDisabled(record.ID, disable)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintln(w, err)
+		return
+	}
+	log.Printf("Token %d for %s %sd by %s", record.ID, record.User, ps.ByName("action"), ps.ByName("username"))
+}
+
+// RevokeTokenHandler handles requests to DELETE /admin/tokens/:id
+//
+// The token is removed and cannot be used again.
+func (s *RESTServer) RevokeTokenHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	record := s.findTokenRecord(w, ps)
+	if record == nil {
+		return
+	}
+	err := s.TokenDatabase.DeleteToken(record.ID)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintln(w, err)
+		return
+	}
+	log.Printf("Token %d for %s revoked by %s", record.ID, record.User, ps.ByName("username"))
+}
+
+// findTokenRecord returns the token record given by the "id" parameter. If
+// there is none, an error is written to w and nil is returned.
+func (s *RESTServer) findTokenRecord(w http.ResponseWriter, ps httprouter.Params) *TokenRecord {
+	if s.TokenDatabase == nil {
+		writeNoTokenDatabase(w)
+		return nil
+	}
+	id, err := strconv.ParseInt(ps.ByName("id"), 10, 64)
+	if err != nil {
+		w.WriteHeader(404)
+		fmt.Fprintln(w, "cannot find token")
+		return nil
+	}
+	record, err := s.TokenDatabase.GetToken(id)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintln(w, err)
+		return nil
+	}
+	if record == nil {
+		w.WriteHeader(404)
+		fmt.Fprintln(w, "cannot find token")
+	}
+	return record
+}
+
+func writeNoTokenDatabase(w http.ResponseWriter) {
+	w.WriteHeader(503)
+	fmt.Fprintln(w, "No token database")
+}
+
+var (
+	listTokensTemplate = template.Must(template.New("listtokens").Parse(`<html>
+	<h1>API Tokens</h1>
+	<table><thead><tr>
+		<th>ID</th>
+		<th>User</th>
+		<th>Role</th>
+		<th>Items</th>
+		<th>Created</th>
+		<th>Expires</th>
+		<th>Last Used</th>
+		<th>Disabled</th>
+	</tr></thead><tbody>
+	{{ range . }}
+	<tr>
+		<td><a href="/admin/tokens/{{ .ID }}">{{ .ID }}</a></td>
+		<td>{{ .User }}</td>
+		<td>{{ .Role }}</td>
+		<td>{{ if .Scope }}{{ .Scope }}{{ else }}All{{ end }}</td>
+		<td>{{ .Created.Format "2006-01-02 15:04" }} by {{ .Creator }}</td>
+		<td>{{ if not .Expires.IsZero }}{{ .Expires.Format "2006-01-02 15:04" }}{{ end }}</td>
+		<td>{{ if not .LastUsed.IsZero }}{{ .LastUsed.Format "2006-01-02 15:04" }}{{ end }}</td>
+		<td>{{ if .Disabled }}Yes{{ end }}</td>
+	</tr>
+	{{ else }}
+	<tr><td colspan="8">No tokens</td></tr>
+	{{ end }}
+	</tbody></table>
+	</html>`))
+
+	tokenInfoTemplate = template.Must(template.New("tokeninfo").Parse(`<html>
+	<h1>API Token {{ .ID }}</h1>
+	<dl>
+	<dt>User</dt><dd>{{ .User }}</dd>
+	<dt>Role</dt><dd>{{ .Role }}</dd>
+	<dt>Items</dt><dd>{{ if .Scope }}{{ .Scope }}{{ else }}All{{ end }}</dd>
+	<dt>Created</dt><dd>{{ .Created.Format "2006-01-02 15:04" }} by {{ .Creator }}</dd>
+	<dt>Expires</dt><dd>{{ if not .Expires.IsZero }}{{ .Expires.Format "2006-01-02 15:04" }}{{ else }}Never{{ end }}</dd>
+	<dt>Last Used</dt><dd>{{ if not .LastUsed.IsZero }}{{ .LastUsed.Format "2006-01-02 15:04" }}{{ end }}</dd>
+	<dt>Disabled</dt><dd>{{ if .Disabled }}Yes{{ else }}No{{ end }}</dd>
+	</dl>
+	<a href="/admin/tokens">Back</a>
+	</html>`))
+)
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func runTokenSequence(t *testing.T, db TokenDB) {
+	now := time.Now().Truncate(time.Second)
+	id, err := db.CreateToken(TokenRecord{
+		User:    "a",
+		Role:    RoleWrite,
+		Scope:   Scope{"und:etd*", "und:abc"},
+		Hash:    hashToken("1234"),
+		Created: now,
+		Creator: "admin",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := db.FindToken(hashToken("1234"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record == nil || record.ID != id || record.User != "a" || record.Role != RoleWrite {
+		t.Fatalf("Received %v", record)
+	}
+	if record.Scope.String() != "und:etd* und:abc" {
+		t.Errorf("Received scope %v", record.Scope)
+	}
+	if !record.Created.Equal(now) || !record.Expires.IsZero() || !record.LastUsed.IsZero() {
+		t.Errorf("Received times %v, %v, %v", record.Created, record.Expires, record.LastUsed)
+	}
+
+	err = db.SetTokenDisabled(id, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.TouchToken(id, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, _ = db.GetToken(id)
+	if record == nil || !record.Disabled || !record.LastUsed.Equal(now) {
+		t.Errorf("Received %v", record)
+	}
+
+	list, err := db.ListTokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Errorf("Received %d tokens, expected 1", len(list))
+	}
+
+	err = db.DeleteToken(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err = db.GetToken(id)
+	if record != nil || err != nil {
+		t.Errorf("Received %v, %v for deleted token", record, err)
+	}
+}
+
+func TestDBValidator(t *testing.T) {
+	db, err := NewQlCache("mem--dbvalidator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.db.Close()
+	now := time.Now()
+	var table = []struct {
+		token  string
+		record TokenRecord
+		user   string
+	}{
+		{"valid", TokenRecord{User: "a", Role: RoleRead}, "a"},
+		{"future", TokenRecord{User: "b", Role: RoleRead, Expires: now.Add(time.Hour)}, "b"},
+		{"expired", TokenRecord{User: "c", Role: RoleRead, Expires: now.Add(-time.Hour)}, ""},
+		{"disabled", TokenRecord{User: "d", Role: RoleRead, Disabled: true}, ""},
+	}
+	for _, tab := range table {
+		tab.record.Hash = hashToken(tab.token)
+		tab.record.Created = now
+		_, err := db.CreateToken(tab.record)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	v := DBValidator{DB: db}
+	for _, tab := range table {
+		user, _, err := v.TokenValid(tab.token)
+		if err != nil {
+			t.Error(err)
+		}
+		if user != tab.user {
+			t.Errorf("%s: received user %q, expected %q", tab.token, user, tab.user)
+		}
+	}
+	if user, _, _ := v.TokenValid("unknown"); user != "" {
+		t.Errorf("Received user %q for unknown token", user)
+	}
+	record, _ := db.FindToken(hashToken("valid"))
+	if record == nil || record.LastUsed.IsZero() {
+		t.Errorf("Last used time not set: %v", record)
+	}
+}
+
+func TestTokenHandlers(t *testing.T) {
+	user := randomid()
+	// missing or bad parameters
+	for _, params := range []string{"role=read", "user=a", "user=a&role=xyz", "user=a&role=read&expires=-1h"} {
+		resp := postForm(t, "/admin/tokens", params)
+		resp.Body.Close()
+		if resp.StatusCode != 400 {
+			t.Errorf("%s: received status %d, expected 400", params, resp.StatusCode)
+		}
+	}
+
+	resp := postForm(t, "/admin/tokens", "user="+user+"&role=write&expires=24h&items=und:etd*")
+	defer resp.Body.Close()
+	if resp.StatusCode != 201 {
+		t.Fatalf("Received status %d, expected 201", resp.StatusCode)
+	}
+	var created NewToken
+	err := json.NewDecoder(resp.Body).Decode(&created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Token == "" || created.User != user || created.Role != RoleWrite || created.Creator != "nobody" ||
+		!created.Scope.Allows("und:etd1") || created.Scope.Allows("und:abc") {
+		t.Errorf("Received %v", created)
+	}
+	location := resp.Header.Get("Location")
+
+	body := getbody(t, "GET", "/admin/tokens", 200)
+	if !strings.Contains(body, user) {
+		t.Errorf("Token for %s not in list", user)
+	}
+	body = getbody(t, "GET", location, 200)
+	if strings.Contains(body, created.Token) {
+		t.Errorf("Token record contains the token: %s", body)
+	}
+
+	checkStatus(t, "PUT", location+"/disable", 200)
+	checkStatus(t, "PUT", location+"/frob", 404)
+	var record TokenRecord
+	json.Unmarshal([]byte(getbody(t, "GET", location, 200)), &record)
+	if !record.Disabled {
+		t.Errorf("Token was not disabled")
+	}
+	checkStatus(t, "PUT", location+"/enable", 200)
+
+	// the record can be shown as a web page too
+	resp, err = http.Get(testServer.URL + location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 || !strings.Contains(string(b), "<dd>"+user+"</dd>") {
+		t.Errorf("Received status %d: %s", resp.StatusCode, b)
+	}
+
+	checkStatus(t, "DELETE", location, 200)
+	for _, route := range []string{location, "/admin/tokens/xyz"} {
+		body = getbody(t, "GET", route, 404)
+		if !strings.Contains(body, "cannot find token") {
+			t.Errorf("%s: received %q", route, body)
+		}
+	}
+}
+
+// postForm sends a POST request to route with the given url encoded form.
+func postForm(t *testing.T, route, form string) *http.Response {
+	values, _ := url.ParseQuery(form)
+	resp, err := http.PostForm(testServer.URL+route, values)
+	if err != nil {
+		t.Fatal(route, err)
+	}
+	return resp
+}
@@ -16,8 +16,21 @@ import (
 )
 
 // ListTxHandler handles requests to GET /transaction
+//
+// Only transactions on items in the scope of the token are listed.
 func (s *RESTServer) ListTxHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	writeHTMLorJSON(w, r, listTxTemplate, s.TxStore.List())
+	result := s.TxStore.List()
+	if scope := requestScope(r); scope != nil {
+		var allowed []string
+		for _, txid := range result {
+			tx := s.TxStore.Lookup(txid)
+			if tx != nil && scope.Allows(tx.ItemID) {
+				allowed = append(allowed, txid)
+			}
+		}
+		result = allowed
+	}
+	writeHTMLorJSON(w, r, listTxTemplate, result)
 }
 
 var (
@@ -42,6 +55,9 @@ func (s *RESTServer) TxInfoHandler(w http.ResponseWriter, r *http.Request, ps ht
 		fmt.Fprintln(w, "cannot find transaction")
 		return
 	}
+	if !checkScope(w, r, tx.ItemID) {
+		return
+	}
 	tx.M.RLock()
 	defer tx.M.RUnlock()
 	writeHTMLorJSON(w, r, txInfoTemplate, tx)
@@ -84,6 +100,7 @@ func (s *RESTServer) NewTxHandler(w http.ResponseWriter, r *http.Request, ps htt
 	}
 	w.Header().Set("Location", "/transaction/"+tx.ID)
 	tx.Creator = ps.ByName("username")
+	tx.RequestID = requestID(r)
 	// TODO(dbrower): use a limit reader to 1MB(?) for this
 	var cmds [][]string
 	err = json.NewDecoder(r.Body).Decode(&cmds)
@@ -100,6 +117,16 @@ func (s *RESTServer) NewTxHandler(w http.ResponseWriter, r *http.Request, ps htt
 		fmt.Fprintln(w, err.Error())
 		return
 	}
+	// the uploaded files must belong to the user making the transaction
+	for _, fid := range tx.ReferencedFiles() {
+		f := s.FileStore.Lookup(fid)
+		if f != nil && !canUseFile(r, f) {
+			tx.SetStatus(transaction.StatusError)
+			w.WriteHeader(403)
+			fmt.Fprintln(w, "Upload", fid, "belongs to another user")
+			return
+		}
+	}
 	tx.SetStatus(transaction.StatusWaiting)
 	s.txqueue <- tx.ID
 	w.WriteHeader(202)
@@ -130,10 +157,11 @@ func (s *RESTServer) transactionWorker(queue <-chan string) {
 			// ignore and get next transaction
 			continue
 		}
-		log.Printf("Starting transaction %s on %s (%s)",
+		log.Printf("Starting transaction %s on %s (%s) request %s",
 			tx.ID,
 			tx.ItemID,
-			tx.Status.String())
+			tx.Status.String(),
+			tx.RequestID)
 		start := time.Now()
 		switch tx.Status {
 		default:
@@ -163,8 +191,13 @@ func (s *RESTServer) transactionWorker(queue <-chan string) {
 			tx.Commit(*s.Items, s.FileStore, s.Cache)
 		}
 	out:
+		s.auditCommit(tx)
 		duration := time.Now().Sub(start)
-		log.Printf("Finish transaction %s on %s (%s)", tx.ID, tx.ItemID, duration.String())
+		log.Printf("Finish transaction %s on %s (%s) request %s",
+			tx.ID,
+			tx.ItemID,
+			duration.String(),
+			tx.RequestID)
 
 		xTransactionTime.Add(duration.Seconds())
 		xTransactionCount.Add(1)
@@ -269,6 +302,9 @@ func (s *RESTServer) CancelTxHandler(w http.ResponseWriter, r *http.Request, ps
 		fmt.Fprintln(w, "cannot find transaction")
 		return
 	}
+	if !checkScope(w, r, tx.ItemID) {
+		return
+	}
 	if !(tx.Status == transaction.StatusFinished ||
 		tx.Status == transaction.StatusError) {
 		w.WriteHeader(400)
@@ -17,8 +17,58 @@ import (
 )
 
 // ListFileHandler handles requests to GET /upload
+//
+// Only the uploads the user may use are listed.
 func (s *RESTServer) ListFileHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	writeHTMLorJSON(w, r, listFileTemplate, s.FileStore.List())
+	var result []string
+	for _, id := range s.FileStore.List() {
+		f := s.FileStore.Lookup(id)
+		if f != nil && canUseFile(r, f) {
+			result = append(result, id)
+		}
+	}
+	writeHTMLorJSON(w, r, listFileTemplate, result)
+}
+
+// canUseFile returns whether the request r may use the uploaded file f.
+// Uploads belong to the user who made them, and may only be used with a token
+// of that user having the same scope as the one which made them. An Admin
+// whose token is not limited to some items may use any of them. Uploads made
+// before uploads had owners may be used by anyone.
+func canUseFile(r *http.Request, f fragment.FileEntry) bool {
+	info := getRequestInfo(r)
+	if info == nil {
+		return false
+	}
+	stat := f.Stat()
+	return stat.Creator == "" ||
+		(stat.Creator == info.User && stat.Scope == info.Scope.String()) ||
+		(info.Role == RoleAdmin && info.Scope == nil)
+}
+
+// setFileOwner records the user and the scope of the token making the
+// request r as the owner of the new upload f.
+func setFileOwner(r *http.Request, ps httprouter.Params, f fragment.FileEntry) {
+	f.SetCreator(ps.ByName("username"))
+	f.SetScope(requestScope(r).String())
+}
+
+// lookupFile returns the uploaded file given by the "fileid" parameter. If
+// there is no such file, or if the request may not use it, an error is
+// written to w and nil is returned.
+func (s *RESTServer) lookupFile(w http.ResponseWriter, r *http.Request, ps httprouter.Params) fragment.FileEntry {
+	f := s.FileStore.Lookup(ps.ByName("fileid"))
+	if f == nil {
+		w.WriteHeader(404)
+		fmt.Fprintln(w, "cannot find file")
+		return nil
+	}
+	if !canUseFile(r, f) {
+		w.WriteHeader(403)
+		fmt.Fprintln(w, "file belongs to another user")
+		return nil
+	}
+	return f
 }
 
 var (
@@ -36,11 +86,8 @@ var (
 
 // GetFileInfoHandler handles requests to GET /upload/:fileid/metadata
 func (s *RESTServer) GetFileInfoHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	id := ps.ByName("fileid")
-	f := s.FileStore.Lookup(id)
+	f := s.lookupFile(w, r, ps)
 	if f == nil {
-		w.WriteHeader(404)
-		fmt.Fprintln(w, "cannot find file")
 		return
 	}
 	fstat := f.Stat()
@@ -86,10 +133,13 @@ func (s *RESTServer) AppendFileHandler(w http.ResponseWriter, r *http.Request, p
 			id := randomid()
 			f = s.FileStore.New(id)
 		}
+		setFileOwner(r, ps, f)
 	} else {
 		// New returns nil if the file already exists!
 		f = s.FileStore.New(fileid)
-		if f == nil {
+		if f != nil {
+			setFileOwner(r, ps, f)
+		} else {
 			f = s.FileStore.Lookup(fileid)
 		}
 		// f should not be nil at this point...
@@ -98,6 +148,11 @@ func (s *RESTServer) AppendFileHandler(w http.ResponseWriter, r *http.Request, p
 			fmt.Fprintln(w, "could not make new file")
 			return
 		}
+		if !canUseFile(r, f) {
+			w.WriteHeader(403)
+			fmt.Fprintln(w, "file belongs to another user")
+			return
+		}
 	}
 	if r.Body == nil {
 		w.WriteHeader(400)
@@ -172,6 +227,11 @@ func randomid() string {
 // holding area.
 func (s *RESTServer) DeleteFileHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	fileid := ps.ByName("fileid")
+	if f := s.FileStore.Lookup(fileid); f != nil && !canUseFile(r, f) {
+		w.WriteHeader(403)
+		fmt.Fprintln(w, "file belongs to another user")
+		return
+	}
 	err := s.FileStore.Delete(fileid)
 	if err != nil {
 		w.WriteHeader(500)
@@ -181,11 +241,8 @@ func (s *RESTServer) DeleteFileHandler(w http.ResponseWriter, r *http.Request, p
 
 // SetFileInfoHandler handles requests to PUT /upload/:fileid/metadata
 func (s *RESTServer) SetFileInfoHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	fileid := ps.ByName("fileid")
-	f := s.FileStore.Lookup(fileid)
+	f := s.lookupFile(w, r, ps)
 	if f == nil {
-		w.WriteHeader(404)
-		fmt.Fprintln(w, "cannot find file")
 		return
 	}
 	// TODO(dbrower): use a limit reader to 1MB(?) for this
@@ -206,11 +263,8 @@ func (s *RESTServer) SetFileInfoHandler(w http.ResponseWriter, r *http.Request,
 
 // GetFileHandler handles requests to GET /upload/:fileid
 func (s *RESTServer) GetFileHandler(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	fileid := ps.ByName("fileid")
-	f := s.FileStore.Lookup(fileid)
+	f := s.lookupFile(w, r, ps)
 	if f == nil {
-		w.WriteHeader(404)
-		fmt.Fprintln(w, "Unknown file identifier")
 		return
 	}
 	fd := f.Open()
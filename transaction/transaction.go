@@ -139,18 +139,19 @@ func (r *Store) Delete(id string) error {
 
 // Transaction Represents a single transaction.
 type Transaction struct {
-	txstore  *fragment.JSONStore // where this structure is stored
-	files    *fragment.Store     // Where files are stored
-	M        sync.RWMutex        // protects everything below
-	ID       string              // the id of this transaction
-	Status   Status              // one of Status*
-	Started  time.Time           // time tx was created
-	Modified time.Time           // last time user touch or added a file
-	Err      []string            // list of errors (for StatusError)
-	Creator  string              // username of the committer
-	ItemID   string              // ID of the item this tx is modifying
-	Commands []command           // commands to run on commit
-	BlobMap  map[string]int      // tracks the blob id we used for uploaded files
+	txstore   *fragment.JSONStore // where this structure is stored
+	files     *fragment.Store     // Where files are stored
+	M         sync.RWMutex        // protects everything below
+	ID        string              // the id of this transaction
+	Status    Status              // one of Status*
+	Started   time.Time           // time tx was created
+	Modified  time.Time           // last time user touch or added a file
+	Err       []string            // list of errors (for StatusError)
+	Creator   string              // username of the committer
+	RequestID string              // id of the request which made this tx
+	ItemID    string              // ID of the item this tx is modifying
+	Commands  []command           // commands to run on commit
+	BlobMap   map[string]int      // tracks the blob id we used for uploaded files
 }
 
 // The Status of a transaction.